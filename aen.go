@@ -0,0 +1,175 @@
+package megaraid
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// MegasasRegisterAen 用 MEGASAS_IOC_GET_AEN 让驱动向固件注册序号从 seq 开始、符合 filter 的异步事件通知(AEN).
+// 驱动自己已经注册了范围更大的 AEN 时什么也不做, 否则取消旧的注册, 按两者的并集重新注册.
+// 事件发生时驱动向所有在 ioctl 节点上设置了 O_ASYNC 的进程发送 SIGIO, 并自动注册下一个序号, 不需要再次调用
+func (m *MegasasIoctl) MegasasRegisterAen(ctx context.Context, instance *Instance, seq uint32, filter EventFilter) error {
+	aen := megasas_aen{host_no: instance.HostNo, seq_num: seq, class_locale_word: filter.word()}
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, &aen)
+	if err := m.ioctl(ctx, instance.HostNo, MEGASAS_IOC_GET_AEN, b.Bytes()); err != nil {
+		return fmt.Errorf("register aen: %w", err)
+	}
+	return nil
+}
+
+// enableAsync 让驱动把 SIGIO 发送给本进程, 多个 Aen 共用 fd, 按引用计数打开和关闭 O_ASYNC
+func (m *MegasasIoctl) enableAsync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.async == 0 {
+		if _, err := unix.FcntlInt(uintptr(m.fd), unix.F_SETOWN, os.Getpid()); err != nil {
+			return fmt.Errorf("F_SETOWN: %w", err)
+		}
+		flags, err := unix.FcntlInt(uintptr(m.fd), unix.F_GETFL, 0)
+		if err != nil {
+			return fmt.Errorf("F_GETFL: %w", err)
+		}
+		// 设置 O_ASYNC 时内核调用驱动的 fasync, 把 fd 加入驱动的通知队列
+		if _, err := unix.FcntlInt(uintptr(m.fd), unix.F_SETFL, flags|unix.O_ASYNC); err != nil {
+			return fmt.Errorf("F_SETFL: %w", err)
+		}
+	}
+	m.async++
+	return nil
+}
+
+func (m *MegasasIoctl) disableAsync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.async--
+	if m.async > 0 {
+		return nil
+	}
+	flags, err := unix.FcntlInt(uintptr(m.fd), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	_, err = unix.FcntlInt(uintptr(m.fd), unix.F_SETFL, flags&^unix.O_ASYNC)
+	return err
+}
+
+// Aen 是一个 AEN 注册. C 只是"可能有新事件"的提示, 收到后应该用 EventReader 从上次的位置读取:
+// SIGIO 是进程级的, 多次事件可能合并为一个信号, 驱动对任何控制器、以及它自己注册的 debug 级别事件都会发送,
+// 本进程其他设置了 O_ASYNC 的 fd 也会产生 SIGIO, 所以读取时可能没有新事件, 也可能有多条
+type Aen struct {
+	C <-chan struct{}
+
+	m     *MegasasIoctl
+	sig   chan os.Signal
+	done  chan struct{}
+	close sync.Once
+	err   error
+}
+
+// RegisterAen 注册 seq 开始、符合 filter 的事件通知. seq 之后已经有事件时, 驱动会立即发送一次 SIGIO.
+// 不再需要时调用 Close
+func (c *Controller) RegisterAen(ctx context.Context, seq uint32, filter EventFilter) (*Aen, error) {
+	// 先接收信号再打开 O_ASYNC, 注册期间的事件不会丢失. Go 对没有 Notify 的 SIGIO 不做处理, 不会退出进程
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGIO)
+	if err := c.m.enableAsync(); err != nil {
+		signal.Stop(sig)
+		return nil, err
+	}
+	err := c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		return m.MegasasRegisterAen(ctx, instance, seq, filter)
+	})
+	if err != nil {
+		c.m.disableAsync()
+		signal.Stop(sig)
+		return nil, err
+	}
+
+	ch := make(chan struct{}, 1)
+	a := &Aen{C: ch, m: c.m, sig: sig, done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case <-sig:
+			case <-a.done:
+				return
+			}
+			// 通知没有被取走时合并
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return a, nil
+}
+
+// Close 停止接收通知. 固件中的 AEN 注册由驱动管理, 不会被取消
+func (a *Aen) Close() error {
+	a.close.Do(func() {
+		a.err = a.m.disableAsync()
+		signal.Stop(a.sig)
+		close(a.done)
+	})
+	return a.err
+}
+
+// EventBatch 是 WatchEvents 一次唤醒读取到的事件, Err 同 EventReader.Read 返回的错误, 可能是 *EventGap.
+// Cursor 是读取之后的位置, 事件处理完后可以保存到 Checkpoint
+type EventBatch struct {
+	Events []Event
+	Cursor EventCursor
+	Err    error
+}
+
+// WatchEvents 为 r 注册 AEN, 每次收到通知后用 r 读取新事件并发送到返回的 channel, 没有新事件且没有错误时不发送.
+// 注册之后会先读取一次, 不会漏掉注册之前的事件. timeout 限制每次读取的时间, 0 为不限制.
+// ctx 结束后关闭 channel, 在此之前不能在其他地方使用 r
+func (c *Controller) WatchEvents(ctx context.Context, r *EventReader, timeout time.Duration) (<-chan EventBatch, error) {
+	a, err := c.RegisterAen(ctx, r.Next, r.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan EventBatch)
+	go func() {
+		defer close(out)
+		defer a.Close()
+		for {
+			rctx, cancel := ctx, context.CancelFunc(func() {})
+			if timeout > 0 {
+				rctx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			events, err := r.Read(rctx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if len(events) > 0 || err != nil {
+				select {
+				case out <- EventBatch{Events: events, Cursor: r.Cursor(), Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-a.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,247 @@
+// Package alert 把固件事件日志和轮询发现的变化转发到 webhook、syslog 和 journald,
+// 每个 sink 可以配置最低级别和去重窗口
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/health"
+)
+
+// 事件来源
+const (
+	SourceFirmware = "firmware" // 固件事件日志
+	SourcePoll     = "poll"     // 两次快照的差异
+)
+
+// Event 是要转发的一条事件
+type Event struct {
+	Time     time.Time
+	HostNo   uint16
+	Source   string
+	Type     string // 固件事件为 code, 例如 0x0071; 轮询事件为 megaraid.ChangeType
+	Severity health.Severity
+	Object   string // controller、pd 252:3、pd did 8、ld 0
+	Message  string
+	SeqNum   uint32 `json:",omitempty"` // 固件事件的序号
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%s: host %d %s %s", e.Severity, e.HostNo, e.Object, e.Message)
+}
+
+// key 相同的事件在去重窗口内只发送一次, 固件事件的序号和时间不参与比较
+func (e *Event) key() string {
+	return strings.Join([]string{fmt.Sprint(e.HostNo), e.Source, e.Type, e.Object, e.Message}, "\x00")
+}
+
+// FromFirmware 转换固件事件, 控制器时间未设置时用 now
+func FromFirmware(hostNo uint16, fe *megaraid.Event, now time.Time) Event {
+	e := Event{
+		Time:    fe.Time,
+		HostNo:  hostNo,
+		Source:  SourceFirmware,
+		Type:    fmt.Sprintf("%#04x", fe.Code),
+		Object:  fe.Object(),
+		Message: fe.Description,
+		SeqNum:  fe.SeqNum,
+	}
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	switch {
+	case fe.Class >= megaraid.EventClass(megaraid.MR_EVT_CLASS_CRITICAL):
+		e.Severity = health.Critical
+	case fe.Class == megaraid.EventClass(megaraid.MR_EVT_CLASS_WARNING):
+		e.Severity = health.Warning
+	default:
+		e.Severity = health.Info
+	}
+	return e
+}
+
+// FromGap 报告读取固件事件日志时有事件已经被清除或覆盖
+func FromGap(hostNo uint16, gap *megaraid.EventGap, now time.Time) Event {
+	return Event{
+		Time:     now,
+		HostNo:   hostNo,
+		Source:   SourceFirmware,
+		Type:     "EventGap",
+		Severity: health.Warning,
+		Object:   "controller",
+		Message:  gap.Error(),
+	}
+}
+
+// FromChange 转换两次快照之间的变化, 级别与 health 的内置规则一致
+func FromChange(c *megaraid.Change, t time.Time) Event {
+	msg := c.Type.String()
+	if c.Property != "" {
+		msg += " " + c.Property
+	}
+	if c.Old != "" || c.New != "" {
+		msg += fmt.Sprintf(": %s -> %s", c.Old, c.New)
+	}
+	return Event{
+		Time:     t,
+		HostNo:   c.HostNo,
+		Source:   SourcePoll,
+		Type:     c.Type.String(),
+		Severity: changeSeverity(c),
+		Object:   c.Object,
+		Message:  msg,
+	}
+}
+
+func changeSeverity(c *megaraid.Change) health.Severity {
+	switch c.Type {
+	case megaraid.ChangeControllerRemoved:
+		return health.Critical
+	case megaraid.ChangePdState:
+		switch c.New {
+		case "Failed", "Offline", "UBad":
+			return health.Critical
+		}
+	case megaraid.ChangeLdState:
+		if c.New != "Optimal" {
+			return health.Critical
+		}
+	case megaraid.ChangePdRemoved, megaraid.ChangeLdDeleted, megaraid.ChangePredictiveFailure, megaraid.ChangeErrorCount, megaraid.ChangeHotSpareRemoved:
+		return health.Warning
+	case megaraid.ChangeProperty:
+		if c.Object == "bbu" && c.New == "false" {
+			return health.Warning
+		}
+	}
+	return health.Info
+}
+
+// PermanentError 表示重试也不会成功的错误, 例如模板对这条事件渲染出无效的 JSON, 或者 webhook 拒绝了请求.
+// 调用方应该记录后跳过这条事件, 不要让它阻塞之后的事件
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent 把 err 标记为 PermanentError, err 为 nil 时返回 nil
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent 判断 err 是否是 PermanentError, 其他错误都可以重试
+func IsPermanent(err error) bool {
+	var p *PermanentError
+	return errors.As(err, &p)
+}
+
+// Sink 是事件的目的地, Send 可能被多个 goroutine 同时调用. 重试也不会成功的错误用 Permanent 标记
+type Sink interface {
+	Send(ctx context.Context, e *Event) error
+	Close() error
+}
+
+// Route 把不低于 MinSeverity 的事件发送到 Sink
+type Route struct {
+	Name        string // 出错时用于区分 sink, 同一个 Dispatcher 中唯一, alertd 用它保存每个 sink 的发送位置
+	Sink        Sink
+	MinSeverity health.Severity
+	Dedup       time.Duration // 相同的事件在窗口内只发送一次, 0 为不去重
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// suppress 判断事件是否在去重窗口内, 发送时间由 sent 在发送成功后记录
+func (r *Route) suppress(e *Event, now time.Time) bool {
+	if r.Dedup <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+	for k, t := range r.seen {
+		if now.Sub(t) >= r.Dedup {
+			delete(r.seen, k)
+		}
+	}
+	_, ok := r.seen[e.key()]
+	return ok
+}
+
+// sent 记录事件的发送时间, 发送失败的事件不记录, 下次仍然会发送
+func (r *Route) sent(e *Event, now time.Time) {
+	if r.Dedup <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+	r.seen[e.key()] = now
+}
+
+// Dispatcher 把事件分发到所有 Route
+type Dispatcher struct {
+	Routes []*Route
+	Now    func() time.Time // 去重用的时钟, nil 时为 time.Now
+}
+
+// Dispatch 按顺序把 events 发送到所有 Route, 一个 sink 失败不影响其他 sink, 返回所有失败.
+// Dispatch 不重试, 需要重试时应该像 alertd 一样按 Route 记录发送到哪里, 用 Send 只向失败的 Route 重新发送
+func (d *Dispatcher) Dispatch(ctx context.Context, events ...Event) error {
+	var errs []error
+	for i := range events {
+		for _, r := range d.Routes {
+			if err := d.Send(ctx, r, &events[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Send 把一条事件发送到 r, 低于 MinSeverity 或在去重窗口内的事件直接返回 nil, 发送成功后才记录去重时间.
+// 返回的错误带有 Route 的名字, 可以用 IsPermanent 判断是否需要重试
+func (d *Dispatcher) Send(ctx context.Context, r *Route, e *Event) error {
+	now := time.Now
+	if d.Now != nil {
+		now = d.Now
+	}
+	if e.Severity < r.MinSeverity || r.suppress(e, now()) {
+		return nil
+	}
+	if err := r.Sink.Send(ctx, e); err != nil {
+		return fmt.Errorf("%s: %w", r.Name, err)
+	}
+	r.sent(e, now())
+	return nil
+}
+
+func (d *Dispatcher) Close() error {
+	var errs []error
+	for _, r := range d.Routes {
+		errs = append(errs, r.Sink.Close())
+	}
+	return errors.Join(errs...)
+}
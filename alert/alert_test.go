@@ -0,0 +1,371 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/health"
+)
+
+var t0 = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Send(ctx context.Context, e *Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, *e)
+	return nil
+}
+
+func (r *recorder) Close() error { return nil }
+
+func TestDispatcher(t *testing.T) {
+	all, critical := &recorder{}, &recorder{}
+	now := t0
+	d := &Dispatcher{
+		Routes: []*Route{
+			{Name: "all", Sink: all},
+			{Name: "critical", Sink: critical, MinSeverity: health.Critical, Dedup: 10 * time.Minute},
+		},
+		Now: func() time.Time { return now },
+	}
+
+	failed := Event{HostNo: 0, Source: SourcePoll, Type: "PdState", Severity: health.Critical, Object: "pd 252:1", Message: "PdState: Online -> Failed"}
+	info := Event{HostNo: 0, Source: SourceFirmware, Type: "0x0071", Severity: health.Info, Object: "controller", Message: "Time established"}
+	ctx := context.Background()
+	if err := d.Dispatch(ctx, failed, info, failed); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(5 * time.Minute)
+	d.Dispatch(ctx, failed)
+	now = now.Add(5 * time.Minute)
+	d.Dispatch(ctx, failed)
+
+	if len(all.events) != 5 {
+		t.Errorf("all got %d events, want 5", len(all.events))
+	}
+	// 第一次发送, 窗口内的 2 次被去重, 10 分钟后再次发送
+	if len(critical.events) != 2 {
+		t.Errorf("critical got %d events, want 2", len(critical.events))
+	}
+}
+
+type failingSink struct {
+	recorder
+	fail bool
+}
+
+func (s *failingSink) Send(ctx context.Context, e *Event) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	return s.recorder.Send(ctx, e)
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	sink := &failingSink{fail: true}
+	d := &Dispatcher{
+		Routes: []*Route{{Name: "webhook", Sink: sink, Dedup: time.Hour}},
+		Now:    func() time.Time { return t0 },
+	}
+	failed := Event{HostNo: 0, Source: SourcePoll, Type: "PdState", Severity: health.Critical, Object: "pd 252:1", Message: "PdState: Online -> Failed"}
+	ctx := context.Background()
+	if err := d.Dispatch(ctx, failed); err == nil || !strings.Contains(err.Error(), "webhook: unavailable") {
+		t.Fatalf("Dispatch() = %v", err)
+	}
+	// 发送失败的事件不在去重窗口内
+	sink.fail = false
+	if err := d.Dispatch(ctx, failed); err != nil {
+		t.Fatal(err)
+	}
+	d.Dispatch(ctx, failed)
+	if len(sink.events) != 1 {
+		t.Errorf("got %d events, want 1", len(sink.events))
+	}
+}
+
+func TestFrom(t *testing.T) {
+	c := &megaraid.Change{Type: megaraid.ChangeLdState, HostNo: 1, Object: "ld 0", Old: "Optimal", New: "Degraded"}
+	e := FromChange(c, t0)
+	if e.Severity != health.Critical || e.Message != "LdState: Optimal -> Degraded" || e.Type != "LdState" || e.HostNo != 1 {
+		t.Errorf("FromChange = %+v", e)
+	}
+	c = &megaraid.Change{Type: megaraid.ChangePdInserted, Object: "pd 252:3", New: "UGood"}
+	if e := FromChange(c, t0); e.Severity != health.Info {
+		t.Errorf("FromChange = %+v", e)
+	}
+
+	fe := &megaraid.Event{SeqNum: 42, Code: 0x71, Class: megaraid.EventClass(megaraid.MR_EVT_CLASS_WARNING),
+		Description: "Predictive failure", Pd: &megaraid.EventPd{DeviceId: 8}}
+	e = FromFirmware(0, fe, t0)
+	if e.Severity != health.Warning || e.Type != "0x0071" || e.Object != "pd did 8" || e.SeqNum != 42 || !e.Time.Equal(t0) {
+		t.Errorf("FromFirmware = %+v", e)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var bodies []map[string]any
+	var headers []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			t.Error(err)
+		}
+		bodies = append(bodies, v)
+		headers = append(headers, r.Header)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/fail"):
+			w.WriteHeader(http.StatusBadGateway)
+		case strings.HasSuffix(r.URL.Path, "/reject"):
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	e := &Event{Time: t0, HostNo: 2, Source: SourcePoll, Type: "PdState", Severity: health.Critical, Object: "pd 252:1", Message: `say "failed"`}
+	w, err := NewWebhook(srv.URL, `{"text": {{json .String}}, "severity": {{json .Severity}}, "host": {{.HostNo}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Header.Set("Authorization", "Bearer x")
+	if err := w.Send(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if b := bodies[0]; b["text"] != `critical: host 2 pd 252:1 say "failed"` || b["severity"] != "critical" || b["host"] != 2.0 {
+		t.Errorf("body = %v", b)
+	}
+	if h := headers[0]; h.Get("Authorization") != "Bearer x" || h.Get("Content-Type") != "application/json" {
+		t.Errorf("header = %v", h)
+	}
+
+	// 没有模板时发送 Event 本身
+	w, _ = NewWebhook(srv.URL, "")
+	if err := w.Send(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if b := bodies[1]; b["Object"] != "pd 252:1" || b["Severity"] != "critical" {
+		t.Errorf("body = %v", b)
+	}
+
+	w, _ = NewWebhook(srv.URL+"/fail", "")
+	if err := w.Send(context.Background(), e); err == nil || IsPermanent(err) {
+		t.Errorf("502: want a retryable error, got %v", err)
+	}
+	w, _ = NewWebhook(srv.URL+"/reject", "")
+	if err := w.Send(context.Background(), e); !IsPermanent(err) {
+		t.Errorf("400: want a permanent error, got %v", err)
+	}
+	w, _ = NewWebhook(srv.URL, `{"text": {{.Message}}}`)
+	if err := w.Send(context.Background(), e); !IsPermanent(err) {
+		t.Errorf("invalid JSON: want a permanent error, got %v", err)
+	}
+}
+
+// listen 在临时目录创建 unixgram socket, 返回收到的数据报
+func listen(t *testing.T) (string, <-chan []byte) {
+	addr := filepath.Join(t.TempDir(), "sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ch := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- bytes.Clone(buf[:n])
+		}
+	}()
+	return addr, ch
+}
+
+func receive(t *testing.T, ch <-chan []byte) []byte {
+	select {
+	case b := <-ch:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for datagram")
+	}
+	return nil
+}
+
+func TestSyslog(t *testing.T) {
+	addr, ch := listen(t)
+	s := NewSyslog("unixgram", addr)
+	s.Hostname, s.Facility = "node1", 16
+	defer s.Close()
+
+	e := &Event{Time: t0, HostNo: 0, Source: SourceFirmware, Type: "0x0071", Severity: health.Warning,
+		Object: "pd did 8", Message: "Predictive failure", SeqNum: 42}
+	if err := s.Send(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	// local0.warning = 16*8+4
+	re := regexp.MustCompile(`^<132>1 2024-05-01T12:00:00\.000000Z node1 megaraid \d+ 0x0071 ` +
+		`\[megaraid@32473 host="0" source="firmware" object="pd did 8" severity="warning" seq="42"\] pd did 8 Predictive failure$`)
+	if msg := receive(t, ch); !re.Match(msg) {
+		t.Errorf("got %q", msg)
+	}
+
+	e = &Event{Time: t0, Source: SourcePoll, Type: "", Severity: health.Critical, Object: `a"b]`, Message: "x"}
+	s.Send(context.Background(), e)
+	if msg := string(receive(t, ch)); !strings.Contains(msg, ` - [megaraid@32473 host="0" source="poll" object="a\"b\]"`) {
+		t.Errorf("escape: got %q", msg)
+	}
+}
+
+// parseJournal 解析 journald 原生协议的数据报
+func parseJournal(t *testing.T, b []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		if nl < 0 {
+			t.Fatalf("truncated field %q", b)
+		}
+		line := b[:nl]
+		b = b[nl+1:]
+		if k, v, ok := bytes.Cut(line, []byte("=")); ok {
+			fields[string(k)] = string(v)
+			continue
+		}
+		n := binary.LittleEndian.Uint64(b)
+		fields[string(line)] = string(b[8 : 8+n])
+		b = b[8+n+1:]
+	}
+	return fields
+}
+
+func TestJournald(t *testing.T) {
+	addr, ch := listen(t)
+	j := NewJournald(addr)
+	defer j.Close()
+
+	e := &Event{Time: t0, HostNo: 1, Source: SourcePoll, Type: "LdState", Severity: health.Critical, Object: "ld 0", Message: "line1\nline2"}
+	if err := j.Send(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	f := parseJournal(t, receive(t, ch))
+	for k, v := range map[string]string{
+		"MESSAGE":           "host 1 ld 0 line1\nline2",
+		"PRIORITY":          "2",
+		"SYSLOG_IDENTIFIER": "megaraid",
+		"MEGARAID_HOST":     "1",
+		"MEGARAID_TYPE":     "LdState",
+		"MEGARAID_OBJECT":   "ld 0",
+		"MEGARAID_SEVERITY": "critical",
+	} {
+		if f[k] != v {
+			t.Errorf("%s = %q, want %q", k, f[k], v)
+		}
+	}
+	if _, ok := f["MEGARAID_SEQNUM"]; ok {
+		t.Error("poll event must not have MEGARAID_SEQNUM")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(strings.NewReader(`
+interval: 30s
+event_log: false
+history: /var/lib/megaraid/history.jsonl
+sinks:
+  - type: webhook
+    url: http://127.0.0.1:1/hook
+    template: '{"text": {{json .String}}}'
+    headers: {Authorization: Bearer x}
+    min_severity: warning
+    dedup: 1h
+  - name: local
+    type: syslog
+    facility: 16
+  - type: journald
+    app_name: raid
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interval != 30*time.Second || cfg.EventLogEnabled() || cfg.AenEnabled() || !cfg.PollEnabled() || cfg.Checkpoint != DefaultCheckpoint ||
+		cfg.History != "/var/lib/megaraid/history.jsonl" || cfg.HistoryRetention != DefaultHistoryRetention {
+		t.Errorf("cfg = %+v", cfg)
+	}
+	d, err := cfg.Dispatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if len(d.Routes) != 3 {
+		t.Fatalf("routes = %v", d.Routes)
+	}
+	if r := d.Routes[0]; r.Name != "webhook" || r.MinSeverity != health.Warning || r.Dedup != time.Hour ||
+		r.Sink.(*Webhook).Header.Get("Authorization") != "Bearer x" {
+		t.Errorf("webhook route = %+v", r)
+	}
+	if r := d.Routes[1]; r.Name != "local" || r.Sink.(*Syslog).Facility != 16 || r.Sink.(*Syslog).addr != "/dev/log" {
+		t.Errorf("syslog route = %+v", r)
+	}
+	if r := d.Routes[2]; r.Sink.(*Journald).Identifier != "raid" {
+		t.Errorf("journald route = %+v", r)
+	}
+
+	for _, bad := range []string{
+		"interval: 1m",
+		"sinks: [{type: email}]",
+		"sinks: [{type: webhook}]",
+		"sinks: [{type: webhook, url: 'http://x', template: '{{'}]",
+		"sinks: [{type: syslog, network: tcp}]",
+		"sinks: [{type: syslog, min_severity: fatal}]",
+		"sinks: [{type: journald, typo: 1}]",
+	} {
+		if _, err := LoadConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+	}
+}
+
+func TestDispatcherNames(t *testing.T) {
+	cfg, err := LoadConfig(strings.NewReader(`
+sinks:
+  - type: journald
+  - type: journald
+  - name: journald
+    type: syslog
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := cfg.Dispatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var names []string
+	for _, r := range d.Routes {
+		names = append(names, r.Name)
+	}
+	if strings.Join(names, ",") != "journald,journald-2,journald-3" {
+		t.Errorf("route names = %v", names)
+	}
+}
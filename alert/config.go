@@ -0,0 +1,180 @@
+package alert
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid/health"
+	"gopkg.in/yaml.v3"
+)
+
+// Config 是 alertd 的配置文件, 例如:
+//
+//	interval: 30s
+//	aen: true
+//	checkpoint: /var/lib/megaraid/alertd.checkpoint
+//	history: /var/lib/megaraid/history.jsonl
+//	history_retention: 2160h
+//	sinks:
+//	  - type: webhook
+//	    url: http://alertmanager.example:8080/hook
+//	    template: '{"text": {{json .String}}}'
+//	    min_severity: warning
+//	    dedup: 1h
+//	  - type: syslog
+//	  - type: journald
+type Config struct {
+	Interval   time.Duration // 轮询间隔, 默认 1 分钟
+	EventLog   *bool         `yaml:"event_log"` // 读取固件事件日志, 默认开启
+	Aen        *bool         // 读取事件日志时注册驱动的 AEN, 有新事件时立即读取而不是等到下次轮询, 默认开启
+	Checkpoint string        // 固件事件读取位置的保存文件, 默认为 DefaultCheckpoint, 为 - 时不保存
+	Poll       *bool         // 比较快照发现变化, 默认开启
+	// History 是每次读取快照时追加错误计数、温度等的历史文件, 见 history 包, 为空时不记录
+	History          string
+	HistoryRetention time.Duration `yaml:"history_retention"` // 历史保留的时间, 默认为 DefaultHistoryRetention
+	Sinks            []SinkConfig
+}
+
+const (
+	DefaultCheckpoint       = "/var/lib/megaraid/alertd.checkpoint"
+	DefaultHistoryRetention = 90 * 24 * time.Hour
+)
+
+// SinkConfig 是一个 sink, Type 决定使用哪些字段
+type SinkConfig struct {
+	Name        string          // 默认为 Type
+	Type        string          // webhook, syslog 或 journald
+	MinSeverity health.Severity `yaml:"min_severity"`
+	Dedup       time.Duration
+
+	// webhook
+	URL      string
+	Template string
+	Headers  map[string]string
+
+	// syslog 和 journald
+	Network  string // syslog 的 unixgram 或 unix
+	Address  string
+	Facility *int   // syslog, 默认为 3 (daemon)
+	AppName  string `yaml:"app_name"` // syslog 的 APP-NAME 或 journald 的 SYSLOG_IDENTIFIER
+}
+
+// LoadConfig 读取 YAML 格式的配置并检查 sink
+func LoadConfig(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Checkpoint == "" {
+		cfg.Checkpoint = DefaultCheckpoint
+	}
+	if cfg.HistoryRetention <= 0 {
+		cfg.HistoryRetention = DefaultHistoryRetention
+	}
+	if len(cfg.Sinks) == 0 {
+		return nil, fmt.Errorf("no sink configured")
+	}
+	for i, s := range cfg.Sinks {
+		if _, err := s.sink(); err != nil {
+			return nil, fmt.Errorf("sink %d: %w", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+func LoadConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := LoadConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) EventLogEnabled() bool {
+	return c.EventLog == nil || *c.EventLog
+}
+
+func (c *Config) AenEnabled() bool {
+	return c.EventLogEnabled() && (c.Aen == nil || *c.Aen)
+}
+
+func (c *Config) PollEnabled() bool {
+	return c.Poll == nil || *c.Poll
+}
+
+func (s *SinkConfig) sink() (Sink, error) {
+	switch s.Type {
+	case "webhook":
+		if s.URL == "" {
+			return nil, fmt.Errorf("webhook: url is empty")
+		}
+		w, err := NewWebhook(s.URL, s.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %w", err)
+		}
+		for k, v := range s.Headers {
+			w.Header.Set(k, v)
+		}
+		return w, nil
+	case "syslog":
+		switch s.Network {
+		case "", "unixgram", "unix":
+		default:
+			return nil, fmt.Errorf("syslog: unsupported network %q", s.Network)
+		}
+		l := NewSyslog(s.Network, s.Address)
+		if s.Facility != nil {
+			if *s.Facility < 0 || *s.Facility > 23 {
+				return nil, fmt.Errorf("syslog: invalid facility %d", *s.Facility)
+			}
+			l.Facility = *s.Facility
+		}
+		if s.AppName != "" {
+			l.AppName = s.AppName
+		}
+		return l, nil
+	case "journald":
+		j := NewJournald(s.Address)
+		if s.AppName != "" {
+			j.Identifier = s.AppName
+		}
+		return j, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", s.Type)
+}
+
+// Dispatcher 按配置创建所有 sink, socket 在第一次发送时才连接
+func (c *Config) Dispatcher() (*Dispatcher, error) {
+	d := &Dispatcher{}
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		sink, err := s.sink()
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		name := s.Name
+		if name == "" {
+			name = s.Type
+		}
+		// 名字重复时加上序号, 例如两个没有命名的 webhook 为 webhook 和 webhook-2
+		if slices.ContainsFunc(d.Routes, func(r *Route) bool { return r.Name == name }) {
+			name = fmt.Sprintf("%s-%d", name, i+1)
+		}
+		d.Routes = append(d.Routes, &Route{Name: name, Sink: sink, MinSeverity: s.MinSeverity, Dedup: s.Dedup})
+	}
+	return d, nil
+}
@@ -0,0 +1,186 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid/health"
+)
+
+// socket 在第一次发送时连接, 发送失败时重新连接一次, 以便 syslog/journald 重启后继续发送
+type socket struct {
+	network, addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *socket) write(ctx context.Context, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for retry := 0; retry < 2; retry++ {
+		if s.conn == nil {
+			var d net.Dialer
+			if s.conn, err = d.DialContext(ctx, s.network, s.addr); err != nil {
+				return err
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			s.conn.SetWriteDeadline(deadline)
+		} else {
+			s.conn.SetWriteDeadline(time.Time{})
+		}
+		if _, err = s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *socket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// syslog 的 severity
+func syslogSeverity(s health.Severity) int {
+	switch s {
+	case health.Critical:
+		return 2 // crit
+	case health.Warning:
+		return 4 // warning
+	}
+	return 6 // info
+}
+
+// syslogEnterprise 是 structured data 的 SD-ID 中的企业号, 32473 是 RFC 5612 保留给文档的编号
+const syslogEnterprise = 32473
+
+// Syslog 按 RFC 5424 格式发送, 默认发送到本机的 /dev/log
+type Syslog struct {
+	Facility int    // 默认为 3 (daemon)
+	AppName  string // 默认为 megaraid
+	Hostname string // 默认为 os.Hostname
+
+	socket
+}
+
+// NewSyslog 的 network 为 unixgram 或 unix, addr 为空时为 /dev/log
+func NewSyslog(network, addr string) *Syslog {
+	if network == "" {
+		network = "unixgram"
+	}
+	if addr == "" {
+		addr = "/dev/log"
+	}
+	hostname, _ := os.Hostname()
+	return &Syslog{Facility: 3, AppName: "megaraid", Hostname: hostname, socket: socket{network: network, addr: addr}}
+}
+
+// sdEscape 转义 SD-PARAM 的值, 见 RFC 5424 6.3.3
+func sdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// header 中的字段不能为空或包含空格, 见 RFC 5424 6.2
+func headerField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s[:min(len(s), max)]
+}
+
+func (s *Syslog) format(e *Event) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s ",
+		s.Facility*8+syslogSeverity(e.Severity),
+		e.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(s.Hostname, 255), headerField(s.AppName, 48), os.Getpid(), headerField(e.Type, 32))
+	fmt.Fprintf(&buf, `[megaraid@%d host="%d" source="%s" object="%s" severity="%s"`,
+		syslogEnterprise, e.HostNo, sdEscape(e.Source), sdEscape(e.Object), e.Severity)
+	if e.SeqNum != 0 {
+		fmt.Fprintf(&buf, ` seq="%d"`, e.SeqNum)
+	}
+	buf.WriteString("] ")
+	buf.WriteString(e.Object + " " + e.Message)
+	return buf.Bytes()
+}
+
+func (s *Syslog) Send(ctx context.Context, e *Event) error {
+	msg := s.format(e)
+	if s.network != "unixgram" && s.network != "udp" {
+		// 流式连接用换行分隔消息, 见 RFC 6587 3.4.2
+		msg = append(msg, '\n')
+	}
+	return s.write(ctx, msg)
+}
+
+// Journald 使用 systemd-journald 的原生协议发送带结构化字段的日志
+type Journald struct {
+	Identifier string // SYSLOG_IDENTIFIER, 默认为 megaraid
+
+	socket
+}
+
+// NewJournald 的 addr 为空时为 /run/systemd/journal/socket
+func NewJournald(addr string) *Journald {
+	if addr == "" {
+		addr = "/run/systemd/journal/socket"
+	}
+	return &Journald{Identifier: "megaraid", socket: socket{network: "unixgram", addr: addr}}
+}
+
+// journalField 按原生协议写一个字段, 值包含换行时使用带长度的二进制格式
+func journalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+func (j *Journald) format(e *Event) []byte {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", fmt.Sprintf("host %d %s %s", e.HostNo, e.Object, e.Message))
+	journalField(&buf, "PRIORITY", fmt.Sprint(syslogSeverity(e.Severity)))
+	journalField(&buf, "SYSLOG_IDENTIFIER", j.Identifier)
+	journalField(&buf, "MEGARAID_HOST", fmt.Sprint(e.HostNo))
+	journalField(&buf, "MEGARAID_SOURCE", e.Source)
+	journalField(&buf, "MEGARAID_TYPE", e.Type)
+	journalField(&buf, "MEGARAID_OBJECT", e.Object)
+	journalField(&buf, "MEGARAID_SEVERITY", e.Severity.String())
+	journalField(&buf, "MEGARAID_TIME", e.Time.Format(time.RFC3339))
+	if e.SeqNum != 0 {
+		journalField(&buf, "MEGARAID_SEQNUM", fmt.Sprint(e.SeqNum))
+	}
+	return buf.Bytes()
+}
+
+func (j *Journald) Send(ctx context.Context, e *Event) error {
+	return j.write(ctx, j.format(e))
+}
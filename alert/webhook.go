@@ -0,0 +1,93 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+)
+
+// Webhook 以 POST 发送 JSON, 模板为空时发送 Event 本身
+type Webhook struct {
+	URL    string
+	Header http.Header
+	Client *http.Client // nil 时为 http.DefaultClient
+
+	tmpl *template.Template
+}
+
+// NewWebhook 的 tmpl 是 text/template, . 为 Event, 字符串用 json 函数转义, 例如
+//
+//	{"text": {{json .String}}, "severity": {{json .Severity}}}
+func NewWebhook(url, tmpl string) (*Webhook, error) {
+	w := &Webhook{URL: url, Header: make(http.Header)}
+	if tmpl != "" {
+		t, err := template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		w.tmpl = t
+	}
+	return w, nil
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (w *Webhook) body(e *Event) ([]byte, error) {
+	if w.tmpl == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template output is not valid JSON: %s", buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// Send 发送一条事件. 模板对这条事件出错, 或者服务端以 408、429 以外的 4xx 拒绝时返回 PermanentError
+func (w *Webhook) Send(ctx context.Context, e *Event) error {
+	body, err := w.body(e)
+	if err != nil {
+		return Permanent(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("webhook %s: %s", w.URL, resp.Status)
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (w *Webhook) Close() error {
+	return nil
+}
@@ -0,0 +1,341 @@
+// alertd 定期读取固件事件日志并比较快照, 把事件转发到配置的 webhook、syslog 和 journald.
+// 驱动的 AEN 通知有新事件时立即读取事件日志, 不等到下次轮询. 配置了 history 时每次读取快照都追加到历史文件, 例如:
+//
+//	alertd -config /etc/megaraid/alertd.yaml
+//
+// 配置文件格式见 alert.Config
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/alert"
+	"github.com/ishmaelwanglin/megaraid/history"
+)
+
+func main() {
+	configFile := flag.String("config", "/etc/megaraid/alertd.yaml", "configuration file")
+	timeout := flag.Duration("timeout", 30*time.Second, "give up a poll when the controller does not answer within this duration")
+	flag.Parse()
+
+	cfg, err := alert.LoadConfigFile(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d, err := cfg.Dispatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer d.Close()
+
+	m, err := megaraid.CreateMegasasIoctl()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	p := &poller{m: m, cfg: cfg, d: d, timeout: *timeout, readers: make(map[uint16]*eventReader),
+		last: make([]*megaraid.Snapshot, len(d.Routes)), wake: make(chan struct{}, 1), done: make(chan struct{})}
+	defer p.close()
+	if cfg.EventLogEnabled() && cfg.Checkpoint != "-" {
+		if p.checkpoint, err = megaraid.OpenCheckpoint(cfg.Checkpoint); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.History != "" {
+		if p.history, err = history.Open(cfg.History); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	full := true
+	for {
+		p.poll(ctx, full)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			full = true
+		case <-p.wake:
+			// AEN 只说明有新的固件事件, 不需要比较快照
+			full = false
+		}
+	}
+}
+
+type poller struct {
+	m       *megaraid.MegasasIoctl
+	cfg     *alert.Config
+	d       *alert.Dispatcher
+	timeout time.Duration
+
+	checkpoint *megaraid.Checkpoint // 不保存读取位置时为 nil
+	readers    map[uint16]*eventReader
+	last       []*megaraid.Snapshot // 每个 Route 上次发送成功的快照, 与 d.Routes 按下标对应
+	history    *history.Store       // 不记录历史时为 nil
+	pruned     time.Time            // 上次删除过期历史的时间
+
+	wake chan struct{} // 任何一个 AEN 收到通知, 容量为 1
+	done chan struct{} // 关闭时停止转发 AEN 通知
+}
+
+func (p *poller) close() {
+	if p.history != nil {
+		p.history.Close()
+	}
+	close(p.done)
+	for _, r := range p.readers {
+		if r.aen != nil {
+			r.aen.Close()
+		}
+	}
+}
+
+// eventReader 从所有 Route 中最早的位置读取, 每个 Route 只发送自己位置之后的事件.
+// Checkpoint 中每个 Route 的 key 为 key/Route.Name
+type eventReader struct {
+	*megaraid.EventReader
+	key    string
+	aen    *megaraid.Aen // 没有注册成功时为 nil, 只按间隔轮询
+	routes []uint32      // 每个 Route 下一条要发送的事件序号, 与 Dispatcher.Routes 按下标对应
+}
+
+// poll 读取固件事件, full 为 true 时还读取快照, 比较变化并记录历史
+func (p *poller) poll(ctx context.Context, full bool) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	if p.cfg.EventLogEnabled() {
+		p.firmwareEvents(ctx)
+	}
+	if full && (p.cfg.PollEnabled() || p.history != nil) {
+		p.changes(ctx)
+	}
+}
+
+// reader 返回 host 的 eventReader, 第一次调用时从 Checkpoint 中保存的位置继续, 没有保存过时只读取之后的新事件
+func (p *poller) reader(ctx context.Context, hostNo uint16) (*eventReader, error) {
+	if r, ok := p.readers[hostNo]; ok {
+		return r, nil
+	}
+
+	c := p.m.Controller(hostNo)
+	info, err := c.GetControllerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// host 号在重启后可能变化, 用控制器序列号区分
+	key := info.SerialNumber
+	if key == "" {
+		key = fmt.Sprintf("host%d", hostNo)
+	}
+	// 从最早的 Route 继续读取. 旧版本只按控制器保存了一个位置, 所有 Route 都从这里继续
+	saved := make([]*megaraid.EventCursor, len(p.d.Routes))
+	var cursor *megaraid.EventCursor
+	if p.checkpoint != nil {
+		legacy, hasLegacy := p.checkpoint.Get(key)
+		for i, route := range p.d.Routes {
+			if rc, ok := p.checkpoint.Get(key + "/" + route.Name); ok {
+				saved[i] = &rc
+			} else if hasLegacy {
+				saved[i] = &legacy
+			}
+			if saved[i] != nil && (cursor == nil || saved[i].Next < cursor.Next) {
+				cursor = saved[i]
+			}
+		}
+	}
+	er, err := c.ResumeEventReader(ctx, megaraid.AllEvents, cursor)
+	if err != nil {
+		return nil, err
+	}
+	r := &eventReader{EventReader: er, key: key, routes: make([]uint32, len(p.d.Routes))}
+	// 没有保存过位置的 Route, 例如新加的 sink, 从读取的起点开始
+	for i := range r.routes {
+		r.routes[i] = er.Next
+		if saved[i] != nil {
+			r.routes[i] = saved[i].Next
+		}
+	}
+	if p.cfg.AenEnabled() {
+		if r.aen, err = c.RegisterAen(ctx, er.Next, er.Filter); err != nil {
+			log.Printf("host %d: %v, polling every %s", hostNo, err, p.cfg.Interval)
+		} else {
+			go p.forward(r.aen)
+		}
+	}
+	p.readers[hostNo] = r
+	return r, nil
+}
+
+// forward 把 AEN 通知合并到 p.wake
+func (p *poller) forward(a *megaraid.Aen) {
+	for {
+		select {
+		case <-a.C:
+		case <-p.done:
+			return
+		}
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// firmwareEvents 读取每个控制器上次之后的事件, 按 Route 分别发送, 见 deliver. 每个 Route 的位置在发送之后保存,
+// 在此之前退出时重启后会重新发送这些事件, 不会漏掉
+func (p *poller) firmwareEvents(ctx context.Context) {
+	hostNos, err := p.m.ScanHosts()
+	if err != nil {
+		log.Printf("scan hosts: %v", err)
+		return
+	}
+	slices.Sort(hostNos)
+
+	for _, hostNo := range hostNos {
+		r, err := p.reader(ctx, hostNo)
+		if err != nil {
+			log.Printf("host %d: open event log: %v", hostNo, err)
+			continue
+		}
+		fes, err := r.Read(ctx)
+		var gap *megaraid.EventGap
+		if errors.As(err, &gap) {
+			err = nil
+		} else if err != nil {
+			log.Printf("host %d: read events: %v", hostNo, err)
+		}
+		now := time.Now()
+		for i := range p.d.Routes {
+			p.deliver(ctx, hostNo, r, i, gap, fes, now)
+		}
+
+		// 下次从最早的 Route 继续读取, 已经读过的事件对其他 Route 不会重复发送
+		r.Seek(megaraid.EventCursor{Next: slices.Min(r.routes), ClearSeqNum: r.ClearSeqNum})
+		if p.checkpoint == nil {
+			continue
+		}
+		for i, route := range p.d.Routes {
+			if err := p.checkpoint.Save(r.key+"/"+route.Name, megaraid.EventCursor{Next: r.routes[i], ClearSeqNum: r.ClearSeqNum}); err != nil {
+				log.Printf("host %d: save checkpoint: %v", hostNo, err)
+			}
+		}
+	}
+}
+
+// deliver 把 Route i 位置之后的事件发送到 Route i. 可以重试的错误停在失败的事件, 下次轮询只向这个 Route 重新发送;
+// 永久错误记录后跳过这条事件, 不阻塞之后的事件
+func (p *poller) deliver(ctx context.Context, hostNo uint16, r *eventReader, i int, gap *megaraid.EventGap, fes []megaraid.Event, now time.Time) {
+	route, next := p.d.Routes[i], &r.routes[i]
+	send := func(e *alert.Event) bool {
+		err := p.d.Send(ctx, route, e)
+		switch {
+		case err == nil:
+		case alert.IsPermanent(err):
+			log.Printf("host %d: %v, skipped %s", hostNo, err, e)
+		default:
+			log.Printf("host %d: %v, sending again from seq %d on the next poll", hostNo, err, *next)
+			return false
+		}
+		return true
+	}
+
+	if gap != nil {
+		reset := gap.Reason == "reset"
+		if reset {
+			// 序号比最新的事件还大, 原来的位置已经没有意义
+			*next = gap.Resumed
+		}
+		if reset || *next < gap.Resumed {
+			e := alert.FromGap(hostNo, gap, now)
+			if !send(&e) {
+				return
+			}
+			*next = gap.Resumed
+		}
+	}
+	for j := range fes {
+		if fes[j].SeqNum < *next {
+			continue
+		}
+		e := alert.FromFirmware(hostNo, &fes[j], now)
+		if !send(&e) {
+			return
+		}
+		*next = fes[j].SeqNum + 1
+	}
+}
+
+// changes 读取快照并记录历史, 开启 poll 时把每个 Route 上次发送成功的快照与本次比较, 发送变化, 第一次只记住快照.
+// 可以重试的错误保留这个 Route 上次的快照, 下次轮询重新比较, 变化不会丢失, 也不会重复发送到其他 Route
+func (p *poller) changes(ctx context.Context) {
+	s, err := p.m.Snapshot(ctx)
+	if err != nil {
+		log.Printf("snapshot: %v", err)
+		return
+	}
+	p.record(s)
+	if !p.cfg.PollEnabled() {
+		return
+	}
+
+	for i, route := range p.d.Routes {
+		if p.last[i] == nil {
+			p.last[i] = s
+			continue
+		}
+		if p.sendChanges(ctx, route, megaraid.Diff(p.last[i], s), s.Time) {
+			p.last[i] = s
+		}
+	}
+}
+
+// sendChanges 发送变化, 遇到可以重试的错误时停止并返回 false, 永久错误记录后跳过
+func (p *poller) sendChanges(ctx context.Context, route *alert.Route, changes []megaraid.Change, t time.Time) bool {
+	for i := range changes {
+		e := alert.FromChange(&changes[i], t)
+		err := p.d.Send(ctx, route, &e)
+		switch {
+		case err == nil:
+		case alert.IsPermanent(err):
+			log.Printf("snapshot changes: %v, skipped %s", err, &e)
+		default:
+			log.Printf("snapshot changes: %v, sending again on the next poll", err)
+			return false
+		}
+	}
+	return true
+}
+
+// record 把快照追加到历史, 每天删除一次超过保留时间的记录
+func (p *poller) record(s *megaraid.Snapshot) {
+	if p.history == nil {
+		return
+	}
+	if err := p.history.Record(s); err != nil {
+		log.Printf("history: %v", err)
+	}
+	if s.Time.Sub(p.pruned) < 24*time.Hour {
+		return
+	}
+	if err := p.history.Prune(s.Time.Add(-p.cfg.HistoryRetention)); err != nil {
+		log.Printf("history: prune: %v", err)
+		return
+	}
+	p.pruned = s.Time
+}
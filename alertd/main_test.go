@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/alert"
+)
+
+// sink 记录收到的事件, fail 返回错误的事件不记录
+type sink struct {
+	got  []uint32
+	fail func(e *alert.Event) error
+}
+
+func (s *sink) Send(ctx context.Context, e *alert.Event) error {
+	if s.fail != nil {
+		if err := s.fail(e); err != nil {
+			return err
+		}
+	}
+	s.got = append(s.got, e.SeqNum)
+	return nil
+}
+
+func (s *sink) Close() error { return nil }
+
+func TestDeliver(t *testing.T) {
+	down := errors.New("connection refused")
+	webhook := &sink{fail: func(e *alert.Event) error {
+		if e.SeqNum == 11 {
+			return down
+		}
+		return nil
+	}}
+	syslog := &sink{fail: func(e *alert.Event) error {
+		// 模板对这条事件出错, 重试也不会成功
+		if e.SeqNum == 12 {
+			return alert.Permanent(errors.New("template output is not valid JSON"))
+		}
+		return nil
+	}}
+	p := &poller{d: &alert.Dispatcher{Routes: []*alert.Route{{Name: "webhook", Sink: webhook}, {Name: "syslog", Sink: syslog}}}}
+	r := &eventReader{routes: []uint32{10, 10}}
+	events := func(seqs ...uint32) []megaraid.Event {
+		var fes []megaraid.Event
+		for _, seq := range seqs {
+			fes = append(fes, megaraid.Event{SeqNum: seq, Description: "event"})
+		}
+		return fes
+	}
+
+	ctx, now := context.Background(), time.Now()
+	for i := range p.d.Routes {
+		p.deliver(ctx, 0, r, i, nil, events(10, 11, 12, 13), now)
+	}
+	// webhook 停在失败的事件, syslog 跳过永久错误的事件继续
+	if r.routes[0] != 11 || r.routes[1] != 14 {
+		t.Fatalf("route cursors = %v", r.routes)
+	}
+	if len(webhook.got) != 1 || len(syslog.got) != 3 {
+		t.Fatalf("webhook got %v, syslog got %v", webhook.got, syslog.got)
+	}
+
+	// 下次从最早的 Route 读取, 只有 webhook 重新发送
+	webhook.fail = nil
+	for i := range p.d.Routes {
+		p.deliver(ctx, 0, r, i, nil, events(11, 12, 13, 14), now)
+	}
+	if r.routes[0] != 15 || r.routes[1] != 15 {
+		t.Fatalf("route cursors = %v", r.routes)
+	}
+	if want := []uint32{10, 11, 12, 13, 14}; !slices.Equal(webhook.got, want) {
+		t.Errorf("webhook got %v, want %v", webhook.got, want)
+	}
+	if want := []uint32{10, 11, 13, 14}; !slices.Equal(syslog.got, want) {
+		t.Errorf("syslog got %v, want %v", syslog.got, want)
+	}
+
+	// 日志被覆盖时只有还没读到 Resumed 的 Route 收到 EventGap
+	r.routes = []uint32{15, 30}
+	gap := &megaraid.EventGap{Reason: "wrapped", Expected: 15, Resumed: 20}
+	for i := range p.d.Routes {
+		p.deliver(ctx, 0, r, i, gap, events(20, 21), now)
+	}
+	if r.routes[0] != 22 || r.routes[1] != 30 || len(webhook.got) != 8 || len(syslog.got) != 4 {
+		t.Errorf("gap: cursors %v, webhook got %v, syslog got %v", r.routes, webhook.got, syslog.got)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+	"github.com/ishmaelwanglin/megaraid/health"
+)
+
+// Nagios plugin 的返回码
+type Status int
+
+const (
+	OK Status = iota
+	Warning
+	Critical
+	Unknown
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "OK"
+	case Warning:
+		return "WARNING"
+	case Critical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// Threshold 是一条规则的阈值, 值 >= 阈值时触发, 阈值为 0 表示不检查该级别
+type Threshold struct {
+	Warning  float64
+	Critical float64
+}
+
+func (t Threshold) status(v float64) Status {
+	switch {
+	case t.Critical > 0 && v >= t.Critical:
+		return Critical
+	case t.Warning > 0 && v >= t.Warning:
+		return Warning
+	}
+	return OK
+}
+
+// perf 按 'label'=value;warn;crit 的格式输出, 阈值为 0 时留空
+func (t Threshold) perf(label string, v float64) string {
+	f := func(x float64) string {
+		if x == 0 {
+			return ""
+		}
+		return fmt.Sprint(x)
+	}
+	return fmt.Sprintf("'%s'=%v;%s;%s", label, v, f(t.Warning), f(t.Critical))
+}
+
+// Rules 是所有可配置阈值的规则, LD 降级/离线、PD 故障等状态由 Health 中的规则判断
+type Rules struct {
+	Health             []health.Rule
+	MemUncorrectable   Threshold
+	PredictiveFailures Threshold
+	MediaErrors        Threshold
+	PdTemperature      Threshold // ℃
+	Rebuild            bool      // 有盘在重建时 WARNING
+	Bbu                bool      // BBU 需要更换或在 learn cycle 时 WARNING
+}
+
+// optInRules 是 health 包中 check_megaraid 以前没有检查的内置规则, 默认不启用, 用 EnableRule 开启,
+// 以免升级后原来 OK 的阵列变成 WARNING
+var optInRules = []string{health.RuleNoHotSpare, health.RuleWriteThrough, health.RuleCachePinned, health.RuleForeignConfig}
+
+func DefaultRules() Rules {
+	return Rules{
+		Health: slices.DeleteFunc(health.DefaultRules(), func(r health.Rule) bool {
+			return slices.Contains(optInRules, r.Name)
+		}),
+		MemUncorrectable:   Threshold{Critical: 1},
+		PredictiveFailures: Threshold{Warning: 1},
+		MediaErrors:        Threshold{Warning: 10},
+		PdTemperature:      Threshold{Warning: 55, Critical: 65},
+		Rebuild:            true,
+		Bbu:                true,
+	}
+}
+
+// EnableRule 启用名字为 name 的内置规则, 已经启用时什么也不做
+func (r *Rules) EnableRule(name string) error {
+	if slices.ContainsFunc(r.Health, func(rule health.Rule) bool { return rule.Name == name }) {
+		return nil
+	}
+	for _, rule := range health.DefaultRules() {
+		if rule.Name == name {
+			r.Health = append(r.Health, rule)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown rule %q", name)
+}
+
+// DisableRule 停用名字为 name 的内置或自定义规则. pd-predictive-failure 由 PredictiveFailures 阈值检查,
+// 停用时同时清除阈值
+func (r *Rules) DisableRule(name string) error {
+	n := len(r.Health)
+	r.Health = slices.DeleteFunc(r.Health, func(rule health.Rule) bool { return rule.Name == name })
+	if len(r.Health) == n {
+		return fmt.Errorf("unknown rule %q", name)
+	}
+	if name == health.RulePredictiveFailure {
+		r.PredictiveFailures = Threshold{}
+	}
+	return nil
+}
+
+// Result 是一次检查的结果
+type Result struct {
+	Status   Status
+	Messages []string
+	Perfdata []string
+}
+
+// rank 是合并多个结果时的优先级. 跳过的对象只说明有部分状态不确定, UNKNOWN 不能盖过已经发现的问题,
+// 控制器本身读不到时 run 直接返回 UNKNOWN
+func (s Status) rank() int {
+	switch s {
+	case OK:
+		return 0
+	case Unknown:
+		return 1
+	case Warning:
+		return 2
+	}
+	return 3
+}
+
+func (r *Result) add(s Status, format string, a ...any) {
+	if s == OK {
+		return
+	}
+	if s.rank() > r.Status.rank() {
+		r.Status = s
+	}
+	r.Messages = append(r.Messages, fmt.Sprintf("%s: %s", s, fmt.Sprintf(format, a...)))
+}
+
+// String 按 Nagios plugin 的格式输出一行结果和 perfdata
+func (r *Result) String() string {
+	msg := "all controllers are healthy"
+	if len(r.Messages) > 0 {
+		msg = strings.Join(r.Messages, ", ")
+	}
+	s := fmt.Sprintf("MEGARAID %s - %s", r.Status, msg)
+	if len(r.Perfdata) > 0 {
+		s += " | " + strings.Join(r.Perfdata, " ")
+	}
+	return s
+}
+
+func severityStatus(s health.Severity) Status {
+	switch s {
+	case health.Critical:
+		return Critical
+	case health.Warning:
+		return Warning
+	}
+	return OK
+}
+
+// objectName 把 health 的对象名转换为 check_megaraid 一直使用的名字,
+// 例如 c0 的 ld 0 为 c0/v0, pd 252:3 为 c0/e252/s3, bbu 为 c0 BBU
+func objectName(c, object string) string {
+	var e, s, v int
+	if n, _ := fmt.Sscanf(object, "pd %d:%d", &e, &s); n == 2 {
+		return fmt.Sprintf("%s/e%d/s%d", c, e, s)
+	}
+	if n, _ := fmt.Sscanf(object, "ld %d", &v); n == 1 {
+		return fmt.Sprintf("%s/v%d", c, v)
+	}
+	switch object {
+	case "controller":
+		return c
+	case "bbu":
+		return c + " BBU"
+	}
+	return c + " " + object
+}
+
+// Evaluate 按规则检查所有控制器
+func Evaluate(hosts []*collector.Host, rules Rules) *Result {
+	r := &Result{}
+	for _, h := range hosts {
+		c := fmt.Sprintf("c%d", h.Ctrl.HostNo)
+
+		r.add(rules.MemUncorrectable.status(float64(h.Ctrl.MemUncorrectableErrorCount)),
+			"%s uncorrectable memory errors %d", c, h.Ctrl.MemUncorrectableErrorCount)
+		r.Perfdata = append(r.Perfdata, rules.MemUncorrectable.perf(c+"_mem_uncorrectable", float64(h.Ctrl.MemUncorrectableErrorCount)))
+
+		// 没有读到的对象不能确认状态
+		for _, e := range h.Errors {
+			r.add(Unknown, "%s %s", c, e)
+		}
+
+		snap := h.Snapshot()
+		for _, f := range health.EvaluateController(&snap, rules.Health) {
+			switch {
+			case f.Rule == health.RulePredictiveFailure:
+				continue // 由 PredictiveFailures 阈值检查
+			case f.Rule == health.RuleBbuReplace && !rules.Bbu:
+				continue
+			}
+			r.add(severityStatus(f.Severity), "%s %s", objectName(c, f.Object), f.Message)
+		}
+
+		var degraded, offline int
+		for i := range h.Lds {
+			switch h.Lds[i].State {
+			case 3:
+			case 0:
+				offline++
+			default:
+				degraded++
+			}
+		}
+		r.Perfdata = append(r.Perfdata, fmt.Sprintf("'%s_ld_degraded'=%d;;1", c, degraded), fmt.Sprintf("'%s_ld_offline'=%d;;1", c, offline))
+
+		for _, pd := range h.Pds {
+			info := pd.Info
+			name := fmt.Sprintf("%s/e%d/s%d", c, info.EnclDeviceId, info.SlotNumber)
+			label := fmt.Sprintf("%s_e%d_s%d", c, info.EnclDeviceId, info.SlotNumber)
+
+			if rules.Rebuild && uint8(info.FwState) == megaraid.MR_PD_STATE_REBUILD {
+				r.add(Warning, "%s rebuilding %d%%", name, info.ProgInfo.Rbld.Percent())
+			}
+
+			r.add(rules.PredictiveFailures.status(float64(info.PredFailCount)), "%s predictive failures %d", name, info.PredFailCount)
+			r.add(rules.MediaErrors.status(float64(info.MediaErrCount)), "%s media errors %d", name, info.MediaErrCount)
+			r.add(rules.PdTemperature.status(float64(info.Temperature)), "%s temperature %d℃", name, info.Temperature)
+			r.Perfdata = append(r.Perfdata,
+				rules.MediaErrors.perf(label+"_media_errors", float64(info.MediaErrCount)),
+				rules.PdTemperature.perf(label+"_temperature", float64(info.Temperature)))
+		}
+
+		if rules.Bbu && h.Bbu != nil && h.Bbu.Healthy() &&
+			h.Bbu.FwStatus&(megaraid.MR_BBU_STATE_LEARN_CYC_ACTIVE|megaraid.MR_BBU_STATE_LEARN_CYC_REQ) != 0 {
+			r.add(Warning, "%s BBU learn cycle in progress", c)
+		}
+	}
+	return r
+}
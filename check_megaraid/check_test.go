@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+	"github.com/ishmaelwanglin/megaraid/health"
+)
+
+func TestEvaluate(t *testing.T) {
+	pd := &megaraid.MR_PD_INFO{Temperature: 40}
+	pd.FwState = uint16(megaraid.MR_PD_STATE_ONLINE)
+	h := &collector.Host{
+		Ctrl: &megaraid.ControllerInfo{},
+		Lds:  []megaraid.LD_INFO{{State: 3}},
+		Pds:  []collector.Pd{{Info: pd}},
+	}
+
+	r := Evaluate([]*collector.Host{h}, DefaultRules())
+	if r.Status != OK {
+		t.Fatalf("expected OK, got %s", r)
+	}
+
+	pd.MediaErrCount = 10
+	pd.Temperature = 56
+	if r = Evaluate([]*collector.Host{h}, DefaultRules()); r.Status != Warning || len(r.Messages) != 2 {
+		t.Fatalf("expected 2 warnings, got %s", r)
+	}
+	if !strings.Contains(r.String(), "'c0_e0_s0_temperature'=56;55;65") {
+		t.Fatalf("unexpected perfdata %s", r)
+	}
+
+	rules := DefaultRules()
+	rules.MediaErrors = Threshold{Warning: 20}
+	rules.PdTemperature.Warning = 60
+	if r = Evaluate([]*collector.Host{h}, rules); r.Status != OK {
+		t.Fatalf("raised thresholds must be OK, got %s", r)
+	}
+
+	h.Lds[0].State = 2
+	h.Ctrl.MemUncorrectableErrorCount = 1
+	if r = Evaluate([]*collector.Host{h}, rules); r.Status != Critical || len(r.Messages) != 2 {
+		t.Fatalf("expected 2 criticals, got %s", r)
+	}
+	if !strings.Contains(r.String(), "CRITICAL: c0/v0 is Degraded") {
+		t.Fatalf("unexpected message %s", r)
+	}
+
+	// 跳过的对象不能盖过已经发现的问题
+	h.Errors = []string{"pd 9: timeout"}
+	if r = Evaluate([]*collector.Host{h}, rules); r.Status != Critical || !strings.Contains(r.String(), "UNKNOWN: c0 pd 9: timeout") {
+		t.Fatalf("CRITICAL must win over skipped objects, got %s", r)
+	}
+	h.Lds[0].State = 3
+	h.Ctrl.MemUncorrectableErrorCount = 0
+	if r = Evaluate([]*collector.Host{h}, rules); r.Status != Unknown {
+		t.Fatalf("skipped objects on a healthy controller must be UNKNOWN, got %s", r)
+	}
+}
+
+func TestRules(t *testing.T) {
+	pd := &megaraid.MR_PD_INFO{}
+	pd.EnclDeviceId, pd.SlotNumber = 252, 3
+	pd.FwState = uint16(megaraid.MR_PD_STATE_FAILED)
+	h := &collector.Host{
+		Ctrl: &megaraid.ControllerInfo{},
+		Pds:  []collector.Pd{{Info: pd}},
+		// RAID 1 没有热备, 新规则默认不检查
+		Config: &megaraid.Config{Lds: []megaraid.MR_LD_CONFIG{{}}},
+		Lds:    []megaraid.LD_INFO{{State: 3}},
+	}
+	h.Config.Lds[0].Params.PrimaryRaidLevel = 1
+
+	rules := DefaultRules()
+	r := Evaluate([]*collector.Host{h}, rules)
+	if r.Status != Critical || len(r.Messages) != 1 || r.Messages[0] != "CRITICAL: c0/e252/s3 is Failed" {
+		t.Fatalf("unexpected result %s", r)
+	}
+
+	if err := rules.EnableRule(health.RuleNoHotSpare); err != nil {
+		t.Fatal(err)
+	}
+	if r = Evaluate([]*collector.Host{h}, rules); len(r.Messages) != 2 || r.Messages[1] != "WARNING: c0/v0 RAID1 has no hot spare" {
+		t.Fatalf("enabled rule must be checked, got %s", r)
+	}
+
+	if err := rules.DisableRule(health.RulePdFailed); err != nil {
+		t.Fatal(err)
+	}
+	if r = Evaluate([]*collector.Host{h}, rules); r.Status != Warning || len(r.Messages) != 1 {
+		t.Fatalf("disabled rule must not be checked, got %s", r)
+	}
+
+	if rules.EnableRule("foo") == nil || rules.DisableRule("foo") == nil {
+		t.Fatal("unknown rules must be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+// check_megaraid 是 Nagios/Icinga 的检查插件, 返回码为 0/1/2/3 (OK/WARNING/CRITICAL/UNKNOWN)
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid/collector"
+	"github.com/ishmaelwanglin/megaraid/health"
+	"github.com/ishmaelwanglin/megaraid/storcli"
+)
+
+func thresholdFlags(name string, t *Threshold) {
+	flag.Float64Var(&t.Warning, name+".warning", t.Warning, "warning threshold for "+name+", 0 disables")
+	flag.Float64Var(&t.Critical, name+".critical", t.Critical, "critical threshold for "+name+", 0 disables")
+}
+
+func main() {
+	rules := DefaultRules()
+	thresholdFlags("mem-uncorrectable", &rules.MemUncorrectable)
+	thresholdFlags("predictive-failures", &rules.PredictiveFailures)
+	thresholdFlags("media-errors", &rules.MediaErrors)
+	thresholdFlags("pd-temperature", &rules.PdTemperature)
+	flag.BoolVar(&rules.Rebuild, "rebuild", rules.Rebuild, "warn while a drive is rebuilding")
+	flag.BoolVar(&rules.Bbu, "bbu", rules.Bbu, "warn when the BBU needs replacement or is in a learn cycle")
+	storcliCmd := flag.String("storcli", "", "storcli/perccli to use when the ioctl device cannot be opened, searched in PATH if empty")
+	timeout := flag.Duration("timeout", 30*time.Second, "return UNKNOWN when the controller does not answer within this duration")
+	rulesFile := flag.String("rules", "", "YAML file with additional health rules")
+	var enable, disable []string
+	flag.Func("enable-rule", "enable a built-in health rule that is off by default ("+strings.Join(optInRules, ", ")+"), can be repeated", func(s string) error {
+		enable = append(enable, s)
+		return nil
+	})
+	flag.Func("disable-rule", "disable a built-in or custom health rule, can be repeated", func(s string) error {
+		disable = append(disable, s)
+		return nil
+	})
+	flag.Parse()
+
+	if *rulesFile != "" {
+		custom, err := health.LoadRulesFile(*rulesFile)
+		if err != nil {
+			fmt.Printf("MEGARAID %s - %v\n", Unknown, err)
+			os.Exit(int(Unknown))
+		}
+		rules.Health = append(rules.Health, custom...)
+	}
+	for _, name := range enable {
+		if err := rules.EnableRule(name); err != nil {
+			fmt.Printf("MEGARAID %s - -enable-rule: %v\n", Unknown, err)
+			os.Exit(int(Unknown))
+		}
+	}
+	for _, name := range disable {
+		if err := rules.DisableRule(name); err != nil {
+			fmt.Printf("MEGARAID %s - -disable-rule: %v\n", Unknown, err)
+			os.Exit(int(Unknown))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	os.Exit(int(run(ctx, rules, *storcliCmd)))
+}
+
+func run(ctx context.Context, rules Rules, storcliCmd string) Status {
+	unknown := func(err error) Status {
+		fmt.Printf("MEGARAID %s - %v\n", Unknown, err)
+		return Unknown
+	}
+
+	b, err := storcli.OpenBackend(storcliCmd)
+	if err != nil {
+		return unknown(err)
+	}
+	defer b.Close()
+
+	hostNos, err := b.ScanHosts(ctx)
+	if err != nil {
+		return unknown(err)
+	}
+	if len(hostNos) == 0 {
+		return unknown(fmt.Errorf("no megaraid_sas controller found"))
+	}
+
+	var hosts []*collector.Host
+	for _, hostNo := range hostNos {
+		h, err := b.Gather(ctx, hostNo)
+		if err != nil {
+			return unknown(fmt.Errorf("host %d: %w", hostNo, err))
+		}
+		hosts = append(hosts, h)
+	}
+
+	result := Evaluate(hosts, rules)
+	fmt.Println(result)
+	return result.Status
+}
@@ -0,0 +1,293 @@
+// Package collector 把 MegaRAID 控制器、逻辑盘、物理盘和 BBU 的状态导出为 Prometheus 指标
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "megaraid"
+
+var (
+	hostLabels = []string{"host"}
+	ldLabels   = []string{"host", "target_id"}
+	pdLabels   = []string{"host", "enclosure", "slot", "serial", "wwn"}
+)
+
+func newDesc(name, help string, labels []string, extra ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, append(append([]string{}, labels...), extra...), nil)
+}
+
+var (
+	ctrlInfoDesc            = newDesc("controller_info", "Controller information, value is always 1.", hostLabels, "product", "serial", "package_version")
+	ctrlTempROCDesc         = newDesc("controller_roc_temperature_celsius", "Temperature of the RAID-on-chip.", hostLabels)
+	ctrlTempCtrlDesc        = newDesc("controller_temperature_celsius", "Temperature of the controller board.", hostLabels)
+	ctrlMemCorrectableDesc  = newDesc("controller_memory_correctable_errors_total", "Correctable ECC errors of the controller memory.", hostLabels)
+	ctrlMemUncorrectDesc    = newDesc("controller_memory_uncorrectable_errors_total", "Uncorrectable ECC errors of the controller memory.", hostLabels)
+	ldPresentDesc           = newDesc("ld_present", "Number of logical drives present.", hostLabels)
+	ldDegradedDesc          = newDesc("ld_degraded", "Number of degraded logical drives.", hostLabels)
+	ldOfflineDesc           = newDesc("ld_offline", "Number of offline logical drives.", hostLabels)
+	ldStateDesc             = newDesc("ld_state", "State of the logical drive, value is always 1.", ldLabels, "state")
+	pdStateDesc             = newDesc("pd_state", "Firmware state of the physical drive, value is always 1.", pdLabels, "state")
+	pdMediaErrorsDesc       = newDesc("pd_media_errors_total", "Media errors of the physical drive.", pdLabels)
+	pdOtherErrorsDesc       = newDesc("pd_other_errors_total", "Other errors of the physical drive.", pdLabels)
+	pdPredictiveFailureDesc = newDesc("pd_predictive_failures_total", "Predictive failure count of the physical drive.", pdLabels)
+	pdTemperatureDesc       = newDesc("pd_temperature_celsius", "Temperature of the physical drive.", pdLabels)
+	pdLinkSpeedDesc         = newDesc("pd_link_speed_gbps", "Negotiated link speed of the physical drive in Gb/s.", pdLabels)
+	pdRebuildDesc           = newDesc("pd_rebuild_progress_percent", "Rebuild progress of the physical drive, only exported while rebuilding.", pdLabels)
+	bbuHealthyDesc          = newDesc("bbu_healthy", "1 if the BBU is present and reports no error.", hostLabels)
+	bbuStatusDesc           = newDesc("bbu_fw_status", "Raw firmware status bits of the BBU.", hostLabels)
+	bbuTemperatureDesc      = newDesc("bbu_temperature_celsius", "Temperature of the BBU.", hostLabels)
+	bbuVoltageDesc          = newDesc("bbu_voltage_volts", "Voltage of the BBU.", hostLabels)
+	scrapeSuccessDesc       = newDesc("scrape_success", "1 if all controllers were read successfully.", nil)
+	scrapeDurationDesc      = newDesc("scrape_duration_seconds", "Time taken to read all controllers.", nil)
+)
+
+// Host 是一个控制器一次采集的结果. ioctl 来源由 megaraid.ControllerSnapshot 构造, 见 NewHost
+type Host struct {
+	Ctrl *megaraid.ControllerInfo
+	Lds  []megaraid.LD_INFO
+	Pds  []Pd
+	// Enclosures 是 PD list 中的 SES 设备
+	Enclosures []megaraid.MR_PD_ADDRESS
+	Bbu        *megaraid.MR_BBU_STATUS // 没有 BBU 时为 nil
+	// Config 是 RAID 配置, 读取失败时为 nil
+	Config *megaraid.Config
+	// Errors 是读取时跳过的对象, 同 megaraid.ControllerSnapshot.Errors
+	Errors []string
+
+	snap *megaraid.ControllerSnapshot // 构造 Host 的快照, 其他来源为 nil
+}
+
+// NewHost 用 megaraid.MegasasIoctl.SnapshotController 读取的快照构造 Host.
+// 控制器信息没有读到, 或者快照是从 JSON 还原的、没有原始数据时返回错误
+func NewHost(c *megaraid.ControllerSnapshot) (*Host, error) {
+	if c.Info == nil {
+		return nil, fmt.Errorf("%s", strings.Join(c.Errors, "; "))
+	}
+	if c.Raw == nil {
+		return nil, fmt.Errorf("host %d: snapshot has no raw data", c.HostNo)
+	}
+	h := &Host{
+		Ctrl:       c.Info,
+		Lds:        c.Raw.Lds,
+		Enclosures: c.Raw.Enclosures,
+		Bbu:        c.Raw.Bbu,
+		Config:     c.Raw.Config,
+		Errors:     c.Errors,
+		snap:       c,
+	}
+	for i, info := range c.Raw.Pds {
+		p := &c.Pds[i]
+		h.Pds = append(h.Pds, Pd{Info: info, Serial: p.Serial, WWN: p.WWN, Vendor: p.Vendor, Model: p.Model, Firmware: p.Firmware})
+	}
+	return h, nil
+}
+
+// Pd 是一块物理盘的信息和从 inquiry/VPD 解析出的序列号、WWN、型号和固件版本
+type Pd struct {
+	Info     *megaraid.MR_PD_INFO
+	Serial   string
+	WWN      string
+	Vendor   string
+	Model    string
+	Firmware string
+}
+
+// Snapshot 返回 Host 对应的 megaraid.ControllerSnapshot. NewHost 构造的 Host 直接返回读取时的快照;
+// storcli 等其他来源没有快照, 由采集结果转换, 使它们也可以用 megaraid.Diff 和 health 包检查.
+// 转换时 RAID 配置没有读到的记录在 Errors 中, 逻辑盘只有状态和大小
+func (h *Host) Snapshot() megaraid.ControllerSnapshot {
+	if h.snap != nil {
+		return *h.snap
+	}
+	c := megaraid.ControllerSnapshot{HostNo: h.Ctrl.HostNo, Info: h.Ctrl, Errors: slices.Clone(h.Errors)}
+	for _, e := range h.Enclosures {
+		c.Enclosures = append(c.Enclosures, megaraid.EnclosureSnapshot{DeviceId: e.DeviceId, SasAddr: e.GetSasAddrs()})
+	}
+	for _, pd := range h.Pds {
+		p := megaraid.NewPdSnapshot(pd.Info)
+		// storcli 来源没有 inquiry 和 VPD 原始数据
+		if p.Serial == "" {
+			p.Vendor, p.Model, p.Serial, p.Firmware = pd.Vendor, pd.Model, pd.Serial, pd.Firmware
+		}
+		if p.WWN == "" {
+			p.WWN = pd.WWN
+		}
+		c.Pds = append(c.Pds, p)
+		c.BackgroundOps = append(c.BackgroundOps, megaraid.NewBackgroundOps(pd.Info)...)
+		for i := range c.Enclosures {
+			if c.Enclosures[i].DeviceId == p.EnclDeviceId {
+				c.Enclosures[i].Slots++
+			}
+		}
+	}
+	if h.Config == nil {
+		c.Errors = append(c.Errors, "config: not available")
+	}
+	for i := range h.Lds {
+		c.Lds = append(c.Lds, megaraid.NewLdSnapshot(h.Config, &h.Lds[i], c.Pds))
+	}
+	c.HotSpares = megaraid.NewHotSpareSnapshots(h.Config)
+	if h.Bbu != nil {
+		c.Bbu = megaraid.NewBbuSnapshot(h.Bbu)
+	}
+	return c
+}
+
+// Gather 读取一个控制器, 与 megaraid.Snapshot 是同一个读取过程: 整个过程持有 host 的锁,
+// 单个对象读取失败时跳过并记录在 Host.Errors 中. 可以在多个 goroutine 中同时采集不同的控制器
+func Gather(ctx context.Context, m *megaraid.MegasasIoctl, hostNo uint16) (*Host, error) {
+	c, err := m.SnapshotController(ctx, hostNo)
+	if err != nil {
+		return nil, err
+	}
+	return NewHost(c)
+}
+
+// Backend 是采集数据的来源, 可以是 ioctl, 也可以是 storcli/perccli 的 JSON 输出
+type Backend interface {
+	ScanHosts(ctx context.Context) ([]uint16, error)
+	Gather(ctx context.Context, hostNo uint16) (*Host, error)
+	Close()
+}
+
+// IoctlBackend 通过 megaraid_sas 驱动的 ioctl 采集
+type IoctlBackend struct {
+	*megaraid.MegasasIoctl
+}
+
+// ScanHosts 只读 sysfs, 不会卡在控制器上
+func (b IoctlBackend) ScanHosts(ctx context.Context) ([]uint16, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.MegasasIoctl.ScanHosts()
+}
+
+func (b IoctlBackend) Gather(ctx context.Context, hostNo uint16) (*Host, error) {
+	return Gather(ctx, b.MegasasIoctl, hostNo)
+}
+
+// Collector 实现 prometheus.Collector, 每次 Collect 都会扫描所有控制器
+type Collector struct {
+	// Timeout 是一次 scrape 的超时, 0 为不超时
+	Timeout time.Duration
+
+	mu sync.Mutex // 多个 scrape 串行执行, 避免同时对控制器下发重复的命令
+	b  Backend
+}
+
+func New(b Backend) *Collector {
+	return &Collector{b: b}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		ctrlInfoDesc, ctrlTempROCDesc, ctrlTempCtrlDesc, ctrlMemCorrectableDesc, ctrlMemUncorrectDesc,
+		ldPresentDesc, ldDegradedDesc, ldOfflineDesc, ldStateDesc,
+		pdStateDesc, pdMediaErrorsDesc, pdOtherErrorsDesc, pdPredictiveFailureDesc, pdTemperatureDesc, pdLinkSpeedDesc, pdRebuildDesc,
+		bbuHealthyDesc, bbuStatusDesc, bbuTemperatureDesc, bbuVoltageDesc,
+		scrapeSuccessDesc, scrapeDurationDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	success := 1.0
+	hosts, err := c.b.ScanHosts(ctx)
+	if err != nil {
+		log.Printf("scan hosts: %v", err)
+		success = 0
+	}
+	for _, hostNo := range hosts {
+		h, err := c.b.Gather(ctx, hostNo)
+		if err != nil {
+			log.Printf("host %d: %v", hostNo, err)
+			success = 0
+			continue
+		}
+		for _, e := range h.Errors {
+			log.Printf("host %d: %s", hostNo, e)
+			success = 0
+		}
+		h.Emit(ch)
+	}
+
+	ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success)
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+}
+
+// Emit 把采集结果转成指标写到 ch
+func (h *Host) Emit(ch chan<- prometheus.Metric) {
+	host := strconv.Itoa(int(h.Ctrl.HostNo))
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, labels...)
+	}
+
+	var pkg string
+	if h.Ctrl.Firmware != nil {
+		pkg = h.Ctrl.Firmware.PackageVersion
+	}
+	gauge(ctrlInfoDesc, 1, host, h.Ctrl.ProductName, h.Ctrl.SerialNumber, pkg)
+	gauge(ctrlTempROCDesc, float64(h.Ctrl.TemperatureROC), host)
+	gauge(ctrlTempCtrlDesc, float64(h.Ctrl.TemperatureCtrl), host)
+	counter(ctrlMemCorrectableDesc, float64(h.Ctrl.MemCorrectableErrorCount), host)
+	counter(ctrlMemUncorrectDesc, float64(h.Ctrl.MemUncorrectableErrorCount), host)
+	gauge(ldPresentDesc, float64(h.Ctrl.LdPresentCount), host)
+	gauge(ldDegradedDesc, float64(h.Ctrl.LdDegradedCount), host)
+	gauge(ldOfflineDesc, float64(h.Ctrl.LdOfflineCount), host)
+
+	for i := range h.Lds {
+		gauge(ldStateDesc, 1, host, strconv.Itoa(int(h.Lds[i].Ref.TargetId)), h.Lds[i].GetState())
+	}
+
+	for _, pd := range h.Pds {
+		info := pd.Info
+		labels := []string{host, strconv.Itoa(int(info.EnclDeviceId)), strconv.Itoa(int(info.SlotNumber)), pd.Serial, pd.WWN}
+		gauge(pdStateDesc, 1, append(labels, info.GetFwState())...)
+		counter(pdMediaErrorsDesc, float64(info.MediaErrCount), labels...)
+		counter(pdOtherErrorsDesc, float64(info.OtherErrCount), labels...)
+		counter(pdPredictiveFailureDesc, float64(info.PredFailCount), labels...)
+		gauge(pdTemperatureDesc, float64(info.Temperature), labels...)
+		gauge(pdLinkSpeedDesc, info.GetLinkSpeed(), labels...)
+		if info.ProgInfo.Active[0]&megaraid.MR_PD_PROGRESS_REBUILD != 0 {
+			gauge(pdRebuildDesc, float64(info.ProgInfo.Rbld.Percent()), labels...)
+		}
+	}
+
+	if h.Bbu != nil {
+		var healthy float64
+		if h.Bbu.Healthy() {
+			healthy = 1
+		}
+		gauge(bbuHealthyDesc, healthy, host)
+		gauge(bbuStatusDesc, float64(h.Bbu.FwStatus), host)
+		gauge(bbuTemperatureDesc, float64(h.Bbu.Temperature), host)
+		gauge(bbuVoltageDesc, float64(h.Bbu.Voltage)/1000, host)
+	}
+}
@@ -0,0 +1,96 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type hostCollector struct{ h *Host }
+
+func (c hostCollector) Describe(ch chan<- *prometheus.Desc) { prometheus.DescribeByCollect(c, ch) }
+func (c hostCollector) Collect(ch chan<- prometheus.Metric) { c.h.Emit(ch) }
+
+func TestEmit(t *testing.T) {
+	pd := &megaraid.MR_PD_INFO{}
+	pd.EnclDeviceId, pd.SlotNumber = 252, 3
+	pd.FwState = uint16(megaraid.MR_PD_STATE_REBUILD)
+	pd.MediaErrCount = 7
+	pd.LinkSpeed = 4
+	pd.ProgInfo.Active[0] = megaraid.MR_PD_PROGRESS_REBUILD
+	pd.ProgInfo.Rbld.Mrprogress.Progress = 0x8000
+
+	h := &Host{
+		Ctrl: &megaraid.ControllerInfo{HostNo: 0, LdPresentCount: 1, LdDegradedCount: 1, TemperatureROC: 60},
+		Lds:  []megaraid.LD_INFO{{State: 2}},
+		Pds:  []Pd{{Info: pd, Serial: "S1"}},
+		Bbu:  &megaraid.MR_BBU_STATUS{BatteryType: megaraid.MR_BBU_TYPE_BBU, Voltage: 4000, FwStatus: megaraid.MR_BBU_STATE_VOLTAGE_LOW},
+	}
+
+	expected := `
+# HELP megaraid_bbu_healthy 1 if the BBU is present and reports no error.
+# TYPE megaraid_bbu_healthy gauge
+megaraid_bbu_healthy{host="0"} 0
+# HELP megaraid_ld_degraded Number of degraded logical drives.
+# TYPE megaraid_ld_degraded gauge
+megaraid_ld_degraded{host="0"} 1
+# HELP megaraid_ld_state State of the logical drive, value is always 1.
+# TYPE megaraid_ld_state gauge
+megaraid_ld_state{host="0",state="Degraded",target_id="0"} 1
+# HELP megaraid_pd_link_speed_gbps Negotiated link speed of the physical drive in Gb/s.
+# TYPE megaraid_pd_link_speed_gbps gauge
+megaraid_pd_link_speed_gbps{enclosure="252",host="0",serial="S1",slot="3",wwn=""} 12
+# HELP megaraid_pd_media_errors_total Media errors of the physical drive.
+# TYPE megaraid_pd_media_errors_total counter
+megaraid_pd_media_errors_total{enclosure="252",host="0",serial="S1",slot="3",wwn=""} 7
+# HELP megaraid_pd_rebuild_progress_percent Rebuild progress of the physical drive, only exported while rebuilding.
+# TYPE megaraid_pd_rebuild_progress_percent gauge
+megaraid_pd_rebuild_progress_percent{enclosure="252",host="0",serial="S1",slot="3",wwn=""} 50
+# HELP megaraid_pd_state Firmware state of the physical drive, value is always 1.
+# TYPE megaraid_pd_state gauge
+megaraid_pd_state{enclosure="252",host="0",serial="S1",slot="3",state="Rebuild",wwn=""} 1
+`
+	if err := testutil.CollectAndCompare(hostCollector{h}, strings.NewReader(expected),
+		"megaraid_bbu_healthy", "megaraid_ld_degraded", "megaraid_ld_state", "megaraid_pd_link_speed_gbps",
+		"megaraid_pd_media_errors_total", "megaraid_pd_rebuild_progress_percent", "megaraid_pd_state"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewHost(t *testing.T) {
+	pd := &megaraid.MR_PD_INFO{}
+	pd.EnclDeviceId, pd.SlotNumber = 252, 3
+	c := &megaraid.ControllerSnapshot{
+		HostNo: 2,
+		Info:   &megaraid.ControllerInfo{HostNo: 2},
+		Pds:    []megaraid.PdSnapshot{{EnclDeviceId: 252, Slot: 3, Serial: "S1", WWN: "naa.5000c500a1b2c3d4"}},
+		Errors: []string{"bbu: timeout"},
+		Raw: &megaraid.ControllerRaw{
+			Pds: []*megaraid.MR_PD_INFO{pd},
+			Lds: []megaraid.LD_INFO{{State: 3}},
+		},
+	}
+	h, err := NewHost(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Pds) != 1 || h.Pds[0].Info != pd || h.Pds[0].Serial != "S1" || h.Pds[0].WWN != "naa.5000c500a1b2c3d4" {
+		t.Fatalf("unexpected pds %+v", h.Pds)
+	}
+	if len(h.Lds) != 1 || len(h.Errors) != 1 {
+		t.Fatalf("unexpected host %+v", h)
+	}
+	if s := h.Snapshot(); s.Raw != c.Raw || s.Errors[0] != "bbu: timeout" {
+		t.Fatalf("Snapshot must return the gathered snapshot, got %+v", s)
+	}
+
+	if _, err := NewHost(&megaraid.ControllerSnapshot{HostNo: 2, Errors: []string{"controller info: timeout"}}); err == nil || err.Error() != "controller info: timeout" {
+		t.Fatalf("missing controller info must fail, got %v", err)
+	}
+	if _, err := NewHost(&megaraid.ControllerSnapshot{HostNo: 2, Info: c.Info}); err == nil {
+		t.Fatal("snapshot without raw data must fail")
+	}
+}
@@ -0,0 +1,122 @@
+package megaraid
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// Config 是解析后的 RAID 配置
+type Config struct {
+	Arrays []MR_ARRAY
+	Lds    []MR_LD_CONFIG
+	Spares []MR_SPARE
+}
+
+// MegasasGetConfig 读取 RAID 配置, 先读头部拿到总大小, 再按总大小读一次
+func (m *MegasasIoctl) MegasasGetConfig(ctx context.Context, instance *Instance) (*Config, error) {
+	instance.Buf = make([]byte, unsafe.Sizeof(MR_CONFIG_DATA{}))
+	instance.Cmd.OpCode = MR_DCMD_CFG_READ
+	instance.Dcmd.MboxB = [12]uint8{}
+	if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(instance.Buf)
+	if size > uint32(len(instance.Buf)) {
+		instance.Buf = make([]byte, size)
+		if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ); err != nil {
+			return nil, err
+		}
+	}
+
+	return ParseConfig(instance.Buf)
+}
+
+// ParseConfig 解析 MR_DCMD_CFG_READ 返回的数据
+func ParseConfig(buf []byte) (*Config, error) {
+	hdr := MR_CONFIG_DATA{}
+	r := bytes.NewReader(buf)
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		Arrays: make([]MR_ARRAY, hdr.ArrayCount),
+		Lds:    make([]MR_LD_CONFIG, hdr.LogDrvCount),
+		Spares: make([]MR_SPARE, hdr.SparesCount),
+	}
+
+	offset := binary.Size(hdr)
+	for _, section := range []struct {
+		count, size int
+		read        func(i int, b []byte) error
+	}{
+		{len(cfg.Arrays), sectionSize(hdr.ArraySize, MR_ARRAY{}), func(i int, b []byte) error {
+			return decodeElem(b, &cfg.Arrays[i])
+		}},
+		{len(cfg.Lds), sectionSize(hdr.LogDrvSize, MR_LD_CONFIG{}), func(i int, b []byte) error {
+			return decodeElem(b, &cfg.Lds[i])
+		}},
+		{len(cfg.Spares), sectionSize(hdr.SparesSize, MR_SPARE{}), func(i int, b []byte) error {
+			return decodeElem(b, &cfg.Spares[i])
+		}},
+	} {
+		for i := 0; i < section.count; i++ {
+			if offset+section.size > len(buf) {
+				return nil, fmt.Errorf("config data truncated at offset %d", offset)
+			}
+			if err := section.read(i, buf[offset:offset+section.size]); err != nil {
+				return nil, err
+			}
+			offset += section.size
+		}
+	}
+
+	return cfg, nil
+}
+
+// decodeElem 解码一个元素. 固件的元素大小和 Go 结构体不一致时, 多出的部分忽略, 不足的部分按 0 解码
+func decodeElem(b []byte, v any) error {
+	elem := make([]byte, binary.Size(v))
+	copy(elem, b)
+	return binary.Read(bytes.NewReader(elem), binary.LittleEndian, v)
+}
+
+// sectionSize 优先用头部里固件给出的元素大小, 没给时用结构体大小
+func sectionSize(size uint16, v any) int {
+	if size == 0 {
+		return binary.Size(v)
+	}
+	return int(size)
+}
+
+// ArrayOf 返回物理盘所在 array 的 ArrayRef
+func (c *Config) ArrayOf(deviceId uint16) (uint16, bool) {
+	for i := range c.Arrays {
+		a := &c.Arrays[i]
+		for j := 0; j < int(a.NumDrives) && j < len(a.Pd); j++ {
+			if a.Pd[j].Ref.DeviceId == deviceId {
+				return a.ArrayRef, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// LdsOfArray 返回使用了该 array 的逻辑盘 targetId
+func (c *Config) LdsOfArray(arrayRef uint16) []uint8 {
+	var targets []uint8
+	for i := range c.Lds {
+		ld := &c.Lds[i]
+		for j := 0; j < int(ld.Params.SpanDepth) && j < len(ld.Span); j++ {
+			if ld.Span[j].ArrayRef == arrayRef {
+				targets = append(targets, ld.Properties.Ref.TargetId)
+				break
+			}
+		}
+	}
+	return targets
+}
@@ -0,0 +1,105 @@
+package megaraid
+
+import "context"
+
+// Controller 是一个 host 的句柄, 可以在多个 goroutine 中使用. 同一个 host 的命令按顺序逐条下发,
+// 每次 Do 都使用新的 Instance, 不同调用之间不会共享 Buf 和 MboxB
+type Controller struct {
+	m      *MegasasIoctl
+	hostNo uint16
+	sem    chan struct{} // 容量为 1, 作为可以被 select 的锁
+}
+
+// Controller 返回 host 的句柄, 同一个 MegasasIoctl 对同一个 host 总是返回同一个句柄
+func (m *MegasasIoctl) Controller(hostNo uint16) *Controller {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.controllers == nil {
+		m.controllers = make(map[uint16]*Controller)
+	}
+	c, ok := m.controllers[hostNo]
+	if !ok {
+		c = &Controller{m: m, hostNo: hostNo, sem: make(chan struct{}, 1)}
+		m.controllers[hostNo] = c
+	}
+	return c
+}
+
+func (c *Controller) HostNo() uint16 {
+	return c.hostNo
+}
+
+// Do 在持有 host 的锁时执行 fn, fn 中的命令应该使用同一个 ctx, fn 返回后不能再引用 instance.Buf.
+// 等锁时 ctx 结束返回 ctx.Err(), ctx 为 nil 时一直等待; host 上有超时后还没返回的命令时直接返回 ErrHostBusy, 不等锁
+func (c *Controller) Do(ctx context.Context, fn func(m *MegasasIoctl, instance *Instance) error) error {
+	if err := c.m.hostBusy(c.hostNo); err != nil {
+		return err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.sem }()
+
+	instance := Instance{HostNo: c.hostNo}
+	return fn(c.m, &instance)
+}
+
+// GetControllerInfo 见 MegasasGetControllerInfo
+func (c *Controller) GetControllerInfo(ctx context.Context) (info *ControllerInfo, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		info, err = m.MegasasGetControllerInfo(ctx, instance)
+		return err
+	})
+	return info, err
+}
+
+// GetPdList 见 MegasasGetPdList
+func (c *Controller) GetPdList(ctx context.Context) (devices []MR_PD_ADDRESS, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		devices, err = m.MegasasGetPdList(ctx, instance)
+		return err
+	})
+	return devices, err
+}
+
+// GetPdInfo 见 MegasasGetPdInfo
+func (c *Controller) GetPdInfo(ctx context.Context, sdev *ScsiDevice) (info *MR_PD_INFO, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		info, err = m.MegasasGetPdInfo(ctx, instance, sdev)
+		return err
+	})
+	return info, err
+}
+
+// GetLdList 见 MegasasGetLdList
+func (c *Controller) GetLdList(ctx context.Context) (list *MR_LD_LIST, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		list, err = m.MegasasGetLdList(ctx, instance)
+		return err
+	})
+	return list, err
+}
+
+// GetConfig 见 MegasasGetConfig
+func (c *Controller) GetConfig(ctx context.Context) (cfg *Config, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		cfg, err = m.MegasasGetConfig(ctx, instance)
+		return err
+	})
+	return cfg, err
+}
+
+// GetBbuStatus 见 MegasasGetBbuStatus
+func (c *Controller) GetBbuStatus(ctx context.Context) (bbu *MR_BBU_STATUS, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		bbu, err = m.MegasasGetBbuStatus(ctx, instance)
+		return err
+	})
+	return bbu, err
+}
@@ -0,0 +1,558 @@
+package megaraid
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// mfiEpoch 固件时间(CurrentFwTime, 事件时间戳)是从 2000-01-01 00:00:00 UTC 开始的秒数
+var mfiEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func flag[T uintInterface](data T, offset uint) bool {
+	return BitField(data, offset, 1) == 1
+}
+
+// sasAddrs 把 [2n]uint32 表示的 [n]uint64 还原, 只保留前 count 个端口
+func sasAddrs(arr []uint32, count int) []uint64 {
+	var addrs []uint64
+	for i := 0; i+1 < len(arr) && i/2 < count; i += 2 {
+		addrs = append(addrs, uint64(arr[i])|uint64(arr[i+1])<<32)
+	}
+	return addrs
+}
+
+type PciInfo struct {
+	VendorId    uint16
+	DeviceId    uint16
+	SubVendorId uint16
+	SubDeviceId uint16
+}
+
+type HostInterface struct {
+	PCIX      bool
+	PCIE      bool
+	ISCSI     bool
+	SAS3G     bool
+	SRIOV     bool
+	PortCount uint8
+	PortAddr  []uint64
+}
+
+// DeviceInterface 是后端(连盘侧)接口, 固件只给出支持的协议位, 不包含 6G/12G 这样的速率;
+// storcli 显示的 SAS-12G 是按卡型号补上的, 比如 SAS3108 上 bits = 0b1010 (SAS + SATA-3G)
+type DeviceInterface struct {
+	SPI       bool
+	SAS3G     bool
+	SATA1_5G  bool
+	SATA3G    bool
+	PortCount uint8
+	PortAddr  []uint64
+}
+
+// String 返回支持的协议, 比如 SAS/SATA
+func (d DeviceInterface) String() string {
+	var protocols []string
+	if d.SPI {
+		protocols = append(protocols, "SPI")
+	}
+	if d.SAS3G {
+		protocols = append(protocols, "SAS")
+	}
+	if d.SATA1_5G || d.SATA3G {
+		protocols = append(protocols, "SATA")
+	}
+	if len(protocols) == 0 {
+		return "Unknown"
+	}
+	return strings.Join(protocols, "/")
+}
+
+type HwPresent struct {
+	BBU   bool
+	Alarm bool
+	NVRAM bool
+	UART  bool
+}
+
+type RaidLevels struct {
+	Raid0  bool
+	Raid1  bool
+	Raid5  bool
+	Raid1E bool
+	Raid6  bool
+}
+
+// Levels 返回支持的 RAID 级别, 比如 [0 1 5 6]
+func (r RaidLevels) Levels() []string {
+	var levels []string
+	for _, l := range []struct {
+		ok   bool
+		name string
+	}{{r.Raid0, "0"}, {r.Raid1, "1"}, {r.Raid5, "5"}, {r.Raid1E, "1E"}, {r.Raid6, "6"}} {
+		if l.ok {
+			levels = append(levels, l.name)
+		}
+	}
+	return levels
+}
+
+type AdapterOperations struct {
+	RebuildRate          bool
+	CcRate               bool
+	BgiRate              bool
+	ReconRate            bool
+	PatrolRate           bool
+	AlarmControl         bool
+	ClusterSupported     bool
+	BBU                  bool
+	SpanningAllowed      bool
+	DedicatedHotspares   bool
+	RevertibleHotspares  bool
+	ForeignConfigImport  bool
+	SelfDiagnostic       bool
+	MixedRedundancyArray bool
+	GlobalHotSpares      bool
+}
+
+type AdapterOperations2 struct {
+	SupportPIController        bool
+	SupportLdPIType1           bool
+	SupportLdPIType2           bool
+	SupportLdPIType3           bool
+	SupportLdBBMInfo           bool
+	SupportShieldState         bool
+	BlockSSDWriteCacheChange   bool
+	SupportSuspendResumeBGops  bool
+	SupportEmergencySpares     bool
+	SupportSetLinkSpeed        bool
+	SupportBootTimePFKChange   bool
+	SupportJBOD                bool
+	DisableOnlinePFKChange     bool
+	SupportPerfTuning          bool
+	SupportSSDPatrolRead       bool
+	RealTimeScheduler          bool
+	SupportResetNow            bool
+	SupportEmulatedDrives      bool
+	HeadlessMode               bool
+	DedicatedHotSparesLimited  bool
+	SupportUnevenSpans         bool
+	SupportPointInTimeProgress bool
+	SupportDataLDonSSCArray    bool
+	MPIO                       bool
+	SupportConfigAutoBalance   bool
+	ActivePassive              uint8 // 2 bits
+}
+
+type AdapterOperations3 struct {
+	SupportPersonalityChange         uint8 // 2 bits
+	SupportThermalPollInterval       bool
+	SupportDisableImmediateIO        bool
+	SupportT10RebuildAssist          bool
+	SupportMaxExtLDs                 bool
+	SupportCrashDump                 bool
+	SupportSwZone                    bool
+	SupportDebugQueue                bool
+	SupportNVCacheErase              bool
+	SupportForceTo512e               bool
+	SupportHOQRebuild                bool
+	SupportAllowedOpsforDrvRemoval   bool
+	SupportDrvActivityLEDSetting     bool
+	SupportNVDRAM                    bool
+	SupportForceFlash                bool
+	SupportDisableSESMonitoring      bool
+	SupportCacheBypassModes          bool
+	SupportSecurityonJBOD            bool
+	DiscardCacheDuringLDDelete       bool
+	SupportTTYLogCompression         bool
+	SupportCPLDUpdate                bool
+	SupportDiskCacheSettingForSysPDs bool
+	SupportExtendedSSCSize           bool
+	UseSeqNumJbodFP                  bool
+}
+
+type AdapterOperations4 struct {
+	CtrlInfoExtSupported         bool
+	SupportIbuttonLess           bool
+	SupportedEncAlgo             bool
+	SupportEncryptedMfc          bool
+	ImageUploadSupported         bool
+	SupportSesCtrlInMultipathcfg bool
+	SupportPdMapTargetId         bool
+	FwSwapsBbuVpdInfo            bool
+	SupportSscRev3               bool
+	SupportDualFwUpdate          bool
+	SupportHostInfo              bool
+	SupportFlashCompInfo         bool
+	SupportPlDebugInfo           bool
+	SupportNvmePassthru          bool
+}
+
+type AdapterOperations5 struct {
+	MrConfigExt2Supported         bool
+	SupportProfileChange          uint8 // 2 bits
+	SupportCvhealthInfo           bool
+	SupportPcie                   bool
+	SupportExtMfgVpd              bool
+	SupportOceOnly                bool
+	SupportNvmeTm                 bool
+	SupportSnapDump               bool
+	SupportFdeTypeMix             bool
+	SupportForcePersonalityChange bool
+	SupportPsocUpdate             bool
+	SupportPciLaneMargining       bool
+}
+
+type LdOperations struct {
+	ReadPolicy      bool
+	WritePolicy     bool
+	IoPolicy        bool
+	AccessPolicy    bool
+	DiskCachePolicy bool
+}
+
+type PdOperations struct {
+	ForceOnline  bool
+	ForceOffline bool
+	ForceRebuild bool
+}
+
+type PdMixSupport struct {
+	SAS                bool
+	SATA               bool
+	AllowMixInEncl     bool
+	AllowMixInLd       bool
+	AllowSataInCluster bool
+}
+
+type Cluster struct {
+	PeerIsPresent          bool
+	PeerIsIncompatible     bool
+	HwIncompatible         bool
+	FwVersionMismatch      bool
+	CtrlPropIncompatible   bool
+	PremiumFeatureMismatch bool
+	Passive                bool
+}
+
+// ControllerInfo 是解码后的控制器信息, 字段含义见 megasas_ctrl_info
+type ControllerInfo struct {
+	HostNo       uint16
+	Pci          PciInfo
+	ProductName  string
+	SerialNumber string
+
+	HostInterface   HostInterface
+	DeviceInterface DeviceInterface
+	HwPresent       HwPresent
+	CurrentFwTime   time.Time
+
+	MaxArms           uint8
+	MaxSpans          uint8
+	MaxArrays         uint8
+	MaxLds            uint8
+	MaxConcurrentCmds uint16
+	MaxSgeCount       uint16
+	MaxRequestSize    uint32
+	MaxStripsPerIo    uint16
+	MaxPds            uint16
+	MaxDedHSPs        uint16
+	MaxGlobalHSP      uint16
+	MaxLdsPerArray    uint8
+	MinStripeSize     uint32 // Bytes
+	MaxStripeSize     uint32 // Bytes
+
+	LdPresentCount         uint16
+	LdDegradedCount        uint16
+	LdOfflineCount         uint16
+	PdPresentCount         uint16
+	PdDiskPresentCount     uint16
+	PdDiskPredFailureCount uint16
+	PdDiskFailedCount      uint16
+
+	NvramSize       uint16 // KB
+	MemorySize      uint16 // MB
+	FlashSize       uint16 // MB
+	CacheMemorySize uint16 // MB
+
+	MemCorrectableErrorCount   uint16
+	MemUncorrectableErrorCount uint16
+
+	TemperatureROC  uint8 // ℃
+	TemperatureCtrl uint8 // ℃
+
+	ClusterPermitted bool
+	ClusterActive    bool
+	Cluster          Cluster
+
+	RaidLevels         RaidLevels
+	AdapterOperations  AdapterOperations
+	AdapterOperations2 AdapterOperations2
+	AdapterOperations3 AdapterOperations3
+	AdapterOperations4 AdapterOperations4
+	AdapterOperations5 AdapterOperations5
+	LdOperations       LdOperations
+	PdOperations       PdOperations
+	PdMixSupport       PdMixSupport
+
+	JbodEnabled bool
+	// LockKeyBound 表示控制器已经绑定了 SED 密钥(lockKeyBinding 非 0)
+	LockKeyBound bool
+
+	Firmware *FirmwareInventory
+}
+
+// Decode 把 megasas_ctrl_info 里的位域展开成 ControllerInfo
+func (ctrl *megasas_ctrl_info) Decode() *ControllerInfo {
+	host, dev := ctrl.HostInterface.Bits, ctrl.DeviceInterface.Bits
+	ops, ops2, ops3, ops4, ops5 := ctrl.AdapterOperations.Bits, ctrl.AdapterOperations2.Bits,
+		ctrl.AdapterOperations3.Bits, ctrl.AdapterOperations4.Bits, ctrl.AdapterOperations5.Bits
+	cluster := ctrl.Cluster.Bits
+
+	info := &ControllerInfo{
+		Pci: PciInfo{
+			VendorId:    ctrl.Pci.VendorId,
+			DeviceId:    ctrl.Pci.DeviceId,
+			SubVendorId: ctrl.Pci.SubVendorId,
+			SubDeviceId: ctrl.Pci.SubDeviceId,
+		},
+		ProductName:  trimString(ctrl.ProductName[:]),
+		SerialNumber: trimString(ctrl.SerialNo[:]),
+		HostInterface: HostInterface{
+			PCIX:      flag(host, 0),
+			PCIE:      flag(host, 1),
+			ISCSI:     flag(host, 2),
+			SAS3G:     flag(host, 3),
+			SRIOV:     flag(host, 4),
+			PortCount: ctrl.HostInterface.PortCount,
+			PortAddr:  sasAddrs(ctrl.HostInterface.PortAddr[:], int(ctrl.HostInterface.PortCount)),
+		},
+		DeviceInterface: DeviceInterface{
+			SPI:       flag(dev, 0),
+			SAS3G:     flag(dev, 1),
+			SATA1_5G:  flag(dev, 2),
+			SATA3G:    flag(dev, 3),
+			PortCount: ctrl.DeviceInterface.PortCount,
+			PortAddr:  sasAddrs(ctrl.DeviceInterface.PortAddr[:], int(ctrl.DeviceInterface.PortCount)),
+		},
+		HwPresent: HwPresent{
+			BBU:   flag(ctrl.HwPresent.Bits, 0),
+			Alarm: flag(ctrl.HwPresent.Bits, 1),
+			NVRAM: flag(ctrl.HwPresent.Bits, 2),
+			UART:  flag(ctrl.HwPresent.Bits, 3),
+		},
+		CurrentFwTime: mfiEpoch.Add(time.Duration(ctrl.CurrentFwTime) * time.Second),
+
+		MaxArms:           ctrl.MaxArms,
+		MaxSpans:          ctrl.MaxSpans,
+		MaxArrays:         ctrl.MaxArrays,
+		MaxLds:            ctrl.MaxLds,
+		MaxConcurrentCmds: ctrl.MaxConcurrentCmds,
+		MaxSgeCount:       ctrl.MaxSgeCount,
+		MaxRequestSize:    ctrl.MaxRequestSize,
+		MaxStripsPerIo:    ctrl.MaxStripsPerIo,
+		MaxPds:            ctrl.MaxPds,
+		MaxDedHSPs:        ctrl.MaxDedHSPs,
+		MaxGlobalHSP:      ctrl.MaxGlobalHSP,
+		MaxLdsPerArray:    ctrl.MaxLdsPerArray,
+		// 条带大小是 512 << n
+		MinStripeSize: SectorSz << ctrl.StripeSzOps.Min,
+		MaxStripeSize: SectorSz << ctrl.StripeSzOps.Max,
+
+		LdPresentCount:         ctrl.LdPresentCount,
+		LdDegradedCount:        ctrl.LdDegradedCount,
+		LdOfflineCount:         ctrl.LdOfflineCount,
+		PdPresentCount:         ctrl.PdPresentCount,
+		PdDiskPresentCount:     ctrl.PdDiskPresentCount,
+		PdDiskPredFailureCount: ctrl.PdDiskPredFailureCount,
+		PdDiskFailedCount:      ctrl.PdDiskFailedCount,
+
+		NvramSize:       ctrl.NvramSize,
+		MemorySize:      ctrl.MemorySize,
+		FlashSize:       ctrl.FlashSize,
+		CacheMemorySize: ctrl.CacheMemorySize,
+
+		MemCorrectableErrorCount:   ctrl.MemCorrectableErrorCount,
+		MemUncorrectableErrorCount: ctrl.MemUncorrectableErrorCount,
+
+		TemperatureROC:  ctrl.TemperatureROC,
+		TemperatureCtrl: ctrl.TemperatureCtrl,
+
+		ClusterPermitted: ctrl.ClusterPermitted != 0,
+		ClusterActive:    ctrl.ClusterActive != 0,
+		Cluster: Cluster{
+			PeerIsPresent:          flag(cluster, 0),
+			PeerIsIncompatible:     flag(cluster, 1),
+			HwIncompatible:         flag(cluster, 2),
+			FwVersionMismatch:      flag(cluster, 3),
+			CtrlPropIncompatible:   flag(cluster, 4),
+			PremiumFeatureMismatch: flag(cluster, 5),
+			Passive:                flag(cluster, 6),
+		},
+
+		RaidLevels: RaidLevels{
+			Raid0:  flag(ctrl.RaidLevels.Bits, 0),
+			Raid1:  flag(ctrl.RaidLevels.Bits, 1),
+			Raid5:  flag(ctrl.RaidLevels.Bits, 2),
+			Raid1E: flag(ctrl.RaidLevels.Bits, 3),
+			Raid6:  flag(ctrl.RaidLevels.Bits, 4),
+		},
+		AdapterOperations: AdapterOperations{
+			RebuildRate:          flag(ops, 0),
+			CcRate:               flag(ops, 1),
+			BgiRate:              flag(ops, 2),
+			ReconRate:            flag(ops, 3),
+			PatrolRate:           flag(ops, 4),
+			AlarmControl:         flag(ops, 5),
+			ClusterSupported:     flag(ops, 6),
+			BBU:                  flag(ops, 7),
+			SpanningAllowed:      flag(ops, 8),
+			DedicatedHotspares:   flag(ops, 9),
+			RevertibleHotspares:  flag(ops, 10),
+			ForeignConfigImport:  flag(ops, 11),
+			SelfDiagnostic:       flag(ops, 12),
+			MixedRedundancyArray: flag(ops, 13),
+			GlobalHotSpares:      flag(ops, 14),
+		},
+		AdapterOperations2: AdapterOperations2{
+			SupportPIController:        flag(ops2, 0),
+			SupportLdPIType1:           flag(ops2, 1),
+			SupportLdPIType2:           flag(ops2, 2),
+			SupportLdPIType3:           flag(ops2, 3),
+			SupportLdBBMInfo:           flag(ops2, 4),
+			SupportShieldState:         flag(ops2, 5),
+			BlockSSDWriteCacheChange:   flag(ops2, 6),
+			SupportSuspendResumeBGops:  flag(ops2, 7),
+			SupportEmergencySpares:     flag(ops2, 8),
+			SupportSetLinkSpeed:        flag(ops2, 9),
+			SupportBootTimePFKChange:   flag(ops2, 10),
+			SupportJBOD:                flag(ops2, 11),
+			DisableOnlinePFKChange:     flag(ops2, 12),
+			SupportPerfTuning:          flag(ops2, 13),
+			SupportSSDPatrolRead:       flag(ops2, 14),
+			RealTimeScheduler:          flag(ops2, 15),
+			SupportResetNow:            flag(ops2, 16),
+			SupportEmulatedDrives:      flag(ops2, 17),
+			HeadlessMode:               flag(ops2, 18),
+			DedicatedHotSparesLimited:  flag(ops2, 19),
+			SupportUnevenSpans:         flag(ops2, 20),
+			SupportPointInTimeProgress: flag(ops2, 21),
+			SupportDataLDonSSCArray:    flag(ops2, 22),
+			MPIO:                       flag(ops2, 23),
+			SupportConfigAutoBalance:   flag(ops2, 24),
+			ActivePassive:              uint8(BitField(ops2, 25, 2)),
+		},
+		AdapterOperations3: AdapterOperations3{
+			SupportPersonalityChange:         uint8(BitField(ops3, 0, 2)),
+			SupportThermalPollInterval:       flag(ops3, 2),
+			SupportDisableImmediateIO:        flag(ops3, 3),
+			SupportT10RebuildAssist:          flag(ops3, 4),
+			SupportMaxExtLDs:                 flag(ops3, 5),
+			SupportCrashDump:                 flag(ops3, 6),
+			SupportSwZone:                    flag(ops3, 7),
+			SupportDebugQueue:                flag(ops3, 8),
+			SupportNVCacheErase:              flag(ops3, 9),
+			SupportForceTo512e:               flag(ops3, 10),
+			SupportHOQRebuild:                flag(ops3, 11),
+			SupportAllowedOpsforDrvRemoval:   flag(ops3, 12),
+			SupportDrvActivityLEDSetting:     flag(ops3, 13),
+			SupportNVDRAM:                    flag(ops3, 14),
+			SupportForceFlash:                flag(ops3, 15),
+			SupportDisableSESMonitoring:      flag(ops3, 16),
+			SupportCacheBypassModes:          flag(ops3, 17),
+			SupportSecurityonJBOD:            flag(ops3, 18),
+			DiscardCacheDuringLDDelete:       flag(ops3, 19),
+			SupportTTYLogCompression:         flag(ops3, 20),
+			SupportCPLDUpdate:                flag(ops3, 21),
+			SupportDiskCacheSettingForSysPDs: flag(ops3, 22),
+			SupportExtendedSSCSize:           flag(ops3, 23),
+			UseSeqNumJbodFP:                  flag(ops3, 24),
+		},
+		AdapterOperations4: AdapterOperations4{
+			CtrlInfoExtSupported:         flag(ops4, 0),
+			SupportIbuttonLess:           flag(ops4, 1),
+			SupportedEncAlgo:             flag(ops4, 2),
+			SupportEncryptedMfc:          flag(ops4, 3),
+			ImageUploadSupported:         flag(ops4, 4),
+			SupportSesCtrlInMultipathcfg: flag(ops4, 5),
+			SupportPdMapTargetId:         flag(ops4, 6),
+			FwSwapsBbuVpdInfo:            flag(ops4, 7),
+			SupportSscRev3:               flag(ops4, 8),
+			SupportDualFwUpdate:          flag(ops4, 9),
+			SupportHostInfo:              flag(ops4, 10),
+			SupportFlashCompInfo:         flag(ops4, 11),
+			SupportPlDebugInfo:           flag(ops4, 12),
+			SupportNvmePassthru:          flag(ops4, 13),
+		},
+		AdapterOperations5: AdapterOperations5{
+			MrConfigExt2Supported:         flag(ops5, 0),
+			SupportProfileChange:          uint8(BitField(ops5, 1, 2)),
+			SupportCvhealthInfo:           flag(ops5, 3),
+			SupportPcie:                   flag(ops5, 4),
+			SupportExtMfgVpd:              flag(ops5, 5),
+			SupportOceOnly:                flag(ops5, 6),
+			SupportNvmeTm:                 flag(ops5, 7),
+			SupportSnapDump:               flag(ops5, 8),
+			SupportFdeTypeMix:             flag(ops5, 9),
+			SupportForcePersonalityChange: flag(ops5, 10),
+			SupportPsocUpdate:             flag(ops5, 11),
+			SupportPciLaneMargining:       flag(ops5, 12),
+		},
+		LdOperations: LdOperations{
+			ReadPolicy:      flag(ctrl.LdOperations.Bits, 0),
+			WritePolicy:     flag(ctrl.LdOperations.Bits, 1),
+			IoPolicy:        flag(ctrl.LdOperations.Bits, 2),
+			AccessPolicy:    flag(ctrl.LdOperations.Bits, 3),
+			DiskCachePolicy: flag(ctrl.LdOperations.Bits, 4),
+		},
+		PdOperations: PdOperations{
+			ForceOnline:  flag(ctrl.PdOperations.Bits, 0),
+			ForceOffline: flag(ctrl.PdOperations.Bits, 1),
+			ForceRebuild: flag(ctrl.PdOperations.Bits, 2),
+		},
+		PdMixSupport: PdMixSupport{
+			SAS:                flag(ctrl.PdMixSupport.Bits, 0),
+			SATA:               flag(ctrl.PdMixSupport.Bits, 1),
+			AllowMixInEncl:     flag(ctrl.PdMixSupport.Bits, 2),
+			AllowMixInLd:       flag(ctrl.PdMixSupport.Bits, 3),
+			AllowSataInCluster: flag(ctrl.PdMixSupport.Bits, 4),
+		},
+
+		JbodEnabled:  ctrl.JbodEnabled(),
+		LockKeyBound: ctrl.LockKeyBinding != 0,
+		Firmware:     ctrl.firmwareInventory(),
+	}
+
+	return info
+}
+
+func (m *MegasasIoctl) getCtrlInfo(ctx context.Context, instance *Instance) (*megasas_ctrl_info, error) {
+	instance.Buf = make([]byte, unsafe.Sizeof(megasas_ctrl_info{}))
+	instance.Cmd.OpCode = MR_DCMD_CTRL_GET_INFO
+	instance.Dcmd.MboxB = [12]uint8{}
+	instance.Dcmd.MboxB[0] = 1
+	if err := m.MFI_READ(ctx, instance); err != nil {
+		return nil, err
+	}
+
+	data := &megasas_ctrl_info{}
+	if err := binary.Read(bytes.NewBuffer(instance.Buf), binary.LittleEndian, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// MegasasGetControllerInfo 读取并解码控制器信息
+func (m *MegasasIoctl) MegasasGetControllerInfo(ctx context.Context, instance *Instance) (*ControllerInfo, error) {
+	data, err := m.getCtrlInfo(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	info := data.Decode()
+	info.HostNo = instance.HostNo
+	return info, nil
+}
@@ -0,0 +1,151 @@
+package megaraid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// EventCursor 是一个控制器事件日志的读取位置, 保存在 Checkpoint 中, 重启后用 ResumeEventReader 继续读取
+type EventCursor struct {
+	Next        uint32 // 下一条要处理的事件序号
+	ClearSeqNum uint32 // 保存时事件日志的 ClearSeqNum, 变化说明之后日志被清除过
+}
+
+// EventGap 表示有事件在读取之前已经不在日志里, 读取从 Resumed 继续
+type EventGap struct {
+	Reason   string // cleared: 日志被清除; wrapped: 日志写满后覆盖了旧事件; reset: 序号比最新的事件还大, 例如换了控制器
+	Expected uint32
+	Resumed  uint32
+}
+
+func (g *EventGap) Error() string {
+	return fmt.Sprintf("event log %s: expected seq %d, resumed at %d", g.Reason, g.Expected, g.Resumed)
+}
+
+// sync 按事件日志的序号范围调整 Next, 返回跳过的范围
+func (r *EventReader) sync(info *MR_EVT_LOG_INFO) *EventGap {
+	expected := r.Next
+	var reason string
+	switch {
+	case r.clearKnown && info.ClearSeqNum != r.ClearSeqNum && r.Next < info.ClearSeqNum:
+		// 从 clear 事件本身开始读取, 让下游知道日志被清除过
+		reason, r.Next = "cleared", max(info.ClearSeqNum, info.OldestSeqNum)
+	case r.Next < info.OldestSeqNum:
+		reason, r.Next = "wrapped", info.OldestSeqNum
+	case r.Next > info.NewestSeqNum+1:
+		// 无法判断哪些事件已经处理过, 只读取之后的新事件, 避免重复告警
+		reason, r.Next = "reset", info.NewestSeqNum+1
+	}
+	r.ClearSeqNum, r.clearKnown = info.ClearSeqNum, true
+	if reason == "" {
+		return nil
+	}
+	return &EventGap{Reason: reason, Expected: expected, Resumed: r.Next}
+}
+
+// Cursor 返回当前的读取位置, 应在 Read 返回的事件都处理完后保存
+func (r *EventReader) Cursor() EventCursor {
+	return EventCursor{Next: r.Next, ClearSeqNum: r.ClearSeqNum}
+}
+
+// Seek 回到 cursor 的位置, 例如 Read 返回的事件没有处理成功时回到 Read 之前的 Cursor, 下次 Read 重新读取
+func (r *EventReader) Seek(cursor EventCursor) {
+	r.Next, r.ClearSeqNum, r.clearKnown = cursor.Next, cursor.ClearSeqNum, true
+}
+
+// Checkpoint 把多个控制器的 EventCursor 保存在一个 JSON 文件中. 每次 Save 都先写临时文件并 fsync,
+// 再 rename 覆盖, 掉电时文件要么是旧内容要么是新内容
+type Checkpoint struct {
+	path string
+
+	mu      sync.Mutex
+	cursors map[string]EventCursor
+}
+
+// OpenCheckpoint 读取 path, 文件不存在时为空
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, cursors: make(map[string]EventCursor)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.cursors); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Get 返回 key 的读取位置, key 一般为控制器序列号, 不随 host 号变化
+func (c *Checkpoint) Get(key string) (EventCursor, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cursor, ok := c.cursors[key]
+	return cursor, ok
+}
+
+// Save 更新 key 的读取位置并写入文件
+func (c *Checkpoint) Save(key string, cursor EventCursor) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, ok := c.cursors[key]
+	if ok && old == cursor {
+		return nil
+	}
+	c.cursors[key] = cursor
+	if err := c.write(); err != nil {
+		// 保持与文件一致, 下次 Save 重试
+		if ok {
+			c.cursors[key] = old
+		} else {
+			delete(c.cursors, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Checkpoint) write() error {
+	data, err := json.MarshalIndent(c.cursors, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(c.path)
+	f, err := os.CreateTemp(dir, filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+
+	// rename 之后 fsync 目录, 保证新的目录项落盘
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
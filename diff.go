@@ -0,0 +1,287 @@
+package megaraid
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ChangeType 是两次快照之间的变化类型
+type ChangeType uint8
+
+const (
+	ChangeControllerAdded ChangeType = iota + 1
+	ChangeControllerRemoved
+	ChangePdInserted
+	ChangePdRemoved
+	ChangePdState           // Old/New 为 GetFwState
+	ChangePredictiveFailure // Old/New 为 PredictiveFailures 计数
+	ChangeErrorCount        // Property 为 MediaErrors、OtherErrors 或 MemUncorrectableErrors
+	ChangeLdCreated
+	ChangeLdDeleted
+	ChangeLdState // Old/New 为 LD_INFO.GetState
+	ChangeFirmware
+	ChangeProperty
+	ChangeHotSpareAdded
+	ChangeHotSpareRemoved
+)
+
+var changeTypeNames = map[ChangeType]string{
+	ChangeControllerAdded:   "ControllerAdded",
+	ChangeControllerRemoved: "ControllerRemoved",
+	ChangePdInserted:        "PdInserted",
+	ChangePdRemoved:         "PdRemoved",
+	ChangePdState:           "PdState",
+	ChangePredictiveFailure: "PredictiveFailure",
+	ChangeErrorCount:        "ErrorCount",
+	ChangeLdCreated:         "LdCreated",
+	ChangeLdDeleted:         "LdDeleted",
+	ChangeLdState:           "LdState",
+	ChangeFirmware:          "Firmware",
+	ChangeProperty:          "Property",
+	ChangeHotSpareAdded:     "HotSpareAdded",
+	ChangeHotSpareRemoved:   "HotSpareRemoved",
+}
+
+func (t ChangeType) String() string {
+	if name, ok := changeTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ChangeType(%d)", uint8(t))
+}
+
+func (t ChangeType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *ChangeType) UnmarshalText(text []byte) error {
+	for k, v := range changeTypeNames {
+		if v == string(text) {
+			*t = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown change type %q", text)
+}
+
+// Change 是一次变化. Pd/Ld 指向新快照中的对象, 对象被移除时指向旧快照中的对象
+type Change struct {
+	Type     ChangeType
+	HostNo   uint16
+	Object   string // 例如 controller、pd 32:1、ld 0
+	Property string
+	Old      string
+	New      string
+	Pd       *PdSnapshot `json:",omitempty"`
+	Ld       *LdSnapshot `json:",omitempty"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("host %d %s %s", c.HostNo, c.Object, c.Type)
+	if c.Property != "" {
+		s += " " + c.Property
+	}
+	if c.Old != "" || c.New != "" {
+		s += fmt.Sprintf(": %s -> %s", c.Old, c.New)
+	}
+	return s
+}
+
+// PdKey 是跨快照识别物理盘的 key, 优先用 WWN, 其次序列号, 都没有时用 deviceId.
+// 按 key 匹配时, 换槽位的盘不会被当成拔出再插入
+func (pd *PdSnapshot) PdKey() string {
+	switch {
+	case pd.WWN != "":
+		return "wwn:" + pd.WWN
+	case pd.Serial != "":
+		return "serial:" + pd.Serial
+	}
+	return "did:" + strconv.Itoa(int(pd.DeviceId))
+}
+
+// Name 是物理盘在日志里的名字, 与 storcli 的 eid:slot 一致
+func (pd *PdSnapshot) Name() string {
+	return fmt.Sprintf("pd %d:%d", pd.EnclDeviceId, pd.Slot)
+}
+
+// Diff 比较两次快照, 返回按控制器、物理盘、逻辑盘顺序排列的变化. 控制器按 HostNo 匹配,
+// 物理盘按 PdKey 匹配, 逻辑盘按 TargetId 匹配. 计数只报告增长, 计数被清零不算变化
+func Diff(old, new *Snapshot) []Change {
+	var changes []Change
+	for i := range new.Controllers {
+		n := &new.Controllers[i]
+		o := old.Controller(n.HostNo)
+		if o == nil {
+			changes = append(changes, Change{Type: ChangeControllerAdded, HostNo: n.HostNo, Object: "controller"})
+			continue
+		}
+		changes = append(changes, diffController(o, n)...)
+	}
+	for i := range old.Controllers {
+		o := &old.Controllers[i]
+		if new.Controller(o.HostNo) == nil {
+			changes = append(changes, Change{Type: ChangeControllerRemoved, HostNo: o.HostNo, Object: "controller"})
+		}
+	}
+	return changes
+}
+
+func diffController(o, n *ControllerSnapshot) []Change {
+	var changes []Change
+	add := func(c Change) {
+		c.HostNo = n.HostNo
+		changes = append(changes, c)
+	}
+	property := func(object, name, old, new string) {
+		if old != new {
+			add(Change{Type: ChangeProperty, Object: object, Property: name, Old: old, New: new})
+		}
+	}
+	counter := func(t ChangeType, object, name string, old, new uint64, pd *PdSnapshot) {
+		if new > old {
+			add(Change{Type: t, Object: object, Property: name, Old: strconv.FormatUint(old, 10), New: strconv.FormatUint(new, 10), Pd: pd})
+		}
+	}
+
+	// 控制器信息读取失败时不比较, 否则会把失败当成全部盘被拔出
+	if o.Info == nil || n.Info == nil {
+		return nil
+	}
+	if of, nf := firmwareVersion(o.Info), firmwareVersion(n.Info); of != nf {
+		add(Change{Type: ChangeFirmware, Object: "controller", Old: of, New: nf})
+	}
+	counter(ChangeErrorCount, "controller", "MemUncorrectableErrors", uint64(o.Info.MemUncorrectableErrorCount), uint64(n.Info.MemUncorrectableErrorCount), nil)
+	if o.Bbu != nil && n.Bbu != nil {
+		property("bbu", "Healthy", strconv.FormatBool(o.Bbu.Healthy), strconv.FormatBool(n.Bbu.Healthy))
+	} else if (o.Bbu == nil) != (n.Bbu == nil) {
+		property("bbu", "Present", strconv.FormatBool(o.Bbu != nil), strconv.FormatBool(n.Bbu != nil))
+	}
+
+	oldPds := make(map[string]*PdSnapshot)
+	for i := range o.Pds {
+		oldPds[o.Pds[i].PdKey()] = &o.Pds[i]
+	}
+	seen := make(map[string]bool)
+	for i := range n.Pds {
+		np := &n.Pds[i]
+		key := np.PdKey()
+		seen[key] = true
+		op, ok := oldPds[key]
+		if !ok {
+			// 上次读取失败的盘不在旧快照里, 不能当成新插入
+			if !o.failed("pd list") && !o.failed(fmt.Sprintf("pd %d", np.DeviceId)) {
+				add(Change{Type: ChangePdInserted, Object: np.Name(), New: np.State, Pd: np})
+			}
+			continue
+		}
+		if op.State != np.State {
+			add(Change{Type: ChangePdState, Object: np.Name(), Old: op.State, New: np.State, Pd: np})
+		}
+		counter(ChangePredictiveFailure, np.Name(), "PredictiveFailures", uint64(op.Health.PredictiveFailures), uint64(np.Health.PredictiveFailures), np)
+		counter(ChangeErrorCount, np.Name(), "MediaErrors", uint64(op.Health.MediaErrors), uint64(np.Health.MediaErrors), np)
+		counter(ChangeErrorCount, np.Name(), "OtherErrors", uint64(op.Health.OtherErrors), uint64(np.Health.OtherErrors), np)
+		if op.Firmware != np.Firmware {
+			add(Change{Type: ChangeFirmware, Object: np.Name(), Old: op.Firmware, New: np.Firmware, Pd: np})
+		}
+		property(np.Name(), "Location", op.Name(), np.Name())
+		property(np.Name(), "Foreign", strconv.FormatBool(op.Foreign), strconv.FormatBool(np.Foreign))
+		property(np.Name(), "Locked", strconv.FormatBool(op.Security.Locked), strconv.FormatBool(np.Security.Locked))
+	}
+	for i := range o.Pds {
+		op := &o.Pds[i]
+		// 读取失败的盘不在新快照里, 不能当成被拔出
+		if n.failed("pd list") || n.failed(fmt.Sprintf("pd %d", op.DeviceId)) {
+			continue
+		}
+		if !seen[op.PdKey()] {
+			add(Change{Type: ChangePdRemoved, Object: op.Name(), Old: op.State, Pd: op})
+		}
+	}
+
+	// 没有 RAID 配置时逻辑盘属性和热备盘都是空的, 不比较
+	cfgOK := !o.failed("config") && !n.failed("config")
+
+	oldLds := make(map[uint8]*LdSnapshot)
+	for i := range o.Lds {
+		oldLds[o.Lds[i].TargetId] = &o.Lds[i]
+	}
+	newLds := make(map[uint8]bool)
+	for i := range n.Lds {
+		nl := &n.Lds[i]
+		name := fmt.Sprintf("ld %d", nl.TargetId)
+		newLds[nl.TargetId] = true
+		ol, ok := oldLds[nl.TargetId]
+		if !ok {
+			if !o.failed("ld list") {
+				add(Change{Type: ChangeLdCreated, Object: name, New: nl.State, Ld: nl})
+			}
+			continue
+		}
+		if ol.State != nl.State {
+			add(Change{Type: ChangeLdState, Object: name, Old: ol.State, New: nl.State, Ld: nl})
+		}
+		if !cfgOK {
+			continue
+		}
+		for _, p := range []struct {
+			name     string
+			old, new any
+		}{
+			{"Name", ol.Name, nl.Name},
+			{"RaidLevel", ol.RaidLevel, nl.RaidLevel},
+			{"SizeBytes", ol.SizeBytes, nl.SizeBytes},
+			{"DefaultCachePolicy", ol.DefaultCachePolicy, nl.DefaultCachePolicy},
+			{"CurrentCachePolicy", ol.CurrentCachePolicy, nl.CurrentCachePolicy},
+			{"DiskCachePolicy", ol.DiskCachePolicy, nl.DiskCachePolicy},
+			{"AccessPolicy", ol.AccessPolicy, nl.AccessPolicy},
+		} {
+			if p.old != p.new {
+				add(Change{Type: ChangeProperty, Object: name, Property: p.name, Old: fmt.Sprint(p.old), New: fmt.Sprint(p.new), Ld: nl})
+			}
+		}
+	}
+	for i := range o.Lds {
+		ol := &o.Lds[i]
+		if !newLds[ol.TargetId] && !n.failed("ld list") {
+			add(Change{Type: ChangeLdDeleted, Object: fmt.Sprintf("ld %d", ol.TargetId), Old: ol.State, Ld: ol})
+		}
+	}
+
+	if !cfgOK {
+		return changes
+	}
+	oldSpares := make(map[uint16]bool)
+	for _, s := range o.HotSpares {
+		oldSpares[s.DeviceId] = true
+	}
+	newSpares := make(map[uint16]bool)
+	for _, s := range n.HotSpares {
+		newSpares[s.DeviceId] = true
+		if !oldSpares[s.DeviceId] {
+			add(Change{Type: ChangeHotSpareAdded, Object: fmt.Sprintf("pd did %d", s.DeviceId)})
+		}
+	}
+	for _, s := range o.HotSpares {
+		if !newSpares[s.DeviceId] {
+			add(Change{Type: ChangeHotSpareRemoved, Object: fmt.Sprintf("pd did %d", s.DeviceId)})
+		}
+	}
+	return changes
+}
+
+func firmwareVersion(info *ControllerInfo) string {
+	if info.Firmware == nil {
+		return ""
+	}
+	return info.Firmware.PackageVersion
+}
+
+// failed 表示快照中 what 读取失败, what 与 Errors 中冒号前的部分一致
+func (c *ControllerSnapshot) failed(what string) bool {
+	for _, e := range c.Errors {
+		if strings.HasPrefix(e, what+": ") {
+			return true
+		}
+	}
+	return false
+}
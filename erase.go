@@ -0,0 +1,339 @@
+package megaraid
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EraseMethod 是擦除方式
+type EraseMethod int
+
+const (
+	// 固件 PD clear, simple/normal/thorough 对应 1/3/9 遍, 与 storcli 的 erase simple/normal/thorough 遍数一致
+	EraseSimple EraseMethod = iota
+	EraseNormal
+	EraseThorough
+	// SANITIZE CRYPTOGRAPHIC ERASE, 只用于 SED(fdeCapable)
+	EraseCrypto
+	// SANITIZE BLOCK ERASE, 一般用于 SSD
+	EraseSanitizeBlock
+	// SANITIZE OVERWRITE, 写一遍 0
+	EraseSanitizeOverwrite
+)
+
+func (e EraseMethod) String() string {
+	switch e {
+	case EraseSimple:
+		return "simple"
+	case EraseNormal:
+		return "normal"
+	case EraseThorough:
+		return "thorough"
+	case EraseCrypto:
+		return "crypto"
+	case EraseSanitizeBlock:
+		return "sanitize-block"
+	case EraseSanitizeOverwrite:
+		return "sanitize-overwrite"
+	}
+	return fmt.Sprintf("erase(%d)", int(e))
+}
+
+func (e EraseMethod) passes() int {
+	switch e {
+	case EraseNormal:
+		return 3
+	case EraseThorough:
+		return 9
+	}
+	return 1
+}
+
+// ErrNotErasable 表示物理盘当前状态不允许擦除
+var ErrNotErasable = errors.New("pd is not erasable")
+
+// ErasureRecord 是擦除证明, 记录被擦除的盘和擦除过程
+type ErasureRecord struct {
+	HostNo       uint16
+	DeviceId     uint16
+	EnclDeviceId uint16
+	SlotNumber   uint8
+	Vendor       string
+	Product      string
+	SerialNumber string
+	WWN          string
+	Method       string
+	Passes       int
+	Started      time.Time
+	Finished     time.Time
+	Completed    bool // 只有固件确认每一遍 clear 完成、或 SANITIZE 以 NO SENSE 结束时为 true
+}
+
+// CheckErasable 检查物理盘是否可以擦除: 必须是 Unconfigured Good, 且不属于任何逻辑盘、array 或热备
+func CheckErasable(pdInfo *MR_PD_INFO, cfg *Config) error {
+	if uint8(pdInfo.FwState) != MR_PD_STATE_UNCONFIGURED_GOOD {
+		return fmt.Errorf("%w: pd %d state is %s", ErrNotErasable, pdInfo.Ref.DeviceId, pdInfo.GetFwState())
+	}
+	if pdInfo.InVD() {
+		return fmt.Errorf("%w: pd %d is in a virtual drive", ErrNotErasable, pdInfo.Ref.DeviceId)
+	}
+	if cfg != nil {
+		if ref, ok := cfg.ArrayOf(pdInfo.Ref.DeviceId); ok {
+			return fmt.Errorf("%w: pd %d is a member of array %d", ErrNotErasable, pdInfo.Ref.DeviceId, ref)
+		}
+		for i := range cfg.Spares {
+			if cfg.Spares[i].Ref.DeviceId == pdInfo.Ref.DeviceId {
+				return fmt.Errorf("%w: pd %d is a hot spare", ErrNotErasable, pdInfo.Ref.DeviceId)
+			}
+		}
+	}
+	return nil
+}
+
+// EraseDrive 擦除一块 Unconfigured Good 的物理盘, 阻塞直到完成, 每次轮询把总进度(0-100)传给 progress。
+// 擦除前会重新检查盘的状态和 RAID 配置, 不满足条件时返回 ErrNotErasable.
+// 每条命令单独持有 host 的锁, 轮询的间隔中其他 goroutine 可以继续使用这个控制器
+func (c *Controller) EraseDrive(ctx context.Context, deviceId uint16, method EraseMethod, poll time.Duration, progress func(percent int)) (*ErasureRecord, error) {
+	if poll <= 0 {
+		poll = 10 * time.Second
+	}
+	if progress == nil {
+		progress = func(int) {}
+	}
+
+	var pdInfo *MR_PD_INFO
+	err := c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		info, err := m.MegasasGetPdInfo(ctx, instance, &ScsiDevice{DeviceId: deviceId})
+		if err != nil {
+			return err
+		}
+		cfg, err := m.MegasasGetConfig(ctx, instance)
+		if err != nil {
+			return err
+		}
+		pdInfo = info
+		return CheckErasable(pdInfo, cfg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if method == EraseCrypto && !pdInfo.GetSecurity().FdeCapable {
+		return nil, fmt.Errorf("%w: pd %d is not a self-encrypting drive", ErrNotErasable, deviceId)
+	}
+
+	record := &ErasureRecord{
+		HostNo:       c.hostNo,
+		DeviceId:     deviceId,
+		EnclDeviceId: pdInfo.EnclDeviceId,
+		SlotNumber:   pdInfo.SlotNumber,
+		WWN:          pdInfo.GetWWN(),
+		Method:       method.String(),
+		Passes:       method.passes(),
+		Started:      time.Now(),
+	}
+	if inq, err := pdInfo.GetInquiryData(); err == nil {
+		record.Vendor, record.Product, record.SerialNumber = inq.VendorIdentification, inq.ProductIdentification, inq.SerialNumber
+	}
+
+	switch method {
+	case EraseSimple, EraseNormal, EraseThorough:
+		for pass := 0; pass < record.Passes; pass++ {
+			if err := c.pdClear(ctx, pdInfo, poll, func(percent int) {
+				progress((pass*100 + percent) / record.Passes)
+			}); err != nil {
+				return record, fmt.Errorf("clear pass %d/%d: %w", pass+1, record.Passes, err)
+			}
+		}
+	case EraseCrypto, EraseSanitizeBlock, EraseSanitizeOverwrite:
+		if err := c.sanitize(ctx, deviceId, method, poll, progress); err != nil {
+			return record, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported erase method %d", method)
+	}
+
+	progress(100)
+	record.Finished = time.Now()
+	record.Completed = true
+	return record, nil
+}
+
+// AbortErase 中止固件 PD clear, SANITIZE 一旦开始无法中止
+func (c *Controller) AbortErase(ctx context.Context, deviceId uint16) error {
+	return c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		pdInfo, err := m.MegasasGetPdInfo(ctx, instance, &ScsiDevice{DeviceId: deviceId})
+		if err != nil {
+			return err
+		}
+		return m.pdRefDcmd(ctx, instance, MR_DCMD_PD_CLEAR_ABORT, pdInfo)
+	})
+}
+
+// errNoClearResult 表示事件日志中还没有 clear 结束的事件
+var errNoClearResult = errors.New("no clear result in the event log")
+
+// pdClear 执行一遍固件 clear, 通过 MR_PD_INFO.ProgInfo 轮询进度. 进度结束后从 clear 开始之后的事件日志中
+// 确认 clear 已完成, 被中止或失败时返回错误. 固件可能在进度结束稍后才记录事件, 最多再等 3 个 poll
+func (c *Controller) pdClear(ctx context.Context, pdInfo *MR_PD_INFO, poll time.Duration, progress func(int)) error {
+	var seq uint32
+	err := c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		logInfo, err := m.MegasasGetEventLogInfo(ctx, instance)
+		if err != nil {
+			return err
+		}
+		seq = logInfo.NewestSeqNum + 1
+		return m.pdRefDcmd(ctx, instance, MR_DCMD_PD_CLEAR_START, pdInfo)
+	})
+	if err != nil {
+		return err
+	}
+
+	sdev := &ScsiDevice{DeviceId: pdInfo.Ref.DeviceId}
+	for {
+		if err := sleep(ctx, poll); err != nil {
+			return err
+		}
+		info, err := c.GetPdInfo(ctx, sdev)
+		if err != nil {
+			return err
+		}
+		if info.ProgInfo.Active[0]&MR_PD_PROGRESS_CLEAR == 0 {
+			break
+		}
+		progress(info.ProgInfo.Clear.Percent())
+	}
+
+	for retry := 0; ; retry++ {
+		var events []Event
+		err := c.Do(ctx, func(m *MegasasIoctl, instance *Instance) (err error) {
+			events, err = m.eventsSince(ctx, instance, seq)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("read clear result: %w", err)
+		}
+		err = ClearResult(events, pdInfo.Ref.DeviceId)
+		if !errors.Is(err, errNoClearResult) || retry == 3 {
+			return err
+		}
+		if err := sleep(ctx, poll); err != nil {
+			return err
+		}
+	}
+}
+
+// eventsSince 读取序号从 seq 开始的所有事件
+func (m *MegasasIoctl) eventsSince(ctx context.Context, instance *Instance, seq uint32) ([]Event, error) {
+	var events []Event
+	for {
+		batch, err := m.MegasasGetEvents(ctx, instance, seq, AllEvents, eventBatch)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, batch...)
+		if len(batch) < eventBatch {
+			return events, nil
+		}
+		seq = batch[len(batch)-1].SeqNum + 1
+	}
+}
+
+// ClearResult 按 deviceId 最后一条 clear 结束的事件判断 PD clear 是否完成. 固件的事件描述为
+// "Clear completed on PD ...", "Clear aborted on PD ...", "Clear failed on PD ..." 等, 只有 completed
+// 且不是 completed with errors 才算完成. 没有 clear 结束的事件时不能确认擦除完成, 同样返回错误
+func ClearResult(events []Event, deviceId uint16) error {
+	err := fmt.Errorf("pd %d: %w", deviceId, errNoClearResult)
+	for i := range events {
+		e := &events[i]
+		if e.Pd == nil || e.Pd.DeviceId != deviceId {
+			continue
+		}
+		switch d := e.Description; {
+		case strings.HasPrefix(d, "Clear completed") && !strings.Contains(d, "with errors"):
+			err = nil
+		case strings.HasPrefix(d, "Clear completed"), strings.HasPrefix(d, "Clear aborted"), strings.HasPrefix(d, "Clear failed"):
+			err = fmt.Errorf("pd %d: %s", deviceId, d)
+		}
+	}
+	return err
+}
+
+// sanitize 以 IMMED 方式下发 SANITIZE, 然后用 REQUEST SENSE 的进度字段轮询
+func (c *Controller) sanitize(ctx context.Context, deviceId uint16, method EraseMethod, poll time.Duration, progress func(int)) error {
+	var action uint8
+	var param []byte
+	switch method {
+	case EraseCrypto:
+		action = SANITIZE_CRYPTO_ERASE
+	case EraseSanitizeBlock:
+		action = SANITIZE_BLOCK_ERASE
+	case EraseSanitizeOverwrite:
+		action = SANITIZE_OVERWRITE
+		// 参数列表: overwrite count 1, 4 字节全 0 的 pattern
+		param = []byte{0x01, 0, 0, 4, 0, 0, 0, 0}
+	}
+
+	dir := uint16(MFI_FRAME_DIR_NONE)
+	if len(param) > 0 {
+		dir = MFI_FRAME_DIR_WRITE
+	}
+	cdb := []byte{SCSI_SANITIZE, 0x80 | action, 0, 0, 0, 0, 0, uint8(len(param) >> 8), uint8(len(param)), 0}
+	err := c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		instance.Buf = param
+		return m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, cdb, dir)
+	})
+	if err != nil {
+		return fmt.Errorf("sanitize: %w", err)
+	}
+
+	for {
+		if err := sleep(ctx, poll); err != nil {
+			return err
+		}
+		var percent int
+		var inProgress bool
+		err := c.Do(ctx, func(m *MegasasIoctl, instance *Instance) (err error) {
+			instance.Buf = make([]byte, SCSI_SENSE_BUFFERSIZE)
+			if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, []byte{SCSI_REQUEST_SENSE, 0, 0, 0, uint8(len(instance.Buf)), 0}, MFI_FRAME_DIR_READ); err != nil {
+				return err
+			}
+			percent, inProgress, err = SanitizeProgress(instance.Buf)
+			return err
+		})
+		if err != nil || !inProgress {
+			return err
+		}
+		progress(percent)
+	}
+}
+
+// SanitizeProgress 从 REQUEST SENSE 返回的 sense data 判断 SANITIZE 的状态: NOT READY 04h/1Bh 为正在进行,
+// 返回完成的百分比; 没有 sense 或 sense key 为 NO SENSE 时已经完成. 其他 sense 说明 SANITIZE 失败或被拒绝,
+// 例如 MEDIUM ERROR 31h/03h (SANITIZE COMMAND FAILED), 返回 *ScsiSenseError
+func SanitizeProgress(sense []byte) (int, bool, error) {
+	if len(sense) == 0 {
+		return 100, false, nil
+	}
+	switch sense[0] & 0x7f {
+	case 0, 0x70, 0x71, 0x72, 0x73:
+	default:
+		return 0, false, fmt.Errorf("sanitize: invalid sense response code %#02x", sense[0])
+	}
+	key, asc, ascq := ParseSense(sense)
+	if key == 0 {
+		return 100, false, nil
+	}
+	if key != 0x2 || asc != 0x04 || ascq != 0x1b {
+		return 0, false, fmt.Errorf("sanitize failed: %w", &ScsiSenseError{Sense: slices.Clone(sense)})
+	}
+	// fixed 格式 byte 15-17 是 sense-key specific 的 progress indication
+	if sense[0]&0x7f == 0x70 && len(sense) >= 18 && sense[15]&0x80 != 0 {
+		return int(binary.BigEndian.Uint16(sense[16:18])) * 100 / 65536, true, nil
+	}
+	return 0, true, nil
+}
@@ -0,0 +1,249 @@
+package megaraid
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// EventClass 是固件事件的级别, 值同 MR_EVT_CLASS_*
+type EventClass int8
+
+var eventClassNames = map[EventClass]string{
+	EventClass(MR_EVT_CLASS_DEBUG):    "debug",
+	EventClass(MR_EVT_CLASS_PROGRESS): "progress",
+	EventClass(MR_EVT_CLASS_INFO):     "info",
+	EventClass(MR_EVT_CLASS_WARNING):  "warning",
+	EventClass(MR_EVT_CLASS_CRITICAL): "critical",
+	EventClass(MR_EVT_CLASS_FATAL):    "fatal",
+	EventClass(MR_EVT_CLASS_DEAD):     "dead",
+}
+
+func (c EventClass) String() string {
+	if name, ok := eventClassNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventClass(%d)", int8(c))
+}
+
+// EventFilter 是事件的过滤条件, 只返回级别不低于 Class 且 locale 与 Locale 有交集的事件
+type EventFilter struct {
+	Class  EventClass
+	Locale uint16 // MR_EVT_LOCALE_*
+}
+
+// AllEvents 返回 info 及以上级别的所有事件
+var AllEvents = EventFilter{Class: EventClass(MR_EVT_CLASS_INFO), Locale: MR_EVT_LOCALE_ALL}
+
+// word 是 megasas_evt_class_locale 的 32 位表示
+func (f EventFilter) word() uint32 {
+	return uint32(f.Locale) | uint32(uint8(f.Class))<<24
+}
+
+// Event 是固件事件日志中的一条事件
+type Event struct {
+	SeqNum      uint32
+	Time        time.Time     // 控制器时间未设置时为零值, 见 SinceBoot
+	SinceBoot   time.Duration // 时间戳为开机后的秒数时有效
+	Code        uint32
+	Class       EventClass
+	Locale      uint16
+	Description string
+	Pd          *EventPd // 参数中有物理盘时不为 nil
+	Ld          *EventLd // 参数中有逻辑盘时不为 nil
+}
+
+type EventPd struct {
+	DeviceId  uint16
+	EnclIndex uint8
+	Slot      uint8
+}
+
+type EventLd struct {
+	TargetId uint16
+}
+
+// Object 是事件对象在日志里的名字, 与 Change.Object 的写法一致
+func (e *Event) Object() string {
+	switch {
+	case e.Pd != nil:
+		return fmt.Sprintf("pd did %d", e.Pd.DeviceId)
+	case e.Ld != nil:
+		return fmt.Sprintf("ld %d", e.Ld.TargetId)
+	}
+	return "controller"
+}
+
+// 固件时间戳的起点, 控制器时间由管理工具设置, 按 UTC 解释
+var eventEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newEvent(d *MR_EVT_DETAIL) Event {
+	e := Event{
+		SeqNum:      d.SeqNum,
+		Code:        d.Code,
+		Class:       EventClass(d.Class),
+		Locale:      d.Locale,
+		Description: trimString(d.Description[:]),
+	}
+	if d.TimeStamp&0xff000000 == 0xff000000 {
+		e.SinceBoot = time.Duration(d.TimeStamp&0x00ffffff) * time.Second
+	} else {
+		e.Time = eventEpoch.Add(time.Duration(d.TimeStamp) * time.Second)
+	}
+
+	switch d.ArgType {
+	case MR_EVT_ARGS_LD, MR_EVT_ARGS_LD_COUNT, MR_EVT_ARGS_LD_OWNER, MR_EVT_ARGS_LD_PROG, MR_EVT_ARGS_LD_STATE:
+		e.Ld = &EventLd{TargetId: binary.LittleEndian.Uint16(d.Args[0:])}
+	case MR_EVT_ARGS_PD, MR_EVT_ARGS_PD_ERR, MR_EVT_ARGS_PD_PROG, MR_EVT_ARGS_PD_STATE:
+		e.Pd = &EventPd{DeviceId: binary.LittleEndian.Uint16(d.Args[0:]), EnclIndex: d.Args[2], Slot: d.Args[3]}
+	}
+	return e
+}
+
+// MegasasGetEventLogInfo 读取事件日志的序号范围
+func (m *MegasasIoctl) MegasasGetEventLogInfo(ctx context.Context, instance *Instance) (*MR_EVT_LOG_INFO, error) {
+	instance.Buf = make([]byte, unsafe.Sizeof(MR_EVT_LOG_INFO{}))
+	instance.Cmd.OpCode = MR_DCMD_CTRL_EVENT_GET_INFO
+	instance.Dcmd.MboxB = [12]uint8{}
+	if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ); err != nil {
+		return nil, err
+	}
+
+	info := &MR_EVT_LOG_INFO{}
+	if err := binary.Read(bytes.NewBuffer(instance.Buf), binary.LittleEndian, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// MegasasGetEvents 读取序号从 seq 开始(含)、符合 filter 的最多 count 条事件, 没有更多事件时返回空
+func (m *MegasasIoctl) MegasasGetEvents(ctx context.Context, instance *Instance, seq uint32, filter EventFilter, count int) ([]Event, error) {
+	header := int(unsafe.Sizeof(MR_EVT_LIST_HEADER{}))
+	size := int(unsafe.Sizeof(MR_EVT_DETAIL{}))
+	instance.Buf = make([]byte, header+size*count)
+	instance.Cmd.OpCode = MR_DCMD_CTRL_EVENT_GET
+	instance.Dcmd.MboxB = [12]uint8{}
+	binary.LittleEndian.PutUint32(instance.Dcmd.MboxB[0:], seq)
+	binary.LittleEndian.PutUint32(instance.Dcmd.MboxB[4:], filter.word())
+	err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ)
+	if errors.Is(err, MfiStatus(MFI_STAT_NOT_FOUND)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseEventList(instance.Buf)
+}
+
+func parseEventList(buf []byte) ([]Event, error) {
+	r := bytes.NewReader(buf)
+	var header MR_EVT_LIST_HEADER
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	size := int(unsafe.Sizeof(MR_EVT_DETAIL{}))
+	if int(header.Count) > r.Len()/size {
+		return nil, fmt.Errorf("event list count %d exceeds buffer", header.Count)
+	}
+
+	events := make([]Event, 0, header.Count)
+	for i := 0; i < int(header.Count); i++ {
+		var d MR_EVT_DETAIL
+		if err := binary.Read(r, binary.LittleEndian, &d); err != nil {
+			return nil, err
+		}
+		events = append(events, newEvent(&d))
+	}
+	return events, nil
+}
+
+// eventBatch 是每条 MR_DCMD_CTRL_EVENT_GET 读取的事件数
+const eventBatch = 32
+
+// EventReader 按序号顺序读取一个控制器的事件日志
+type EventReader struct {
+	Filter      EventFilter
+	Next        uint32 // 下一次 Read 的起始序号
+	ClearSeqNum uint32 // 上次 Read 时事件日志的 ClearSeqNum
+
+	c          *Controller
+	clearKnown bool // ClearSeqNum 是否有效, 无效时第一次 Read 不检查日志是否被清除
+}
+
+// NewEventReader 返回从 next 开始读取的 EventReader
+func (c *Controller) NewEventReader(filter EventFilter, next uint32) *EventReader {
+	return &EventReader{Filter: filter, Next: next, c: c}
+}
+
+// ResumeEventReader 从 cursor 继续读取, cursor 为 nil 时从当前最新事件之后开始, 只读取新事件.
+// cursor 之后日志被清除或覆盖时, 第一次 Read 返回 *EventGap
+func (c *Controller) ResumeEventReader(ctx context.Context, filter EventFilter, cursor *EventCursor) (*EventReader, error) {
+	r := c.NewEventReader(filter, 0)
+	if cursor != nil {
+		r.Next, r.ClearSeqNum, r.clearKnown = cursor.Next, cursor.ClearSeqNum, true
+		return r, nil
+	}
+
+	err := c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		info, err := m.MegasasGetEventLogInfo(ctx, instance)
+		if err != nil {
+			return err
+		}
+		r.Next, r.ClearSeqNum, r.clearKnown = info.NewestSeqNum+1, info.ClearSeqNum, true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Read 读取 Next 之后的所有事件, 成功后 Next 为最后一条事件的序号加 1. 中途失败时返回已经读取的事件,
+// Next 同样指向它们之后, 下次 Read 从失败的位置继续.
+// Next 之后的事件已经被清除或覆盖时, 跳到仍在日志中的事件继续读取, 返回读到的事件和 *EventGap
+func (r *EventReader) Read(ctx context.Context) ([]Event, error) {
+	var gap *EventGap
+	err := r.c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		info, err := m.MegasasGetEventLogInfo(ctx, instance)
+		if err != nil {
+			return err
+		}
+		gap = r.sync(info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for {
+		var batch []Event
+		err := r.c.Do(ctx, func(m *MegasasIoctl, instance *Instance) (err error) {
+			batch, err = m.MegasasGetEvents(ctx, instance, r.Next, r.Filter, eventBatch)
+			return err
+		})
+		if err != nil {
+			return events, err
+		}
+		next := r.Next
+		for _, e := range batch {
+			// 固件返回的序号只会递增, 这里防止错误的返回让 Next 回退而重复读取
+			if e.SeqNum < r.Next {
+				continue
+			}
+			events = append(events, e)
+			r.Next = e.SeqNum + 1
+		}
+		if len(batch) < eventBatch || r.Next == next {
+			break
+		}
+	}
+	if gap != nil {
+		return events, gap
+	}
+	return events, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid/collector"
+	"github.com/ishmaelwanglin/megaraid/redfish"
+	"github.com/ishmaelwanglin/megaraid/storcli"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func main() {
+	listen := flag.String("web.listen-address", ":9914", "address to listen on for /metrics")
+	path := flag.String("web.telemetry-path", "/metrics", "path under which to expose metrics")
+	storcliCmd := flag.String("storcli", "", "storcli/perccli to use when the ioctl device cannot be opened, searched in PATH if empty")
+	textfileDir := flag.String("collector.textfile.directory", "", "write metrics once to megaraid.prom in this node_exporter textfile directory and exit")
+	timeout := flag.Duration("scrape.timeout", 30*time.Second, "give up a scrape when the controller does not answer within this duration, 0 waits forever")
+	enableRedfish := flag.Bool("web.redfish", false, "also serve the storage as Redfish resources under /redfish/v1/")
+	flag.Parse()
+
+	b, err := storcli.OpenBackend(*storcliCmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+
+	registry := prometheus.NewRegistry()
+	c := collector.New(b)
+	c.Timeout = *timeout
+	registry.MustRegister(c)
+
+	if *textfileDir != "" {
+		// WriteToTextfile 先写临时文件再 rename, node_exporter 不会读到写了一半的文件
+		if err := prometheus.WriteToTextfile(filepath.Join(*textfileDir, "megaraid.prom"), registry); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	http.Handle(*path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if *enableRedfish {
+		h := redfish.NewHandler(b)
+		http.Handle(redfish.Root, h)
+		http.Handle(redfish.Root+"/", h)
+	}
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
@@ -0,0 +1,357 @@
+package megaraid
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FirmwareComponent 是 flash 里的一个固件组件, 比如 APP、BIOS、PCLI、BCON、NVDATA
+type FirmwareComponent struct {
+	Name      string
+	Version   string
+	Numbers   []int // Version 中的数字, 比如 4.680.00-8527 -> [4 680 0 8527]
+	BuildDate string
+	BuildTime string
+	Built     time.Time // BuildDate/BuildTime 无法解析时为零值
+}
+
+// FirmwareInventory 是控制器上的固件清单, Pending 是已经刷进 flash 但要重启(reset adapter)才生效的组件
+type FirmwareInventory struct {
+	PackageVersion    string
+	DriverVersion     string
+	ExpanderFwVersion string
+	Components        []FirmwareComponent
+	Pending           []FirmwareComponent
+	// RebootRequired 为 true 表示有 pending 组件与当前运行的版本不同
+	RebootRequired bool
+}
+
+var versionNumberRe = regexp.MustCompile(`\d+`)
+
+// ParseVersionNumbers 取出版本字符串里的全部数字
+func ParseVersionNumbers(version string) []int {
+	var numbers []int
+	for _, s := range versionNumberRe.FindAllString(version, -1) {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+// CompareVersion 逐段比较两个版本, 返回 -1, 0, 1
+func CompareVersion(a, b string) int {
+	na, nb := ParseVersionNumbers(a), ParseVersionNumbers(b)
+	for i := 0; i < len(na) || i < len(nb); i++ {
+		var x, y int
+		if i < len(na) {
+			x = na[i]
+		}
+		if i < len(nb) {
+			y = nb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// 固件里的构建时间大多是 C 的 __DATE__ __TIME__ 格式, 也见过 mm/dd/yyyy
+var buildTimeLayouts = []string{
+	"Jan _2 2006 15:04:05",
+	"Jan _2 2006",
+	"01/02/2006 15:04:05",
+	"01/02/2006",
+	"01/02/06 15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// ParseBuildTime 解析固件组件的构建日期和时间, 失败返回零值
+func ParseBuildTime(date, clock string) time.Time {
+	// 有的组件时间里带时区或者干脆没有时间, 最后只按日期再试一次
+	for _, value := range []string{date + " " + clock, date} {
+		value = strings.Join(strings.Fields(value), " ")
+		for _, layout := range buildTimeLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func newFirmwareComponent(name, version, date, clock []byte) FirmwareComponent {
+	c := FirmwareComponent{
+		Name:      trimString(name),
+		Version:   trimString(version),
+		BuildDate: trimString(date),
+		BuildTime: trimString(clock),
+	}
+	c.Numbers = ParseVersionNumbers(c.Version)
+	c.Built = ParseBuildTime(c.BuildDate, c.BuildTime)
+	return c
+}
+
+func (ctrl *megasas_ctrl_info) firmwareInventory() *FirmwareInventory {
+	inv := &FirmwareInventory{
+		PackageVersion:    trimString(ctrl.PackageVersion[:]),
+		DriverVersion:     trimString(ctrl.DriverVersion[:]),
+		ExpanderFwVersion: trimString(ctrl.ExpanderFwVersion[:]),
+	}
+
+	running := make(map[string]string)
+	for i := 0; i < min(int(ctrl.ImageComponentCount), len(ctrl.ImageComponent)); i++ {
+		image := &ctrl.ImageComponent[i]
+		c := newFirmwareComponent(image.Name[:], image.Version[:], image.BuildDate[:], image.BuiltTime[:])
+		running[c.Name] = c.Version
+		inv.Components = append(inv.Components, c)
+	}
+
+	for i := 0; i < min(int(ctrl.PendingImageComponentCount), len(ctrl.PendingImageComponent)); i++ {
+		image := &ctrl.PendingImageComponent[i]
+		c := newFirmwareComponent(image.Name[:], image.Version[:], image.BuildDate[:], image.BuiltTime[:])
+		if version, ok := running[c.Name]; !ok || version != c.Version {
+			inv.RebootRequired = true
+		}
+		inv.Pending = append(inv.Pending, c)
+	}
+
+	return inv
+}
+
+// FirmwareInventory 读取控制器的固件清单, 包括等待重启生效的 pending 组件
+func (m *MegasasIoctl) FirmwareInventory(ctx context.Context, instance *Instance) (*FirmwareInventory, error) {
+	ctrl, err := m.getCtrlInfo(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	return ctrl.firmwareInventory(), nil
+}
+
+// FirmwareImagePciIds 找出镜像里所有 PCI Data Structure("PCIR")声明的 vendor/device id,
+// 控制器固件包里的 option ROM 组件都带有这个结构
+func FirmwareImagePciIds(image []byte) []PciInfo {
+	var ids []PciInfo
+	seen := make(map[PciInfo]bool)
+	for off := 0; off+8 <= len(image); {
+		i := bytes.Index(image[off:], []byte("PCIR"))
+		if i < 0 || off+i+8 > len(image) {
+			break
+		}
+		p := off + i
+		id := PciInfo{
+			VendorId: binary.LittleEndian.Uint16(image[p+4:]),
+			DeviceId: binary.LittleEndian.Uint16(image[p+6:]),
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		off = p + 4
+	}
+	return ids
+}
+
+// VerifyFirmwareImage 检查镜像是否适用于该控制器: 镜像里至少有一个 PCIR 结构与控制器的 vendor/device id 相同
+func VerifyFirmwareImage(image []byte, pci PciInfo) error {
+	if len(image) == 0 {
+		return fmt.Errorf("empty firmware image")
+	}
+	ids := FirmwareImagePciIds(image)
+	if len(ids) == 0 {
+		return fmt.Errorf("no PCI data structure found in firmware image")
+	}
+	for _, id := range ids {
+		if id.VendorId == pci.VendorId && id.DeviceId == pci.DeviceId {
+			return nil
+		}
+	}
+	return fmt.Errorf("firmware image is for %04x:%04x, controller is %04x:%04x",
+		ids[0].VendorId, ids[0].DeviceId, pci.VendorId, pci.DeviceId)
+}
+
+// FlashResult 是一次固件升级的结果, Inventory 是刷写后重新读取的固件清单, 新版本在 Inventory.Pending 中
+type FlashResult struct {
+	ImageSize int
+	DryRun    bool
+	Inventory *FirmwareInventory
+}
+
+// FlashControllerFirmware 升级控制器固件: 校验镜像 -> OPEN -> 分段 DOWNLOAD -> FLASH, 失败时 CLOSE 放弃;
+// dryRun 时只做校验, 不会向控制器写任何数据。新固件在控制器重启后生效
+func (m *MegasasIoctl) FlashControllerFirmware(ctx context.Context, instance *Instance, image []byte, dryRun bool) (*FlashResult, error) {
+	ctrl, err := m.getCtrlInfo(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	info := ctrl.Decode()
+	if err := VerifyFirmwareImage(image, info.Pci); err != nil {
+		return nil, err
+	}
+
+	result := &FlashResult{ImageSize: len(image), DryRun: dryRun}
+	if dryRun {
+		result.Inventory = info.Firmware
+		return result, nil
+	}
+
+	instance.Buf = nil
+	instance.Cmd.OpCode = MR_DCMD_FLASH_FW_OPEN
+	instance.Dcmd.MboxB = [12]uint8{}
+	binary.LittleEndian.PutUint32(instance.Dcmd.MboxB[:], uint32(len(image)))
+	if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_NONE); err != nil {
+		return nil, fmt.Errorf("flash open: %w", err)
+	}
+
+	if err := m.flashDownload(ctx, instance, image); err != nil {
+		instance.Buf = nil
+		instance.Cmd.OpCode = MR_DCMD_FLASH_FW_CLOSE
+		instance.Dcmd.MboxB = [12]uint8{}
+		m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_NONE)
+		return nil, err
+	}
+
+	if result.Inventory, err = m.FirmwareInventory(ctx, instance); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *MegasasIoctl) flashDownload(ctx context.Context, instance *Instance, image []byte) error {
+	for off := 0; off < len(image); off += FLASH_BUF_SIZE {
+		instance.Buf = image[off:min(off+FLASH_BUF_SIZE, len(image))]
+		instance.Cmd.OpCode = MR_DCMD_FLASH_FW_DOWNLOAD
+		instance.Dcmd.MboxB = [12]uint8{}
+		binary.LittleEndian.PutUint32(instance.Dcmd.MboxB[:], uint32(off))
+		if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_WRITE); err != nil {
+			return fmt.Errorf("flash download at offset %d: %w", off, err)
+		}
+	}
+
+	// FLASH 命令需要一个 4 字节的数据缓冲区
+	instance.Buf = make([]byte, 4)
+	instance.Cmd.OpCode = MR_DCMD_FLASH_FW_FLASH
+	instance.Dcmd.MboxB = [12]uint8{}
+	if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ); err != nil {
+		return fmt.Errorf("flash: %w", err)
+	}
+	return nil
+}
+
+// DriveFirmwareResult 是一次硬盘固件升级的结果
+type DriveFirmwareResult struct {
+	DeviceId    uint16
+	Mode        uint8
+	OldRevision string
+	NewRevision string
+	// Activated 为 true 表示重新读取到的 inquiry FirmwareRevision 已经变化
+	Activated bool
+}
+
+// writeBufferCdb 构造 WRITE BUFFER(10), offset 和 length 都是 24 位
+func writeBufferCdb(mode uint8, offset, length int) []byte {
+	return []byte{
+		SCSI_WRITE_BUFFER, mode & 0x1f, 0,
+		uint8(offset >> 16), uint8(offset >> 8), uint8(offset),
+		uint8(length >> 16), uint8(length >> 8), uint8(length),
+		0,
+	}
+}
+
+// DownloadDriveFirmware 通过 PD pass-through 用 WRITE BUFFER 给物理盘升级固件,
+// mode 支持 WRITE_BUFFER_MODE_DOWNLOAD_SAVE(5)、WRITE_BUFFER_MODE_OFFSETS_SAVE(7) 和
+// WRITE_BUFFER_MODE_OFFSETS_SAVE_DEFER(0xE), 0xE 下载完成后会再发送 mode 0xF 激活。
+// 完成后重新读取 MR_PD_INFO 的 inquiry 数据确认 FirmwareRevision 是否变化
+func (m *MegasasIoctl) DownloadDriveFirmware(ctx context.Context, instance *Instance, deviceId uint16, image []byte, mode uint8) (*DriveFirmwareResult, error) {
+	if len(image) == 0 || len(image) >= 1<<24 {
+		return nil, fmt.Errorf("invalid drive firmware image size %d", len(image))
+	}
+
+	sdev := ScsiDevice{DeviceId: deviceId}
+	before, err := m.pdFirmwareRevision(ctx, instance, &sdev)
+	if err != nil {
+		return nil, err
+	}
+	result := &DriveFirmwareResult{DeviceId: deviceId, Mode: mode, OldRevision: before}
+
+	switch mode {
+	case WRITE_BUFFER_MODE_DOWNLOAD_SAVE:
+		instance.Buf = image
+		if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, writeBufferCdb(mode, 0, len(image)), MFI_FRAME_DIR_WRITE); err != nil {
+			return nil, fmt.Errorf("write buffer: %w", err)
+		}
+	case WRITE_BUFFER_MODE_OFFSETS_SAVE, WRITE_BUFFER_MODE_OFFSETS_SAVE_DEFER:
+		for off := 0; off < len(image); off += WRITE_BUFFER_CHUNK_SIZE {
+			instance.Buf = image[off:min(off+WRITE_BUFFER_CHUNK_SIZE, len(image))]
+			if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, writeBufferCdb(mode, off, len(instance.Buf)), MFI_FRAME_DIR_WRITE); err != nil {
+				return nil, fmt.Errorf("write buffer at offset %d: %w", off, err)
+			}
+		}
+		if mode == WRITE_BUFFER_MODE_OFFSETS_SAVE_DEFER {
+			instance.Buf = nil
+			if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, writeBufferCdb(WRITE_BUFFER_MODE_ACTIVATE_DEFERRED, 0, 0), MFI_FRAME_DIR_NONE); err != nil {
+				return nil, fmt.Errorf("activate deferred microcode: %w", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported write buffer mode %#x", mode)
+	}
+
+	if result.NewRevision, err = m.pdFirmwareRevision(ctx, instance, &sdev); err != nil {
+		return nil, err
+	}
+	result.Activated = result.NewRevision != result.OldRevision
+	return result, nil
+}
+
+// FirmwareInventory 见 MegasasIoctl.FirmwareInventory
+func (c *Controller) FirmwareInventory(ctx context.Context) (inv *FirmwareInventory, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		inv, err = m.FirmwareInventory(ctx, instance)
+		return err
+	})
+	return inv, err
+}
+
+// FlashControllerFirmware 见 MegasasIoctl.FlashControllerFirmware, 整个刷写过程持有 host 的锁
+func (c *Controller) FlashControllerFirmware(ctx context.Context, image []byte, dryRun bool) (result *FlashResult, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		result, err = m.FlashControllerFirmware(ctx, instance, image, dryRun)
+		return err
+	})
+	return result, err
+}
+
+// DownloadDriveFirmware 见 MegasasIoctl.DownloadDriveFirmware, 整个下载过程持有 host 的锁
+func (c *Controller) DownloadDriveFirmware(ctx context.Context, deviceId uint16, image []byte, mode uint8) (result *DriveFirmwareResult, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		result, err = m.DownloadDriveFirmware(ctx, instance, deviceId, image, mode)
+		return err
+	})
+	return result, err
+}
+
+func (m *MegasasIoctl) pdFirmwareRevision(ctx context.Context, instance *Instance, sdev *ScsiDevice) (string, error) {
+	pdInfo, err := m.MegasasGetPdInfo(ctx, instance, sdev)
+	if err != nil {
+		return "", err
+	}
+	inq, err := pdInfo.GetInquiryData()
+	if err != nil {
+		return "", err
+	}
+	return inq.FirmwareRevision, nil
+}
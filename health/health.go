@@ -0,0 +1,269 @@
+// Package health 按规则检查 megaraid.Snapshot, 给出每个问题的严重程度、对象和处理建议.
+// check_megaraid 等工具都用这里的规则判断控制器是否健康, 自定义规则见 LoadRules
+package health
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ishmaelwanglin/megaraid"
+)
+
+type Severity uint8
+
+const (
+	Info Severity = iota
+	Warning
+	Critical
+)
+
+var severityNames = []string{"info", "warning", "critical"}
+
+func (s Severity) String() string {
+	if int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return fmt.Sprintf("Severity(%d)", uint8(s))
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	i := slices.Index(severityNames, strings.ToLower(string(text)))
+	if i < 0 {
+		return fmt.Errorf("unknown severity %q", text)
+	}
+	*s = Severity(i)
+	return nil
+}
+
+// Finding 是一条规则发现的一个问题
+type Finding struct {
+	Rule        string
+	Severity    Severity
+	HostNo      uint16
+	Object      string // controller、bbu、pd 252:3、ld 0, 与 megaraid.Change 一致
+	Message     string
+	Remediation string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: host %d %s %s", f.Severity, f.HostNo, f.Object, f.Message)
+}
+
+// Rule 检查一个控制器, 返回的 Finding 不需要填写 Rule 和 HostNo
+type Rule struct {
+	Name  string
+	Check func(c *megaraid.ControllerSnapshot) []Finding
+}
+
+// 内置规则的名字
+const (
+	RulePdFailed          = "pd-failed"
+	RulePdUnconfiguredBad = "pd-unconfigured-bad"
+	RulePredictiveFailure = "pd-predictive-failure"
+	RuleLdDegraded        = "ld-degraded"
+	RuleNoHotSpare        = "ld-no-hot-spare"
+	RuleWriteThrough      = "ld-write-through"
+	RuleCachePinned       = "ld-cache-pinned"
+	RuleBbuReplace        = "bbu-replace"
+	RuleForeignConfig     = "foreign-config"
+)
+
+// DefaultRules 返回所有内置规则, 每次返回新的切片, 可以直接增删
+func DefaultRules() []Rule {
+	return []Rule{
+		{RulePdFailed, pdFailed},
+		{RulePdUnconfiguredBad, pdUnconfiguredBad},
+		{RulePredictiveFailure, predictiveFailure},
+		{RuleLdDegraded, ldDegraded},
+		{RuleNoHotSpare, noHotSpare},
+		{RuleWriteThrough, writeThrough},
+		{RuleCachePinned, cachePinned},
+		{RuleBbuReplace, bbuReplace},
+		{RuleForeignConfig, foreignConfig},
+	}
+}
+
+// Evaluate 用 rules 检查快照中所有控制器, 按控制器、规则的顺序返回.
+// 控制器信息读取失败的控制器报告为 Critical, 不再检查其他规则
+func Evaluate(s *megaraid.Snapshot, rules []Rule) []Finding {
+	var findings []Finding
+	for i := range s.Controllers {
+		findings = append(findings, EvaluateController(&s.Controllers[i], rules)...)
+	}
+	return findings
+}
+
+func EvaluateController(c *megaraid.ControllerSnapshot, rules []Rule) []Finding {
+	if c.Info == nil {
+		return []Finding{{
+			Rule:        "controller-unreachable",
+			Severity:    Critical,
+			HostNo:      c.HostNo,
+			Object:      "controller",
+			Message:     "controller does not answer: " + strings.Join(c.Errors, "; "),
+			Remediation: "check dmesg for megaraid_sas resets and the controller firmware",
+		}}
+	}
+
+	var findings []Finding
+	for _, rule := range rules {
+		for _, f := range rule.Check(c) {
+			f.Rule, f.HostNo = rule.Name, c.HostNo
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// Worst 返回最严重的级别, 没有问题时返回 Info
+func Worst(findings []Finding) Severity {
+	s := Info
+	for _, f := range findings {
+		s = max(s, f.Severity)
+	}
+	return s
+}
+
+func ldName(ld *megaraid.LdSnapshot) string {
+	return fmt.Sprintf("ld %d", ld.TargetId)
+}
+
+func pdFailed(c *megaraid.ControllerSnapshot) []Finding {
+	var findings []Finding
+	for i := range c.Pds {
+		pd := &c.Pds[i]
+		switch pd.State {
+		case "Failed":
+			findings = append(findings, Finding{Severity: Critical, Object: pd.Name(), Message: "is Failed",
+				Remediation: "replace the drive, the array rebuilds onto the replacement or a hot spare"})
+		case "Offline":
+			findings = append(findings, Finding{Severity: Critical, Object: pd.Name(), Message: "is Offline",
+				Remediation: "check the cabling and backplane, then bring the drive online or replace it"})
+		}
+	}
+	return findings
+}
+
+func pdUnconfiguredBad(c *megaraid.ControllerSnapshot) []Finding {
+	var findings []Finding
+	for i := range c.Pds {
+		if pd := &c.Pds[i]; pd.State == "UBad" {
+			findings = append(findings, Finding{Severity: Critical, Object: pd.Name(), Message: "is UBad",
+				Remediation: "replace the drive, or set it good if it was marked bad by a transient error"})
+		}
+	}
+	return findings
+}
+
+func predictiveFailure(c *megaraid.ControllerSnapshot) []Finding {
+	var findings []Finding
+	for i := range c.Pds {
+		if pd := &c.Pds[i]; pd.Health.PredictiveFailures > 0 {
+			findings = append(findings, Finding{Severity: Warning, Object: pd.Name(),
+				Message:     fmt.Sprintf("predictive failures %d", pd.Health.PredictiveFailures),
+				Remediation: "replace the drive proactively while the array is still redundant"})
+		}
+	}
+	return findings
+}
+
+func ldDegraded(c *megaraid.ControllerSnapshot) []Finding {
+	var findings []Finding
+	for i := range c.Lds {
+		ld := &c.Lds[i]
+		var remediation string
+		switch ld.State {
+		case "Optimal":
+			continue
+		case "Offline":
+			remediation = "restore the missing drives, restore the data from backup if they are lost"
+		default:
+			remediation = "replace the failed drives, rebuild starts automatically when a hot spare or replacement is present"
+		}
+		findings = append(findings, Finding{Severity: Critical, Object: ldName(ld), Message: "is " + ld.State, Remediation: remediation})
+	}
+	return findings
+}
+
+// redundant 只对 RAID 配置读取成功的逻辑盘有意义, 否则 RaidLevel 为空
+func redundant(ld *megaraid.LdSnapshot) bool {
+	return ld.RaidLevel != "" && ld.RaidLevel != "RAID0"
+}
+
+func noHotSpare(c *megaraid.ControllerSnapshot) []Finding {
+	covered := func(ld *megaraid.LdSnapshot) bool {
+		for _, spare := range c.HotSpares {
+			if !spare.Dedicated {
+				return true
+			}
+			for _, span := range ld.Spans {
+				if slices.Contains(spare.Arrays, span.ArrayRef) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var findings []Finding
+	for i := range c.Lds {
+		if ld := &c.Lds[i]; redundant(ld) && !covered(ld) {
+			findings = append(findings, Finding{Severity: Warning, Object: ldName(ld), Message: ld.RaidLevel + " has no hot spare",
+				Remediation: "add a global or dedicated hot spare so a failed drive is rebuilt immediately"})
+		}
+	}
+	return findings
+}
+
+func writeThrough(c *megaraid.ControllerSnapshot) []Finding {
+	var findings []Finding
+	for i := range c.Lds {
+		ld := &c.Lds[i]
+		if ld.DefaultCachePolicy&megaraid.MR_LD_CACHE_WRITE_BACK != 0 && ld.CurrentCachePolicy&megaraid.MR_LD_CACHE_WRITE_BACK == 0 {
+			findings = append(findings, Finding{Severity: Warning, Object: ldName(ld), Message: "write-back downgraded to write-through",
+				Remediation: "check the BBU/CacheVault, write-back resumes after it is charged or the learn cycle ends"})
+		}
+	}
+	return findings
+}
+
+// cachePinned: ioctl 没有直接读取 preserved cache 的命令, write-back 的逻辑盘离线时固件会保留
+// 未写入的 cache, 按此推断
+func cachePinned(c *megaraid.ControllerSnapshot) []Finding {
+	var findings []Finding
+	for i := range c.Lds {
+		ld := &c.Lds[i]
+		if ld.State == "Offline" && ld.DefaultCachePolicy&megaraid.MR_LD_CACHE_WRITE_BACK != 0 {
+			findings = append(findings, Finding{Severity: Critical, Object: ldName(ld), Message: "cache is probably pinned for the offline write-back drive",
+				Remediation: "bring the drives back to flush the preserved cache, or discard it (storcli /cX/vY delete preservedcache) if the data is lost"})
+		}
+	}
+	return findings
+}
+
+func bbuReplace(c *megaraid.ControllerSnapshot) []Finding {
+	if c.Bbu == nil || c.Bbu.Healthy {
+		return nil
+	}
+	return []Finding{{Severity: Warning, Object: "bbu", Message: fmt.Sprintf("needs replacement (status %#x)", c.Bbu.FwStatus),
+		Remediation: "replace the battery or CacheVault module, write-back is unavailable until then"}}
+}
+
+func foreignConfig(c *megaraid.ControllerSnapshot) []Finding {
+	var names []string
+	for i := range c.Pds {
+		if pd := &c.Pds[i]; pd.Foreign {
+			names = append(names, pd.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return []Finding{{Severity: Warning, Object: "controller", Message: "foreign configuration on " + strings.Join(names, ", "),
+		Remediation: "import the foreign configuration (storcli /cX/fall import) or clear it if the drives are to be reused"}}
+}
@@ -0,0 +1,145 @@
+package health
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ishmaelwanglin/megaraid"
+)
+
+func controller() *megaraid.ControllerSnapshot {
+	wb := uint8(megaraid.MR_LD_CACHE_WRITE_BACK | megaraid.MR_LD_CACHE_READ_AHEAD)
+	return &megaraid.ControllerSnapshot{
+		HostNo: 0,
+		Info:   &megaraid.ControllerInfo{},
+		Pds: []megaraid.PdSnapshot{
+			{DeviceId: 8, EnclDeviceId: 252, Slot: 0, State: "Online", Health: megaraid.PdHealth{Temperature: 35}},
+			{DeviceId: 9, EnclDeviceId: 252, Slot: 1, State: "Online", Health: megaraid.PdHealth{Temperature: 36}},
+			{DeviceId: 10, EnclDeviceId: 252, Slot: 2, State: "HotSpare"},
+		},
+		Lds: []megaraid.LdSnapshot{
+			{TargetId: 0, State: "Optimal", RaidLevel: "RAID1", DefaultCachePolicy: wb, CurrentCachePolicy: wb,
+				Spans: []megaraid.SpanSnapshot{{ArrayRef: 0}}},
+		},
+		HotSpares: []megaraid.HotSpareSnapshot{{DeviceId: 10, Dedicated: true, Arrays: []uint16{0}}},
+		Bbu:       &megaraid.BbuSnapshot{Healthy: true},
+	}
+}
+
+func rules(findings []Finding) []string {
+	var names []string
+	for _, f := range findings {
+		names = append(names, f.Rule+" "+f.Object)
+	}
+	return names
+}
+
+func TestEvaluate(t *testing.T) {
+	c := controller()
+	if f := EvaluateController(c, DefaultRules()); len(f) != 0 {
+		t.Fatalf("healthy controller: %v", f)
+	}
+
+	c.Pds[0].State = "Failed"
+	c.Pds[1].Health.PredictiveFailures = 2
+	c.Pds[1].Foreign = true
+	c.Lds[0].State = "Degraded"
+	c.Lds[0].CurrentCachePolicy = megaraid.MR_LD_CACHE_READ_AHEAD
+	c.HotSpares = nil
+	c.Bbu = &megaraid.BbuSnapshot{FwStatus: megaraid.MR_BBU_STATE_PACK_MISSING}
+	findings := EvaluateController(c, DefaultRules())
+	want := []string{
+		"pd-failed pd 252:0",
+		"pd-predictive-failure pd 252:1",
+		"ld-degraded ld 0",
+		"ld-no-hot-spare ld 0",
+		"ld-write-through ld 0",
+		"bbu-replace bbu",
+		"foreign-config controller",
+	}
+	if got := rules(findings); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if Worst(findings) != Critical || findings[0].Remediation == "" {
+		t.Errorf("findings = %v", findings)
+	}
+	if s := findings[0].String(); s != "critical: host 0 pd 252:0 is Failed" {
+		t.Errorf("String() = %q", s)
+	}
+
+	c.Lds[0].State = "Offline"
+	if got := rules(EvaluateController(c, []Rule{{RuleCachePinned, cachePinned}})); len(got) != 1 {
+		t.Errorf("cache pinned: %v", got)
+	}
+
+	// 没有读到 RAID 配置时不知道 RAID 级别, 不报告缺少热备盘
+	c.Lds[0].RaidLevel = ""
+	if got := rules(EvaluateController(c, []Rule{{RuleNoHotSpare, noHotSpare}})); len(got) != 0 {
+		t.Errorf("no hot spare without config: %v", got)
+	}
+
+	s := &megaraid.Snapshot{Controllers: []megaraid.ControllerSnapshot{{HostNo: 1, Errors: []string{"controller info: timeout"}}}}
+	if f := Evaluate(s, DefaultRules()); len(f) != 1 || f[0].Severity != Critical || f[0].HostNo != 1 {
+		t.Errorf("unreachable controller: %v", f)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := LoadRules(strings.NewReader(`
+rules:
+  - name: pd-hot
+    object: pd
+    field: Health.Temperature
+    op: ">="
+    value: 36
+    severity: warning
+    message: "temperature {{.Health.Temperature}}℃"
+    remediation: check the chassis fans
+  - name: ctrl-ecc
+    object: controller
+    field: Info.MemCorrectableErrorCount
+    op: ">"
+    value: 100
+    severity: critical
+  - name: jbod
+    object: pd
+    field: State
+    op: ==
+    value: Jbod
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := controller()
+	c.Info.MemCorrectableErrorCount = 101
+	c.Pds[0].State = "Jbod"
+	findings := EvaluateController(c, rules)
+	if len(findings) != 3 {
+		t.Fatalf("findings = %v", findings)
+	}
+	if f := findings[0]; f.Rule != "pd-hot" || f.Object != "pd 252:1" || f.Severity != Warning || f.Message != "temperature 36℃" || f.Remediation != "check the chassis fans" {
+		t.Errorf("pd-hot = %+v", f)
+	}
+	if f := findings[1]; f.Rule != "ctrl-ecc" || f.Severity != Critical || f.Message != "Info.MemCorrectableErrorCount is 101" {
+		t.Errorf("ctrl-ecc = %+v", f)
+	}
+	if f := findings[2]; f.Rule != "jbod" || f.Object != "pd 252:0" || f.Severity != Info {
+		t.Errorf("jbod = %+v", f)
+	}
+
+	for _, bad := range []string{
+		"rules: [{name: a, object: disk, field: State, op: ==, value: x}]",
+		"rules: [{name: a, object: pd, field: Foo, op: ==, value: x}]",
+		"rules: [{name: a, object: pd, field: State, op: '>', value: x}]",
+		"rules: [{name: a, object: pd, field: Slot, op: '>', value: x}]",
+		"rules: [{name: a, object: pd, field: Slot, op: '=~', value: 1}]",
+		"rules: [{name: a, object: pd, field: Slot, op: ==, value: 1, severity: fatal}]",
+		"rules: [{name: a, object: pd, field: Slot, op: ==, value: 1, typo: 1}]",
+		"rules: [{object: pd, field: Slot, op: ==, value: 1}]",
+	} {
+		if _, err := LoadRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+	}
+}
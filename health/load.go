@@ -0,0 +1,235 @@
+package health
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"gopkg.in/yaml.v3"
+)
+
+// RuleSpec 是规则文件中的一条规则, 比较对象的一个字段, 例如:
+//
+//	rules:
+//	  - name: pd-hot
+//	    object: pd
+//	    field: Health.Temperature
+//	    op: ">="
+//	    value: 60
+//	    severity: warning
+//	    message: "temperature {{.Health.Temperature}}℃"
+//	    remediation: check the chassis fans
+type RuleSpec struct {
+	Name        string
+	Object      string   // controller, bbu, pd, ld
+	Field       string   // 用 . 分隔的字段名, controller 的字段如 Info.MemCorrectableErrorCount
+	Op          string   // ==, !=, <, <=, >, >=, 字符串和 bool 只能用 == 和 !=
+	Value       any      // 与字段比较的值
+	Severity    Severity // 默认为 info
+	Message     string   // text/template, . 为对象, 为空时输出字段和值
+	Remediation string
+}
+
+// LoadRules 读取 YAML 格式的规则文件, 顶层为 rules 列表, 每条规则见 RuleSpec
+func LoadRules(r io.Reader) ([]Rule, error) {
+	var file struct {
+		Rules []RuleSpec
+	}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var rules []Rule
+	for i, spec := range file.Rules {
+		rule, err := spec.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d %q: %w", i, spec.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func LoadRulesFile(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := LoadRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+var objectTypes = map[string]reflect.Type{
+	"controller": reflect.TypeOf(megaraid.ControllerSnapshot{}),
+	"bbu":        reflect.TypeOf(megaraid.BbuSnapshot{}),
+	"pd":         reflect.TypeOf(megaraid.PdSnapshot{}),
+	"ld":         reflect.TypeOf(megaraid.LdSnapshot{}),
+}
+
+// Compile 检查字段、操作符和值的类型, 返回可以用于 Evaluate 的 Rule
+func (spec RuleSpec) Compile() (Rule, error) {
+	if spec.Name == "" {
+		return Rule{}, fmt.Errorf("name is empty")
+	}
+	t, ok := objectTypes[spec.Object]
+	if !ok {
+		return Rule{}, fmt.Errorf("unknown object %q", spec.Object)
+	}
+	path := strings.Split(spec.Field, ".")
+	ft, err := fieldType(t, path)
+	if err != nil {
+		return Rule{}, err
+	}
+	match, err := comparer(ft, spec.Op, spec.Value)
+	if err != nil {
+		return Rule{}, err
+	}
+	var tmpl *template.Template
+	if spec.Message != "" {
+		if tmpl, err = template.New(spec.Name).Option("missingkey=error").Parse(spec.Message); err != nil {
+			return Rule{}, err
+		}
+	}
+
+	finding := func(object string, v reflect.Value) (Finding, bool) {
+		fv, ok := field(v, path)
+		if !ok || !match(fv) {
+			return Finding{}, false
+		}
+		f := Finding{Severity: spec.Severity, Object: object, Remediation: spec.Remediation}
+		var buf bytes.Buffer
+		if tmpl != nil && tmpl.Execute(&buf, v.Interface()) == nil {
+			f.Message = buf.String()
+		} else {
+			f.Message = fmt.Sprintf("%s is %v", spec.Field, fv.Interface())
+		}
+		return f, true
+	}
+
+	check := func(c *megaraid.ControllerSnapshot) []Finding {
+		var findings []Finding
+		add := func(object string, v reflect.Value) {
+			if f, ok := finding(object, v); ok {
+				findings = append(findings, f)
+			}
+		}
+		switch spec.Object {
+		case "controller":
+			add("controller", reflect.ValueOf(c).Elem())
+		case "bbu":
+			if c.Bbu != nil {
+				add("bbu", reflect.ValueOf(c.Bbu).Elem())
+			}
+		case "pd":
+			for i := range c.Pds {
+				add(c.Pds[i].Name(), reflect.ValueOf(&c.Pds[i]).Elem())
+			}
+		case "ld":
+			for i := range c.Lds {
+				add(ldName(&c.Lds[i]), reflect.ValueOf(&c.Lds[i]).Elem())
+			}
+		}
+		return findings
+	}
+	return Rule{Name: spec.Name, Check: check}, nil
+}
+
+func fieldType(t reflect.Type, path []string) (reflect.Type, error) {
+	for _, name := range path {
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("%s: %s is not a struct", name, t)
+		}
+		f, ok := t.FieldByName(name)
+		if !ok || !f.IsExported() {
+			return nil, fmt.Errorf("unknown field %s in %s", name, t)
+		}
+		t = f.Type
+	}
+	return t, nil
+}
+
+// field 取出字段的值, 路径上有 nil 指针时返回 false
+func field(v reflect.Value, path []string) (reflect.Value, bool) {
+	for _, name := range path {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.FieldByName(name)
+	}
+	return v, true
+}
+
+func comparer(t reflect.Type, op string, value any) (func(reflect.Value) bool, error) {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool:
+		want := reflect.ValueOf(value)
+		if !want.IsValid() || want.Kind() != t.Kind() {
+			return nil, fmt.Errorf("value %v is not a %s", value, t.Kind())
+		}
+		switch op {
+		case "==":
+			return func(v reflect.Value) bool { return v.Interface() == want.Interface() }, nil
+		case "!=":
+			return func(v reflect.Value) bool { return v.Interface() != want.Interface() }, nil
+		}
+		return nil, fmt.Errorf("operator %q is not supported for %s", op, t.Kind())
+	}
+
+	if !numeric(t.Kind()) {
+		return nil, fmt.Errorf("field of type %s cannot be compared", t)
+	}
+	want, ok := toFloat(reflect.ValueOf(value))
+	if !ok {
+		return nil, fmt.Errorf("value %v is not a number", value)
+	}
+	cmp, ok := map[string]func(a, b float64) bool{
+		"==": func(a, b float64) bool { return a == b },
+		"!=": func(a, b float64) bool { return a != b },
+		"<":  func(a, b float64) bool { return a < b },
+		"<=": func(a, b float64) bool { return a <= b },
+		">":  func(a, b float64) bool { return a > b },
+		">=": func(a, b float64) bool { return a >= b },
+	}[op]
+	if !ok {
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+	return func(v reflect.Value) bool {
+		got, _ := toFloat(v)
+		return cmp(got, want)
+	}, nil
+}
+
+func numeric(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+func toFloat(v reflect.Value) (float64, bool) {
+	switch {
+	case !v.IsValid():
+		return 0, false
+	case v.CanInt():
+		return float64(v.Int()), true
+	case v.CanUint():
+		return float64(v.Uint()), true
+	case v.CanFloat():
+		return v.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,384 @@
+// Package history 把每次轮询的错误计数、温度、BBU 容量追加到本地文件, 用于查询趋势, 例如
+// 每块盘 7 天内介质错误的增长、距离上次 predictive failure 的时间.
+//
+// 文件每行是一个 JSON 编码的 Record, 只追加不修改, Prune 时整体重写. 写入中途掉电留下的半行在读取时跳过.
+// 打开时读入所有 Record, 之后的查询不再读文件, 需要用 Prune 限制保留的时间
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+)
+
+// Record 是一个控制器一次轮询的采样
+type Record struct {
+	Time   time.Time
+	HostNo uint16
+
+	MemCorrectableErrors   uint16
+	MemUncorrectableErrors uint16
+	Bbu                    *BbuSample // 没有 BBU 时为 nil
+	Pds                    []PdSample
+}
+
+type BbuSample struct {
+	Temperature           uint16
+	RelativeStateOfCharge uint16 // %
+	RemainingCapacity     uint16 // mAh
+	FullChargeCapacity    uint16 // mAh
+	CycleCount            uint16
+}
+
+// PdSample 是一块物理盘的计数, Key 同 megaraid.PdSnapshot.PdKey, 换槽位后仍然是同一块盘
+type PdSample struct {
+	Key                string
+	Name               string // pd eid:slot
+	Serial             string
+	MediaErrors        uint32
+	OtherErrors        uint32
+	PredictiveFailures uint32
+	Temperature        uint8 // ℃
+}
+
+// Metric 是物理盘的一个计数
+type Metric string
+
+const (
+	MediaErrors        Metric = "MediaErrors"
+	OtherErrors        Metric = "OtherErrors"
+	PredictiveFailures Metric = "PredictiveFailures"
+	Temperature        Metric = "Temperature"
+)
+
+func (pd *PdSample) Value(metric Metric) (uint64, error) {
+	switch metric {
+	case MediaErrors:
+		return uint64(pd.MediaErrors), nil
+	case OtherErrors:
+		return uint64(pd.OtherErrors), nil
+	case PredictiveFailures:
+		return uint64(pd.PredictiveFailures), nil
+	case Temperature:
+		return uint64(pd.Temperature), nil
+	}
+	return 0, fmt.Errorf("unknown metric %q", metric)
+}
+
+// NewRecords 把快照转换为每个控制器一条 Record, 控制器信息读取失败的控制器没有计数, 跳过
+func NewRecords(s *megaraid.Snapshot) []Record {
+	var records []Record
+	for _, c := range s.Controllers {
+		if c.Info == nil {
+			continue
+		}
+		r := Record{
+			Time:                   s.Time,
+			HostNo:                 c.HostNo,
+			MemCorrectableErrors:   c.Info.MemCorrectableErrorCount,
+			MemUncorrectableErrors: c.Info.MemUncorrectableErrorCount,
+		}
+		if c.Bbu != nil {
+			r.Bbu = &BbuSample{
+				Temperature:           c.Bbu.Temperature,
+				RelativeStateOfCharge: c.Bbu.RelativeStateOfCharge,
+				RemainingCapacity:     c.Bbu.RemainingCapacity,
+				FullChargeCapacity:    c.Bbu.FullChargeCapacity,
+				CycleCount:            c.Bbu.CycleCount,
+			}
+		}
+		for i := range c.Pds {
+			pd := &c.Pds[i]
+			r.Pds = append(r.Pds, PdSample{
+				Key:                pd.PdKey(),
+				Name:               pd.Name(),
+				Serial:             pd.Serial,
+				MediaErrors:        pd.Health.MediaErrors,
+				OtherErrors:        pd.Health.OtherErrors,
+				PredictiveFailures: pd.Health.PredictiveFailures,
+				Temperature:        pd.Health.Temperature,
+			})
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// Store 是打开的历史文件, 可以在多个 goroutine 中使用. 同一个文件只应有一个进程写入
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	records []Record // 文件中的 Record, 按写入顺序
+}
+
+// Open 打开 path, 不存在时创建, 并读入已有的 Record.
+// 上次写入中途退出留下的半行会被补上换行, 以免与新的 Record 连在一起
+func Open(path string) (*Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readRecords(f, time.Time{})
+	if err == nil {
+		err = terminate(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Store{path: path, f: f, records: records}, nil
+}
+
+func terminate(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	if _, err := f.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// Append 追加 records 并 fsync, 每条 Record 一次 write, 不会与其他 Record 交错
+func (s *Store) Append(records ...Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := s.f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		s.records = append(s.records, r)
+	}
+	return s.f.Sync()
+}
+
+// Prune 删除 Time 早于 before 的 Record. 先写临时文件再 rename 替换, 中途失败时原文件不变.
+// 没有需要删除的 Record 时不写文件
+func (s *Store) Prune(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keep := slices.DeleteFunc(slices.Clone(s.records), func(r Record) bool { return r.Time.Before(before) })
+	if len(keep) == len(s.records) {
+		return nil
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeRecords(f, keep)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	s.f.Close()
+	s.f, s.records = f, keep
+	return nil
+}
+
+func writeRecords(f *os.File, records []Record) error {
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Record 追加快照的计数, 见 NewRecords
+func (s *Store) Record(snap *megaraid.Snapshot) error {
+	return s.Append(NewRecords(snap)...)
+}
+
+// Records 按写入顺序返回 Time 不早于 since 的 Record
+func (s *Store) Records(since time.Time) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []Record
+	for _, r := range s.records {
+		if !r.Time.Before(since) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func readRecords(r io.Reader, since time.Time) ([]Record, error) {
+	var records []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		var rec Record
+		// 掉电时的半行和损坏的行不影响其他 Record
+		if json.Unmarshal(sc.Bytes(), &rec) != nil {
+			continue
+		}
+		if rec.Time.Before(since) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
+
+// Growth 是一块盘在一段时间内某个计数的增长
+type Growth struct {
+	HostNo   uint16
+	Key      string
+	Name     string // 最后一次采样时的位置
+	Serial   string
+	From, To time.Time // 第一次和最后一次采样的时间
+	First    uint64
+	Last     uint64
+	Increase uint64 // 相邻采样之间增长的累加, 计数被清零不算负增长
+}
+
+// Growth 返回 since 之后每块盘 metric 的增长, 按 HostNo、Key 排序
+func (s *Store) Growth(metric Metric, since time.Time) ([]Growth, error) {
+	records, err := s.Records(since)
+	if err != nil {
+		return nil, err
+	}
+	return growth(records, metric)
+}
+
+type pdId struct {
+	hostNo uint16
+	key    string
+}
+
+func growth(records []Record, metric Metric) ([]Growth, error) {
+	m := make(map[pdId]*Growth)
+	var ids []pdId
+	for _, r := range records {
+		for i := range r.Pds {
+			pd := &r.Pds[i]
+			v, err := pd.Value(metric)
+			if err != nil {
+				return nil, err
+			}
+			id := pdId{r.HostNo, pd.Key}
+			g, ok := m[id]
+			if !ok {
+				g = &Growth{HostNo: r.HostNo, Key: pd.Key, From: r.Time, First: v, Last: v}
+				m[id] = g
+				ids = append(ids, id)
+			}
+			if v > g.Last {
+				g.Increase += v - g.Last
+			}
+			g.Name, g.Serial, g.To, g.Last = pd.Name, pd.Serial, r.Time, v
+		}
+	}
+
+	slices.SortFunc(ids, compareId)
+	var result []Growth
+	for _, id := range ids {
+		result = append(result, *m[id])
+	}
+	return result, nil
+}
+
+// Increase 是一块盘的计数最后一次增长
+type Increase struct {
+	HostNo uint16
+	Key    string
+	Name   string
+	Serial string
+	Time   time.Time // 第一次看到增长后的值的采样时间, 实际发生在它与前一次采样之间
+	Value  uint64
+}
+
+// LastIncrease 返回每块盘 metric 最后一次增长, 例如 PredictiveFailures 最后一次增长就是上次
+// predictive failure 的时间. 历史中从未增长的盘不返回, 第一次采样时计数已经非 0 也不算增长
+func (s *Store) LastIncrease(metric Metric) ([]Increase, error) {
+	records, err := s.Records(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return lastIncrease(records, metric)
+}
+
+func lastIncrease(records []Record, metric Metric) ([]Increase, error) {
+	last := make(map[pdId]uint64)
+	m := make(map[pdId]*Increase)
+	var ids []pdId
+	for _, r := range records {
+		for i := range r.Pds {
+			pd := &r.Pds[i]
+			v, err := pd.Value(metric)
+			if err != nil {
+				return nil, err
+			}
+			id := pdId{r.HostNo, pd.Key}
+			prev, ok := last[id]
+			last[id] = v
+			if !ok || v <= prev {
+				continue
+			}
+			if _, ok := m[id]; !ok {
+				ids = append(ids, id)
+			}
+			m[id] = &Increase{HostNo: r.HostNo, Key: pd.Key, Name: pd.Name, Serial: pd.Serial, Time: r.Time, Value: v}
+		}
+	}
+
+	slices.SortFunc(ids, compareId)
+	var result []Increase
+	for _, id := range ids {
+		result = append(result, *m[id])
+	}
+	return result, nil
+}
+
+func compareId(a, b pdId) int {
+	if a.hostNo != b.hostNo {
+		return int(a.hostNo) - int(b.hostNo)
+	}
+	if a.key < b.key {
+		return -1
+	}
+	if a.key > b.key {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+)
+
+func snapshot(t time.Time, media, pf uint32) *megaraid.Snapshot {
+	return &megaraid.Snapshot{
+		SchemaVersion: megaraid.SnapshotSchemaVersion,
+		Time:          t,
+		Controllers: []megaraid.ControllerSnapshot{
+			{
+				HostNo: 0,
+				Info:   &megaraid.ControllerInfo{MemCorrectableErrorCount: 1},
+				Bbu:    &megaraid.BbuSnapshot{Temperature: 30, RelativeStateOfCharge: 95, CycleCount: 7},
+				Pds: []megaraid.PdSnapshot{
+					{DeviceId: 8, EnclDeviceId: 252, Slot: 0, Serial: "S0", WWN: "5000c500a0000000",
+						Health: megaraid.PdHealth{MediaErrors: media, PredictiveFailures: pf, Temperature: 35}},
+					{DeviceId: 9, EnclDeviceId: 252, Slot: 1, Serial: "S1",
+						Health: megaraid.PdHealth{Temperature: 36}},
+				},
+			},
+			// 控制器信息读取失败, 不记录
+			{HostNo: 1, Errors: []string{"controller info: timeout"}},
+		},
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	for i, v := range []struct{ media, pf uint32 }{
+		{10, 0}, {12, 0}, {15, 1}, {3, 1}, {5, 1}, // 第 3 天计数被清零
+	} {
+		if err := s.Record(snapshot(t0.Add(time.Duration(i)*day), v.media, v.pf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// 模拟掉电留下的半行, 重新打开后继续追加
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Time":"2024-01-06T00:00:00Z","HostNo":0,"Pds":[{"Key"`)
+	f.Close()
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i, v := range []struct{ media, pf uint32 }{{6, 1}, {8, 2}} {
+		if err := s.Record(snapshot(t0.Add(time.Duration(5+i)*day), v.media, v.pf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := s.Records(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 7 {
+		t.Fatalf("got %d records, want 7", len(records))
+	}
+	r := records[0]
+	if r.HostNo != 0 || r.MemCorrectableErrors != 1 || r.Bbu == nil || r.Bbu.RelativeStateOfCharge != 95 || len(r.Pds) != 2 {
+		t.Errorf("record = %+v", r)
+	}
+	if pd := r.Pds[0]; pd.Key != "wwn:5000c500a0000000" || pd.Name != "pd 252:0" || pd.Temperature != 35 {
+		t.Errorf("pd = %+v", pd)
+	}
+
+	g, err := s.Growth(MediaErrors, t0.Add(day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g) != 2 {
+		t.Fatalf("growth = %+v", g)
+	}
+	// 12 -> 15 -> 3 -> 5 -> 6 -> 8: 3 + 2 + 1 + 2
+	if g[1].Key != "wwn:5000c500a0000000" || g[1].First != 12 || g[1].Last != 8 || g[1].Increase != 8 ||
+		!g[1].From.Equal(t0.Add(day)) || !g[1].To.Equal(t0.Add(6*day)) {
+		t.Errorf("growth = %+v", g[1])
+	}
+	if g[0].Key != "serial:S1" || g[0].Increase != 0 {
+		t.Errorf("growth = %+v", g[0])
+	}
+
+	inc, err := s.LastIncrease(PredictiveFailures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inc) != 1 || inc[0].Name != "pd 252:0" || inc[0].Value != 2 || !inc[0].Time.Equal(t0.Add(6*day)) {
+		t.Errorf("last increase = %+v", inc)
+	}
+
+	if _, err := s.Growth("Foo", time.Time{}); err == nil {
+		t.Error("unknown metric: want error")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	for i := range 5 {
+		if err := s.Record(snapshot(t0.Add(time.Duration(i)*day), uint32(i), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Prune(t0.Add(3 * day)); err != nil {
+		t.Fatal(err)
+	}
+	// Prune 之后继续追加到新文件
+	if err := s.Record(snapshot(t0.Add(5*day), 5, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := s.Records(time.Time{}); len(records) != 3 || !records[0].Time.Equal(t0.Add(3*day)) {
+		t.Fatalf("records after prune = %+v", records)
+	}
+	s.Close()
+
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	records, err := s.Records(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || !records[2].Time.Equal(t0.Add(5*day)) || records[2].Pds[0].MediaErrors != 5 {
+		t.Fatalf("reopened records = %+v", records)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
@@ -35,10 +35,10 @@ func _ioc(dir, t, nr, size uintptr) uintptr {
 // 	return _ioc(directionRead, t, nr, size)
 // }
 
-// // Iow calculates the ioctl command for a write-ioctl of the specified type, number and size
-// func Iow(t, nr, size uintptr) uintptr {
-// 	return _ioc(directionWrite, t, nr, size)
-// }
+// Iow calculates the ioctl command for a write-ioctl of the specified type, number and size
+func Iow(t, nr, size uintptr) uintptr {
+	return _ioc(directionWrite, t, nr, size)
+}
 
 // Iowr calculates the ioctl command for a read/write-ioctl of the specified type, number and size
 func Iowr(t, nr, size uintptr) uintptr {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const SectorSz = 512 // Bytes
@@ -176,8 +177,35 @@ const (
 	MR_DCMD_CTRL_EVENT_GET = 0x01040300 //	获取控制器事件日志,返回事件详细信息，例如错误或状态更改。
 
 	MR_DCMD_CTRL_EVENT_WAIT = 0x01040500 //	等待特定事件发生,常用于监控控制器运行状态。
+
+	MR_DCMD_PD_CLEAR_START = 0x02050100 //	开始擦除(clear)物理盘, mbox 为 PD ref(deviceId, seqNum)。
+
+	MR_DCMD_PD_CLEAR_ABORT = 0x02050200 //	中止物理盘擦除, mbox 为 PD ref。
+
+	MR_DCMD_PD_SET_STATE = 0x02030100 //	设置物理盘状态, mbox 为 PD ref, mbox.s[2] 为新的 MR_PD_STATE_*。
+
+	MR_DCMD_PD_LOCATE_START = 0x02070100 //	点亮物理盘定位灯, mbox 为 PD ref。
+
+	MR_DCMD_PD_LOCATE_STOP = 0x02070200 //	熄灭物理盘定位灯, mbox 为 PD ref。
+
+	MR_DCMD_LD_GET_INFO = 0x03020000 //	获取逻辑盘详细信息(配置、进度、VPD 0x83), mbox.b[0] 为 targetId。
+
+	MR_DCMD_CFG_READ = 0x04010000 //	读取 RAID 配置(array、逻辑盘、热备盘)。
+
+	MR_DCMD_BBU_GET_STATUS        = 0x05010000 //	读取 BBU 状态。
+	MR_DCMD_BBU_GET_CAPACITY_INFO = 0x05020000 //	读取 BBU 的电量和容量(gas gauge)。
+
+	MR_DCMD_FLASH_FW_OPEN = 0x010f0100 //	打开固件升级句柄, mbox.w[0] 为镜像大小。
+
+	MR_DCMD_FLASH_FW_DOWNLOAD = 0x010f0200 //	下载一段固件镜像, mbox.w[0] 为这段数据在镜像中的偏移。
+
+	MR_DCMD_FLASH_FW_FLASH = 0x010f0300 //	把下载完的镜像写入 flash, 重启后生效。
+
+	MR_DCMD_FLASH_FW_CLOSE = 0x010f0400 //	关闭固件升级句柄, 放弃已下载的数据。
 )
 
+const FLASH_BUF_SIZE = 64 * KB // 每次 MR_DCMD_FLASH_FW_DOWNLOAD 下发的数据量
+
 const (
 	SGE_BUFFER_SIZE         = 4096
 	MEGASAS_CLUSTER_ID_SIZE = 16
@@ -201,11 +229,23 @@ type mrProgress struct {
 	ElapsedSecs uint16 // union: elapsedSecsForLastPercent
 }
 
+// MR_PD_PROGRESS.Active
+const (
+	MR_PD_PROGRESS_REBUILD = 1 << 0
+	MR_PD_PROGRESS_PATROL  = 1 << 1
+	MR_PD_PROGRESS_CLEAR   = 1 << 2
+)
+
 // union
 type MR_PROGRESS struct {
 	Mrprogress mrProgress
 }
 
+// Percent 返回进度百分比, 固件里 0xffff 表示 100%
+func (p MR_PROGRESS) Percent() int {
+	return int(p.Mrprogress.Progress) * 100 / 0xffff
+}
+
 // 56
 type MR_PD_PROGRESS struct {
 	Active   [4]byte
@@ -387,6 +427,51 @@ func (info *MR_PD_INFO) GetFwState() string {
 	return status
 }
 
+// GetWWN 从 VpdPage83 中取出 WWN, 没有时返回空串
+func (info *MR_PD_INFO) GetWWN() string {
+	designators, _ := ParseVpdPage83(info.VpdPage83[:])
+	return VpdWWN(designators)
+}
+
+// GetInterface 返回物理盘的接口类型
+func (info *MR_PD_INFO) GetInterface() string {
+	switch info.InterfaceType {
+	case 1:
+		return "SCSI"
+	case 2:
+		return "SAS"
+	case 3:
+		return "SATA"
+	case 4:
+		return "FC"
+	case 5:
+		return "NVMe"
+	}
+	return "Unknown"
+}
+
+// GetLinkSpeed 返回协商的链路速率, 单位 Gb/s, 未知时返回 0
+func (info *MR_PD_INFO) GetLinkSpeed() float64 {
+	switch info.LinkSpeed {
+	case 1:
+		return 1.5
+	case 2:
+		return 3
+	case 3:
+		return 6
+	case 4:
+		return 12
+	case 5:
+		return 22.5
+	}
+	return 0
+}
+
+// InVD 对应 DDF type 中的 inVD 位
+func (info *MR_PD_INFO) InVD() bool {
+	return BitField(info.State.PdType, 1, 1) == 1
+}
+
 func (info *MR_PD_INFO) NCQ() bool {
 	return BitField(info.Properties.Bits, 5, 1) == 1
 }
@@ -522,6 +607,79 @@ type mbox_b [12]uint8
 type mbox_s [6]uint16
 type mbox_w [3]uint32
 
+// MFI_CMD_LD_SCSI_IO / MFI_CMD_PD_SCSI_IO 使用的 pass-through frame
+type megasas_pthru_frame struct {
+	cmd                    uint8
+	sense_len              uint8
+	cmd_status             uint8
+	scsi_status            uint8
+	target_id              uint8
+	lun                    uint8
+	cdb_len                uint8
+	sge_count              uint8
+	context                uint32
+	pad_0                  uint32
+	flags                  uint16
+	timeout                uint16
+	data_xfer_len          uint32
+	sense_buf_phys_addr_lo uint32
+	sense_buf_phys_addr_hi uint32
+	cdb                    [16]uint8
+	sgl                    megasas_sge64 //	union of megasas_sge64 / megasas_sge32
+} // __packed
+
+// megasas_iocpacket.frame 在打包后的偏移量, frame 之前全是 4 字节对齐的字段
+const iocFrameOffset = 20
+
+/*
+ * SCSI pass-through definitions
+ */
+const (
+	SCSI_SENSE_BUFFERSIZE = 96
+	SCSI_INQUIRY          = 0x12
+	SCSI_WRITE_BUFFER     = 0x3b
+	SCSI_REQUEST_SENSE    = 0x03
+	SCSI_SEND_DIAGNOSTIC  = 0x1d
+	SCSI_LOG_SENSE        = 0x4d
+	SCSI_ATA_PASSTHRU_16  = 0x85
+	SCSI_SANITIZE         = 0x48
+
+	// SANITIZE service action
+	SANITIZE_OVERWRITE    = 0x01
+	SANITIZE_BLOCK_ERASE  = 0x02
+	SANITIZE_CRYPTO_ERASE = 0x03
+
+	LOG_PAGE_SELF_TEST_RESULTS = 0x10
+
+	// ATA SMART, 通过 ATA PASS-THROUGH(16) 发给 SATA 盘
+	ATA_SMART                    = 0xb0
+	ATA_SMART_READ_DATA          = 0xd0
+	ATA_SMART_EXECUTE_OFFLINE    = 0xd4
+	ATA_SMART_READ_LOG           = 0xd5
+	ATA_SMART_LOG_SELF_TEST      = 0x06
+	ATA_SMART_ABORT_SELF_TEST    = 0x7f
+	ATA_SECTOR_SIZE              = 512
+	ATA_SMART_SELF_TEST_EXEC_OFF = 363 // SMART READ DATA 中 self-test execution status 的偏移
+
+	// WRITE BUFFER mode
+	WRITE_BUFFER_MODE_DOWNLOAD_SAVE      = 0x05 // 一次下载全部微码并保存、激活
+	WRITE_BUFFER_MODE_OFFSETS_SAVE       = 0x07 // 按偏移分段下载, 最后一段完成后保存、激活
+	WRITE_BUFFER_MODE_OFFSETS_SAVE_DEFER = 0x0e // 按偏移分段下载并保存, 延迟激活
+	WRITE_BUFFER_MODE_ACTIVATE_DEFERRED  = 0x0f // 激活延迟的微码
+	WRITE_BUFFER_CHUNK_SIZE              = 64 * KB
+
+	VPD_SUPPORTED_PAGES       = 0x00
+	VPD_UNIT_SERIAL_NUMBER    = 0x80
+	VPD_DEVICE_IDENTIFICATION = 0x83
+	VPD_BLOCK_LIMITS          = 0xb0
+
+	// VPD page 0x83 designator type
+	VPD_DESIGNATOR_T10_VENDOR_ID = 0x1
+	VPD_DESIGNATOR_EUI64         = 0x2
+	VPD_DESIGNATOR_NAA           = 0x3
+	VPD_DESIGNATOR_SCSI_NAME     = 0x8
+)
+
 // megasas_iocpacket struct - caution: megasas driver expects packet struct
 type megasas_iocpacket struct {
 	host_no   uint16
@@ -534,6 +692,14 @@ type megasas_iocpacket struct {
 	sgl       [MAX_IOCTL_SGE]Iovec
 } // __packed
 
+// megasas_aen struct - MEGASAS_IOC_GET_AEN 的参数, 同样是 packed
+type megasas_aen struct {
+	host_no           uint16
+	__pad1            uint16
+	seq_num           uint32
+	class_locale_word uint32
+} // __packed
+
 /*
  * defines the physical drive address structure
  */
@@ -551,6 +717,11 @@ func (a *MR_PD_ADDRESS) IsScsiDev() bool {
 	return a.ScsiDevType == 0
 }
 
+// IsEnclosure 表示该设备是 enclosure 的 SES 设备(SCSI device type 0x0D)
+func (a *MR_PD_ADDRESS) IsEnclosure() bool {
+	return a.ScsiDevType == 0x0d
+}
+
 func (a *MR_PD_ADDRESS) GetSasAddr() uint64 {
 	return ArrayZip(a.SasAddr[:], 32)
 }
@@ -562,6 +733,13 @@ func (a *MR_PD_ADDRESS) GetSasAddrs() string {
 type MegasasIoctl struct {
 	DeviceMajor uint32
 	fd          int
+
+	mu          sync.Mutex
+	controllers map[uint16]*Controller
+	async       int             // 打开的 Aen 数量, 不为 0 时 fd 设置了 O_ASYNC
+	inflight    map[uint16]bool // 有被放弃但还没返回的命令的 host
+
+	sys func(cmd uintptr, arg []byte) error // 测试时代替 Ioctl
 }
 
 /*
@@ -630,6 +808,10 @@ type LD_INFO struct {
 func (ld *LD_INFO) GetState() string {
 	var status string
 	switch ld.State {
+	case 0:
+		status = "Offline"
+	case 1:
+		status = "PartiallyDegraded"
 	case 2:
 		status = "Degraded"
 	case 3:
@@ -1201,3 +1383,252 @@ func (ctrl *megasas_ctrl_info) SerialNumber() string {
 func (ctrl *megasas_ctrl_info) JbodEnabled() bool {
 	return BitField(ctrl.Properties.OnOffProperties.Bits, 13, 1) == 1
 }
+
+/*
+ * RAID configuration (MR_DCMD_CFG_READ)
+ */
+const (
+	MAX_ROW_SIZE         = 32 // 每个 array 最多的盘数
+	MAX_SPAN_DEPTH       = 8  // 每个逻辑盘最多的 span
+	MAX_ARRAYS_DEDICATED = 16 // 专用热备盘最多关联的 array 数
+)
+
+// MR_CONFIG_DATA 是配置数据的头, 后面依次跟着 ArrayCount 个 MR_ARRAY、LogDrvCount 个 MR_LD_CONFIG、SparesCount 个 MR_SPARE
+type MR_CONFIG_DATA struct {
+	Size        uint32
+	ArrayCount  uint16
+	ArraySize   uint16
+	LogDrvCount uint16
+	LogDrvSize  uint16
+	SparesCount uint16
+	SparesSize  uint16
+	_           [16]uint8
+}
+
+type MR_PD_REF struct {
+	DeviceId uint16
+	SeqNum   uint16
+}
+
+type MR_ARRAY struct {
+	Size      uint64 // unit: sector
+	NumDrives uint8
+	_         uint8
+	ArrayRef  uint16
+	_         [20]uint8
+	Pd        [MAX_ROW_SIZE]struct {
+		Ref        MR_PD_REF // DeviceId 0xffff 表示缺盘
+		FwState    uint16    // 成员盘的固件状态, 同 MR_PD_INFO.FwState
+		EnclIndex  uint8     // enclosure 的下标, 不是 enclosure 的 device id
+		SlotNumber uint8
+	}
+}
+
+// MR_LD_PROPERTIES.DefaultCachePolicy/CurrentCachePolicy
+const (
+	MR_LD_CACHE_WRITE_BACK          = 0x01
+	MR_LD_CACHE_WRITE_ADAPTIVE      = 0x02
+	MR_LD_CACHE_READ_AHEAD          = 0x04
+	MR_LD_CACHE_READ_ADAPTIVE       = 0x08
+	MR_LD_CACHE_WRITE_CACHE_BAD_BBU = 0x10
+	MR_LD_CACHE_ALLOW_WRITE_CACHE   = 0x20
+	MR_LD_CACHE_ALLOW_READ_CACHE    = 0x40
+)
+
+// MR_LD_PROPERTIES.AccessPolicy
+const (
+	MR_LD_ACCESS_RW        = 0
+	MR_LD_ACCESS_READ_ONLY = 2
+	MR_LD_ACCESS_BLOCKED   = 3
+)
+
+type MR_LD_PROPERTIES struct {
+	Ref struct {
+		TargetId uint8
+		_        uint8
+		SeqNum   uint16
+	}
+	Name               [16]byte
+	DefaultCachePolicy uint8
+	AccessPolicy       uint8
+	DiskCachePolicy    uint8
+	CurrentCachePolicy uint8
+	NoBgi              uint8
+	_                  [7]uint8
+}
+
+type MR_LD_PARAMETERS struct {
+	PrimaryRaidLevel   uint8
+	RaidLevelQualifier uint8
+	SecondaryRaidLevel uint8
+	StripeSize         uint8 // 512 << StripeSize
+	NumDrives          uint8
+	SpanDepth          uint8
+	State              uint8
+	InitState          uint8
+	IsConsistent       uint8
+	_                  [6]uint8
+	IsSSCD             uint8
+	_                  [16]uint8
+}
+
+type MR_SPAN struct {
+	StartBlock uint64
+	NumBlocks  uint64
+	ArrayRef   uint16
+	_          [6]uint8
+}
+
+type MR_LD_CONFIG struct {
+	Properties MR_LD_PROPERTIES
+	Params     MR_LD_PARAMETERS
+	Span       [MAX_SPAN_DEPTH]MR_SPAN
+}
+
+// GetRaidLevel 返回 RAID 级别, 多个 span 的 RAID1/5/6 分别为 RAID10/50/60
+func (ld *MR_LD_CONFIG) GetRaidLevel() string {
+	level := fmt.Sprintf("RAID%d", ld.Params.PrimaryRaidLevel)
+	if ld.Params.SpanDepth > 1 && ld.Params.PrimaryRaidLevel != 0 {
+		level += "0"
+	}
+	return level
+}
+
+func (ld *MR_LD_CONFIG) GetName() string {
+	return trimString(ld.Properties.Name[:])
+}
+
+// MR_SPARE.SpareType
+const (
+	MR_SPARE_DEDICATED     = 1 << 0
+	MR_SPARE_REVERTIBLE    = 1 << 1
+	MR_SPARE_ENCL_AFFINITY = 1 << 7
+)
+
+type MR_SPARE struct {
+	Ref        MR_PD_REF
+	SpareType  uint8
+	_          [2]uint8
+	ArrayCount uint8
+	ArrayRef   [MAX_ARRAYS_DEDICATED]uint16
+} // 40 bytes
+
+/*
+ * BBU status (MR_DCMD_BBU_GET_STATUS)
+ */
+const (
+	MR_BBU_TYPE_NONE = 0
+	MR_BBU_TYPE_IBBU = 1
+	MR_BBU_TYPE_BBU  = 2
+
+	MR_BBU_STATE_PACK_MISSING      = 1 << 0
+	MR_BBU_STATE_VOLTAGE_LOW       = 1 << 1
+	MR_BBU_STATE_TEMPERATURE_HIGH  = 1 << 2
+	MR_BBU_STATE_CHARGE_ACTIVE     = 1 << 3
+	MR_BBU_STATE_DISCHARGE_ACTIVE  = 1 << 4
+	MR_BBU_STATE_LEARN_CYC_REQ     = 1 << 5
+	MR_BBU_STATE_LEARN_CYC_ACTIVE  = 1 << 6
+	MR_BBU_STATE_LEARN_CYC_FAIL    = 1 << 7
+	MR_BBU_STATE_LEARN_CYC_TIMEOUT = 1 << 8
+	MR_BBU_STATE_I2C_ERR_DETECT    = 1 << 9
+	MR_BBU_STATE_BAD               = MR_BBU_STATE_PACK_MISSING | MR_BBU_STATE_VOLTAGE_LOW | MR_BBU_STATE_TEMPERATURE_HIGH | MR_BBU_STATE_LEARN_CYC_FAIL | MR_BBU_STATE_LEARN_CYC_TIMEOUT | MR_BBU_STATE_I2C_ERR_DETECT
+)
+
+// 64
+type MR_BBU_STATUS struct {
+	BatteryType uint8
+	_           uint8
+	Voltage     uint16 // mV
+	Current     int16  // mA
+	Temperature uint16 // ℃
+	FwStatus    uint32 // MR_BBU_STATE_*
+	_           [20]uint8
+	Detail      [32]uint8 // union: ibbu/bbu 的详细状态
+}
+
+// Healthy 表示电池在位且没有电压、温度、learn cycle 或 I2C 错误
+func (s *MR_BBU_STATUS) Healthy() bool {
+	return s.BatteryType != MR_BBU_TYPE_NONE && s.FwStatus&MR_BBU_STATE_BAD == 0
+}
+
+// 48, MR_DCMD_BBU_GET_CAPACITY_INFO, 容量单位为 mAh, 时间单位为分钟
+type MR_BBU_CAPACITY_INFO struct {
+	RelativeStateOfCharge  uint16 // %
+	AbsoluteStateOfCharge  uint16 // %
+	RemainingCapacity      uint16
+	FullChargeCapacity     uint16
+	RunTimeToEmpty         uint16
+	AverageTimeToEmpty     uint16
+	AverageTimeToFull      uint16
+	CycleCount             uint16
+	MaxError               uint16 // %
+	RemainingCapacityAlarm uint16
+	RemainingTimeAlarm     uint16
+	_                      [26]uint8
+}
+
+// megasas_evt_class_locale.class, MR_DCMD_CTRL_EVENT_GET 返回不低于该级别的事件
+const (
+	MR_EVT_CLASS_DEBUG    int8 = -2
+	MR_EVT_CLASS_PROGRESS int8 = -1
+	MR_EVT_CLASS_INFO     int8 = 0
+	MR_EVT_CLASS_WARNING  int8 = 1
+	MR_EVT_CLASS_CRITICAL int8 = 2
+	MR_EVT_CLASS_FATAL    int8 = 3
+	MR_EVT_CLASS_DEAD     int8 = 4
+)
+
+// megasas_evt_class_locale.locale, 可以组合
+const (
+	MR_EVT_LOCALE_LD      uint16 = 0x0001
+	MR_EVT_LOCALE_PD      uint16 = 0x0002
+	MR_EVT_LOCALE_ENCL    uint16 = 0x0004
+	MR_EVT_LOCALE_BBU     uint16 = 0x0008
+	MR_EVT_LOCALE_SAS     uint16 = 0x0010
+	MR_EVT_LOCALE_CTRL    uint16 = 0x0020
+	MR_EVT_LOCALE_CONFIG  uint16 = 0x0040
+	MR_EVT_LOCALE_CLUSTER uint16 = 0x0080
+	MR_EVT_LOCALE_ALL     uint16 = 0xffff
+)
+
+// MR_EVT_DETAIL.ArgType, 只列出参数以 megasas_evt_ld/megasas_evt_pd 开头的类型
+const (
+	MR_EVT_ARGS_LD       = 0x02
+	MR_EVT_ARGS_LD_COUNT = 0x03
+	MR_EVT_ARGS_LD_OWNER = 0x05
+	MR_EVT_ARGS_LD_PROG  = 0x07
+	MR_EVT_ARGS_LD_STATE = 0x08
+	MR_EVT_ARGS_PD       = 0x0a
+	MR_EVT_ARGS_PD_ERR   = 0x0b
+	MR_EVT_ARGS_PD_PROG  = 0x0e
+	MR_EVT_ARGS_PD_STATE = 0x0f
+)
+
+// 20, MR_DCMD_CTRL_EVENT_GET_INFO
+type MR_EVT_LOG_INFO struct {
+	NewestSeqNum   uint32
+	OldestSeqNum   uint32
+	ClearSeqNum    uint32 // 最后一次清除事件日志时的序号
+	ShutdownSeqNum uint32
+	BootSeqNum     uint32
+}
+
+// 256, megasas_evt_detail
+type MR_EVT_DETAIL struct {
+	SeqNum      uint32
+	TimeStamp   uint32 // 2000-01-01 起的秒数, 最高字节为 0xff 时低 24 位为开机后的秒数
+	Code        uint32
+	Locale      uint16
+	_           uint8
+	Class       int8
+	ArgType     uint8
+	_           [15]uint8
+	Args        [96]uint8
+	Description [128]uint8
+}
+
+// MR_DCMD_CTRL_EVENT_GET 的返回, 后面跟 Count 个 MR_EVT_DETAIL
+type MR_EVT_LIST_HEADER struct {
+	Count uint32
+	_     uint32
+}
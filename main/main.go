@@ -1,98 +1,308 @@
+// storcli 风格的命令行工具, 例如:
+//
+//	megaraid /call show
+//	megaraid /c0 show all J
+//	megaraid -o yaml /c0/vall show
+//	megaraid /c0/e252/sall show
+//	megaraid /c0/e252/s3 start locate
+//	megaraid /c0/e252/s3 set good
+//	megaraid /c0/e252/sall set good force
+//	megaraid snapshot
+//	megaraid -history /var/lib/megaraid/history.jsonl snapshot
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+	"github.com/ishmaelwanglin/megaraid/history"
+	"github.com/ishmaelwanglin/megaraid/storcli"
 )
 
+const usage = `usage: %s [-o table|json|yaml] <path> <verb> [J]
+       %s [-history file] snapshot
+
+paths:
+  /call, /cX                    controller
+  /cX/vall, /cX/vY              virtual drive
+  /cX/eall/sall, /cX/eY/sZ      physical drive
+
+verbs:
+  show, show all
+  start locate, stop locate     (physical drive)
+  set good|offline|online|jbod  (single physical drive, append force for eall/sall)
+`
+
 func main() {
-	m, err := megaraid.CreateMegasasIoctl()
+	format := flag.String("o", "table", "output format: table, json or yaml")
+	timeout := flag.Duration("timeout", 0, "give up when the controller does not answer within this duration, 0 waits forever")
+	historyFile := flag.String("history", "", "snapshot also appends error counters, temperatures and BBU capacity to this file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	// 兼容 storcli 的 J 后缀
+	if len(args) > 0 && strings.EqualFold(args[len(args)-1], "j") {
+		*format = "json"
+		args = args[:len(args)-1]
+	}
+	if len(args) == 1 && args[0] == "snapshot" {
+		snapshot(*timeout, *historyFile)
+		return
+	}
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path, err := ParsePath(args[0])
 	if err != nil {
+		fatal(err)
+	}
+	verb := strings.ToLower(strings.Join(args[1:], " "))
 
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	m, err := megaraid.CreateMegasasIoctl()
+	if err != nil {
+		fatal(err)
 	}
 	defer m.Close()
 
-	hosts, err := m.ScanHosts()
+	hostNos, err := m.ScanHosts()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	// storcli 的控制器编号按 SCSI host 号排序
+	slices.Sort(hostNos)
 
-	for _, host := range hosts {
-		instance := megaraid.Instance{HostNo: host}
-		devices, err := m.MegasasGetPdList(&instance)
+	var hosts []*collector.Host
+	var ctrls []int
+	for c, hostNo := range hostNos {
+		if !match(path.Ctrl, c) {
+			continue
+		}
+		h, err := collector.Gather(ctx, m, hostNo)
 		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("%s\n", strings.Repeat("-", 180))
-		fmt.Printf("%-10s%-10s%-20s%-20s%-20s%-20s%-10s%-10s%-20s%-20s%-20s\n", "Eid:Slt", "DID", "MediaType", "Size", "Serial", "Product", "Vendor", "FwState", "State", "Properties", "SasAddr")
-		fmt.Printf("%s\n", strings.Repeat("-", 180))
-		for _, v := range devices {
-			if !v.IsScsiDev() {
-				continue
-			}
-			sdev := megaraid.ScsiDevice{
-				Channel:  v.EnclosureId,
-				DeviceId: v.DeviceId,
-			}
+			fatal(fmt.Errorf("/c%d: %w", c, err))
+		}
+		for _, e := range h.Errors {
+			fmt.Fprintf(os.Stderr, "/c%d: %s\n", c, e)
+		}
+		hosts = append(hosts, h)
+		ctrls = append(ctrls, c)
+	}
+	if len(hosts) == 0 {
+		fatal(fmt.Errorf("controller %s not found", path))
+	}
 
-			pdInfo, err := m.MegasasGetPdInfo(&instance, &sdev)
-			if err != nil {
-				continue
-			}
-			inq, err := pdInfo.GetInquiryData()
-			if err != nil {
-				continue
-			}
-			sasAddr := v.GetSasAddrs()
+	data, err := command(ctx, m, path, verb)
+	if err != nil {
+		fatal(err)
+	}
+	out := storcli.Render(hosts, func(i int, h *collector.Host) (storcli.Object, error) {
+		return data(ctrls[i], h)
+	})
+	// Render 按 hosts 的下标编号, 这里改回真实的控制器编号
+	for i := range out.Controllers {
+		out.Controllers[i].CommandStatus.Controller = ctrls[i]
+	}
 
-			fmt.Printf("%-10s%-10d%-20s%-20s%-20s%-20s%-10s%-10s%-20b%-20b%-20v\n", fmt.Sprintf("%d:%d", pdInfo.EnclDeviceId, pdInfo.SlotNumber),
-				pdInfo.Ref.DeviceId, pdInfo.GetMediaType(),
-				pdInfo.GetSize(), inq.SerialNumber, inq.ProductIdentification, inq.VendorIdentification, pdInfo.GetFwState(),
-				pdInfo.State.PdType, pdInfo.Properties.Bits, sasAddr)
+	if err := write(os.Stdout, out, *format); err != nil {
+		fatal(err)
+	}
+	for _, c := range out.Controllers {
+		if c.CommandStatus.Status != "Success" {
+			os.Exit(1)
 		}
-		fmt.Printf("%s\n", strings.Repeat("-", 180))
+	}
+}
+
+// snapshot 以 JSON 输出 megaraid.Snapshot, 给资产和巡检工具使用. historyFile 不为空时同时追加到 history
+func snapshot(timeout time.Duration, historyFile string) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	m, err := megaraid.CreateMegasasIoctl()
+	if err != nil {
+		fatal(err)
+	}
+	defer m.Close()
 
-		fmt.Printf("\n\n")
-		ldList, err := m.MegasasGetLdList(&instance)
+	s, err := m.Snapshot(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	if historyFile != "" {
+		store, err := history.Open(historyFile)
 		if err != nil {
-			continue
+			fatal(err)
 		}
-		if ldList.LdCount == 0 {
-			continue
+		if err := store.Record(s); err != nil {
+			fatal(err)
 		}
+		store.Close()
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
 
-		fmt.Printf("%s\n", strings.Repeat("-", 30))
-		fmt.Printf("%-10s%-10s%-10s\n", "TargetId", "State", "Size")
-		fmt.Printf("%s\n", strings.Repeat("-", 30))
-		for i := 0; i < int(ldList.LdCount); i++ {
-			fmt.Printf("%-10d%-10s%-10s\n", ldList.LdList[i].Ref.TargetId, ldList.LdList[i].GetState(), ldList.LdList[i].GetSize())
+type dataFunc func(c int, h *collector.Host) (storcli.Object, error)
+
+// command 返回路径和动作对应的 Response Data 生成函数
+func command(ctx context.Context, m *megaraid.MegasasIoctl, path *Path, verb string) (dataFunc, error) {
+	switch {
+	case path.HasVd:
+		if verb != "show" && verb != "show all" {
+			break
 		}
-		fmt.Printf("%s\n", strings.Repeat("-", 30))
-		fmt.Printf("\n\n")
-		m.MegasasLdListQuery(&instance, megaraid.MR_LD_QUERY_TYPE_EXPOSED_TO_HOST)
-		fmt.Printf("\n\n")
-		ctrlInfo := m.MegasasGetCtrlInfo(&instance)
+		return func(c int, h *collector.Host) (storcli.Object, error) {
+			return storcli.Object{"Virtual Drives": storcli.VdList(filter(h, path))}, nil
+		}, nil
 
-		var devInterface string
-		if megaraid.BitField(ctrlInfo.DeviceInterface.Bits, 0, 4) == 10 {
-			devInterface = "SAS-12G"
-		} else {
-			devInterface = "Unknown"
+	case path.HasDrive:
+		switch verb {
+		case "show":
+			return func(c int, h *collector.Host) (storcli.Object, error) {
+				return storcli.Object{"Drive Information": storcli.PdList(filter(h, path))}, nil
+			}, nil
+		case "show all":
+			return func(c int, h *collector.Host) (storcli.Object, error) {
+				return storcli.DrivesShowAll(c, filter(h, path))
+			}, nil
+		}
+		// 修改状态的动作默认只能用于一块盘, 避免 /call/eall/sall set offline 一次让所有 array 离线
+		set, force := strings.HasPrefix(verb, "set "), strings.HasSuffix(verb, " force")
+		name := verb
+		if set && force {
+			name = strings.TrimSuffix(verb, " force")
+		}
+		if action := pdAction(m, name); action != nil {
+			if set && !force && !path.SingleDrive() {
+				return nil, fmt.Errorf("%q changes drive state: name a single drive like /c0/e252/s3, or append force to apply it to %s", verb, path)
+			}
+			return func(c int, h *collector.Host) (storcli.Object, error) {
+				return drivesDo(ctx, m, c, filter(h, path), action)
+			}, nil
 		}
 
-		fmt.Printf("ProductName: %s\nVendorId: %#x\nSerial: %s\nDeviceInterface: %s\nJbodEnabled: %t\n",
-			ctrlInfo.GetProductName(), ctrlInfo.Pci.VendorId, ctrlInfo.SerialNumber(), devInterface, ctrlInfo.JbodEnabled())
-		fmt.Printf("\n\n")
-		fmt.Printf("%b\n", megaraid.BitField(ctrlInfo.DeviceInterface.Bits, 5, 1))
-		fmt.Printf("%b\n", megaraid.BitField(ctrlInfo.DeviceInterface.Bits, 0, 8))
+	default:
+		switch verb {
+		case "show":
+			return func(c int, h *collector.Host) (storcli.Object, error) {
+				return storcli.Object{
+					"Product Name":    h.Ctrl.ProductName,
+					"Serial Number":   h.Ctrl.SerialNumber,
+					"Virtual Drives":  len(h.Lds),
+					"VD LIST":         storcli.VdList(h),
+					"Physical Drives": len(h.Pds),
+					"PD LIST":         storcli.PdList(h),
+					"Enclosures":      len(h.Enclosures),
+					"Enclosure LIST":  storcli.EnclosureList(h),
+				}, nil
+			}, nil
+		case "show all":
+			return storcli.ShowAll, nil
+		}
 	}
+	return nil, fmt.Errorf("unsupported command %q for %s", verb, path)
+}
 
+// pdAction 返回物理盘动作, 不支持时返回 nil
+func pdAction(m *megaraid.MegasasIoctl, verb string) func(ctx context.Context, instance *megaraid.Instance, deviceId uint16) error {
+	setState := func(state uint8) func(context.Context, *megaraid.Instance, uint16) error {
+		return func(ctx context.Context, instance *megaraid.Instance, deviceId uint16) error {
+			return m.MegasasSetPdState(ctx, instance, deviceId, state)
+		}
+	}
+	switch verb {
+	case "start locate", "stop locate":
+		return func(ctx context.Context, instance *megaraid.Instance, deviceId uint16) error {
+			return m.MegasasLocatePd(ctx, instance, deviceId, verb == "start locate")
+		}
+	case "set good":
+		return setState(megaraid.MR_PD_STATE_UNCONFIGURED_GOOD)
+	case "set offline":
+		return setState(megaraid.MR_PD_STATE_OFFLINE)
+	case "set online":
+		return setState(megaraid.MR_PD_STATE_ONLINE)
+	case "set jbod":
+		return setState(megaraid.MR_PD_STATE_SYSTEM)
+	}
+	return nil
 }
 
-// devType: 0 -> scsi 13 -> vd/nvme
+// drivesDo 对每块匹配的物理盘执行动作, 任一块失败时整个控制器的结果为 Failure
+func drivesDo(ctx context.Context, m *megaraid.MegasasIoctl, c int, h *collector.Host, action func(context.Context, *megaraid.Instance, uint16) error) (storcli.Object, error) {
+	if len(h.Pds) == 0 {
+		return nil, fmt.Errorf("no drive found")
+	}
+	var status []storcli.Object
+	var failed int
+	for _, pd := range h.Pds {
+		row := storcli.Object{"Drive": storcli.DrivePath(c, pd.Info), "Status": "Success", "ErrMsg": "-"}
+		err := m.Controller(h.Ctrl.HostNo).Do(ctx, func(_ *megaraid.MegasasIoctl, instance *megaraid.Instance) error {
+			return action(ctx, instance, pd.Info.Ref.DeviceId)
+		})
+		if err != nil {
+			row["Status"], row["ErrMsg"] = "Failure", err.Error()
+			failed++
+		}
+		status = append(status, row)
+	}
+	obj := storcli.Object{"Detailed Status": status}
+	if failed > 0 {
+		return obj, fmt.Errorf("%d of %d drive(s) failed", failed, len(status))
+	}
+	return obj, nil
+}
 
-// /sys/class/scsi_host/host0/device/target0\:0\:10/0\:0\:10\:0/block/sdg
-// /sys/class/scsi_device
+// filter 返回只包含路径匹配的逻辑盘和物理盘的副本
+func filter(h *collector.Host, path *Path) *collector.Host {
+	f := *h
+	if path.HasVd {
+		f.Lds = nil
+		for _, ld := range h.Lds {
+			if match(path.Vd, int(ld.Ref.TargetId)) {
+				f.Lds = append(f.Lds, ld)
+			}
+		}
+	}
+	if path.HasDrive {
+		f.Pds = nil
+		for _, pd := range h.Pds {
+			if match(path.Encl, int(pd.Info.EnclDeviceId)) && match(path.Slot, int(pd.Info.SlotNumber)) {
+				f.Pds = append(f.Pds, pd)
+			}
+		}
+	}
+	return &f
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ishmaelwanglin/megaraid/storcli"
+	"gopkg.in/yaml.v3"
+)
+
+// 表格的列顺序和 storcli 一致, 其他列表按 key 排序
+var columns = map[string][]string{
+	"VD LIST":           {"DG/VD", "TYPE", "State", "Access", "Consist", "Cache", "Cac", "sCC", "Size", "Name"},
+	"Virtual Drives":    {"DG/VD", "TYPE", "State", "Access", "Consist", "Cache", "Cac", "sCC", "Size", "Name"},
+	"PD LIST":           {"EID:Slt", "DID", "State", "DG", "Size", "Intf", "Med", "SED", "PI", "SeSz", "Model", "Sp", "Type"},
+	"Drive Information": {"EID:Slt", "DID", "State", "DG", "Size", "Intf", "Med", "SED", "PI", "SeSz", "Model", "Sp", "Type"},
+	"Enclosure LIST":    {"EID", "State", "PD"},
+	"Detailed Status":   {"Drive", "Status", "ErrMsg"},
+}
+
+func write(w io.Writer, out *storcli.Output, format string) error {
+	switch format {
+	case "json":
+		b, err := out.Marshal()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		return enc.Encode(out)
+	case "table":
+		writeTable(w, out)
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, want table, json or yaml", format)
+}
+
+func writeTable(w io.Writer, out *storcli.Output) {
+	for _, c := range out.Controllers {
+		fmt.Fprintf(w, "Controller = %d\nStatus = %s\nDescription = %s\n\n", c.CommandStatus.Controller, c.CommandStatus.Status, c.CommandStatus.Description)
+		writeObject(w, c.ResponseData, "")
+	}
+}
+
+func writeObject(w io.Writer, obj storcli.Object, indent string) {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	// 标量在前, 列表和子对象在后
+	slices.SortFunc(keys, func(a, b string) int {
+		if sa, sb := isScalar(obj[a]), isScalar(obj[b]); sa != sb {
+			if sa {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	for _, k := range keys {
+		if isScalar(obj[k]) {
+			fmt.Fprintf(tw, "%s%s\t= %v\n", indent, k, obj[k])
+		}
+	}
+	tw.Flush()
+
+	for _, k := range keys {
+		switch v := obj[k].(type) {
+		case storcli.Object:
+			fmt.Fprintf(w, "\n%s%s :\n%s%s\n", indent, k, indent, strings.Repeat("=", len(k)+2))
+			writeObject(w, v, indent)
+		case []storcli.Object:
+			fmt.Fprintf(w, "\n%s%s :\n%s%s\n", indent, k, indent, strings.Repeat("=", len(k)+2))
+			writeList(w, k, v, indent)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func writeList(w io.Writer, name string, rows []storcli.Object, indent string) {
+	cols, ok := columns[name]
+	if !ok && len(rows) > 0 {
+		for k := range rows[0] {
+			cols = append(cols, k)
+		}
+		slices.Sort(cols)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	line := indent + strings.Repeat("-", 100)
+	fmt.Fprintln(tw, line)
+	fmt.Fprintln(tw, indent+strings.Join(cols, "\t")+"\t")
+	fmt.Fprintln(tw, line)
+	for _, row := range rows {
+		vals := make([]string, len(cols))
+		for i, c := range cols {
+			vals[i] = fmt.Sprint(row[c])
+			if row[c] == nil {
+				vals[i] = "-"
+			}
+		}
+		fmt.Fprintln(tw, indent+strings.Join(vals, "\t")+"\t")
+	}
+	fmt.Fprintln(tw, line)
+	tw.Flush()
+}
+
+func isScalar(v any) bool {
+	switch v.(type) {
+	case storcli.Object, []storcli.Object:
+		return false
+	}
+	return true
+}
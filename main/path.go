@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// All 表示路径中的 all, 例如 /call、/vall、/eall、/sall
+const All = -1
+
+// Path 是 storcli 风格的对象路径: /cX, /cX/vY, /cX/eY/sZ
+type Path struct {
+	Ctrl     int
+	Vd       int
+	Encl     int
+	Slot     int
+	HasVd    bool
+	HasDrive bool
+}
+
+// ParsePath 解析 /call、/c0、/c0/vall、/c0/v1、/c0/eall/sall、/c0/e252/s3 这样的路径
+func ParsePath(s string) (*Path, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.ToLower(s), "/"), "/")
+	p := &Path{}
+
+	var err error
+	if p.Ctrl, err = pathIndex(parts[0], "c"); err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", s, err)
+	}
+	switch len(parts) {
+	case 1:
+	case 2:
+		if p.Vd, err = pathIndex(parts[1], "v"); err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", s, err)
+		}
+		p.HasVd = true
+	case 3:
+		if p.Encl, err = pathIndex(parts[1], "e"); err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", s, err)
+		}
+		if p.Slot, err = pathIndex(parts[2], "s"); err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", s, err)
+		}
+		p.HasDrive = true
+	default:
+		return nil, fmt.Errorf("invalid path %q", s)
+	}
+	return p, nil
+}
+
+// pathIndex 解析 c0、vall 这样的一段, all 返回 All
+func pathIndex(part, prefix string) (int, error) {
+	if !strings.HasPrefix(part, prefix) {
+		return 0, fmt.Errorf("expected /%s<n> or /%sall, got /%s", prefix, prefix, part)
+	}
+	v := strings.TrimPrefix(part, prefix)
+	if v == "all" {
+		return All, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected /%s<n> or /%sall, got /%s", prefix, prefix, part)
+	}
+	return n, nil
+}
+
+func match(want, v int) bool {
+	return want == All || want == v
+}
+
+// SingleDrive 表示路径指定了一个控制器上的一块物理盘, 例如 /c0/e252/s3
+func (p *Path) SingleDrive() bool {
+	return p.HasDrive && p.Ctrl != All && p.Encl != All && p.Slot != All
+}
+
+func (p *Path) String() string {
+	idx := func(prefix string, n int) string {
+		if n == All {
+			return "/" + prefix + "all"
+		}
+		return fmt.Sprintf("/%s%d", prefix, n)
+	}
+	s := idx("c", p.Ctrl)
+	if p.HasVd {
+		s += idx("v", p.Vd)
+	}
+	if p.HasDrive {
+		s += idx("e", p.Encl) + idx("s", p.Slot)
+	}
+	return s
+}
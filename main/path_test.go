@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+	"github.com/ishmaelwanglin/megaraid/storcli"
+)
+
+func TestParsePath(t *testing.T) {
+	for s, want := range map[string]Path{
+		"/call":         {Ctrl: All},
+		"/c0":           {Ctrl: 0},
+		"/c1/vall":      {Ctrl: 1, Vd: All, HasVd: true},
+		"/c0/v2":        {Ctrl: 0, Vd: 2, HasVd: true},
+		"/c0/eall/sall": {Ctrl: 0, Encl: All, Slot: All, HasDrive: true},
+		"/C0/E252/S3":   {Ctrl: 0, Encl: 252, Slot: 3, HasDrive: true},
+	} {
+		p, err := ParsePath(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if *p != want {
+			t.Fatalf("%s: got %+v, want %+v", s, *p, want)
+		}
+	}
+	for _, s := range []string{"/", "/v0", "/c0/e252", "/c0/s1/e252", "/cx", "/c0/v-1", "/c0/e1/s1/x"} {
+		if _, err := ParsePath(s); err == nil {
+			t.Fatalf("%s must be rejected", s)
+		}
+	}
+}
+
+func TestFilterAndTable(t *testing.T) {
+	pd := func(eid uint16, slot uint8) collector.Pd {
+		info := &megaraid.MR_PD_INFO{EnclDeviceId: eid, SlotNumber: slot}
+		info.FwState = uint16(megaraid.MR_PD_STATE_ONLINE)
+		return collector.Pd{Info: info, Model: "ST1200MM0099"}
+	}
+	h := &collector.Host{
+		Ctrl: &megaraid.ControllerInfo{},
+		Pds:  []collector.Pd{pd(252, 0), pd(252, 1), pd(8, 0)},
+	}
+	p, _ := ParsePath("/c0/e252/sall")
+	if f := filter(h, p); len(f.Pds) != 2 || len(h.Pds) != 3 {
+		t.Fatalf("unexpected filter result %d", len(f.Pds))
+	}
+
+	data, err := command(context.Background(), nil, p, "show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := write(&buf, storcli.Render([]*collector.Host{h}, data), "table"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "Drive Information :") || strings.Count(out, "ST1200MM0099") != 2 || !strings.Contains(out, "252:1") {
+		t.Fatalf("unexpected table\n%s", out)
+	}
+	if _, err := command(context.Background(), nil, p, "set foo"); err == nil {
+		t.Fatal("unknown verb must be rejected")
+	}
+
+	// 修改状态的动作只能用于一块盘, 除非加 force
+	for path, ok := range map[string]bool{"/c0/e252/sall": false, "/call/e252/s1": false, "/c0/eall/s1": false, "/c0/e252/s1": true} {
+		p, _ := ParsePath(path)
+		if _, err := command(context.Background(), nil, p, "set offline"); (err == nil) != ok {
+			t.Errorf("%s set offline: %v", path, err)
+		}
+		if _, err := command(context.Background(), nil, p, "set offline force"); err != nil {
+			t.Errorf("%s set offline force: %v", path, err)
+		}
+		if _, err := command(context.Background(), nil, p, "start locate"); err != nil {
+			t.Errorf("%s start locate: %v", path, err)
+		}
+	}
+	if _, err := command(context.Background(), nil, p, "start locate force"); err == nil {
+		t.Error("force is only accepted for set")
+	}
+}
@@ -3,11 +3,16 @@ package megaraid
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -16,6 +21,7 @@ import (
 var (
 	// Beware: cannot use unsafe.Sizeof(megasas_iocpacket{}) due to Go struct padding!
 	MEGASAS_IOC_FIRMWARE = Iowr('M', 1, uintptr(binary.Size(megasas_iocpacket{})))
+	MEGASAS_IOC_GET_AEN  = Iow('M', 3, uintptr(binary.Size(megasas_aen{})))
 )
 
 // PackedBytes is a convenience method that will pack a megasas_iocpacket struct in little-endian
@@ -99,44 +105,182 @@ func (m *MegasasIoctl) ScanHosts() ([]uint16, error) {
 	return hosts, nil
 }
 
-func (m *MegasasIoctl) MFI_READ(instance *Instance, sdev ...*ScsiDevice) error {
+// MFI_READ 下发一条读数据的 DCMD, 见 mfiDcmd, 固件返回非 MFI_STAT_OK 时返回 MfiStatus.
+// 有 sdev 时 mbox 为 16 位的 device id, 否则使用 instance.Dcmd.MboxB
+func (m *MegasasIoctl) MFI_READ(ctx context.Context, instance *Instance, sdev ...*ScsiDevice) error {
+	if len(sdev) > 0 {
+		device_id := sdev[0].Channel*MEGASAS_MAX_DEV_PER_CHANNEL + sdev[0].DeviceId
+		instance.Dcmd.MboxB = [12]uint8{}
+		binary.LittleEndian.PutUint16(instance.Dcmd.MboxB[0:], device_id)
+	}
+	return m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ)
+}
+
+// setSgl 把 buf 切成最多 MAX_IOCTL_SGE 段(每段按 SGE_BUFFER_SIZE 对齐)填到 ioc.sgl,
+// 驱动会为每一段单独申请 DMA 内存, 大块数据分段可以避免一次申请过大的连续内存
+func (ioc *megasas_iocpacket) setSgl(buf []byte) uint8 {
+	if len(buf) == 0 {
+		return 0
+	}
+	chunk := (len(buf) + MAX_IOCTL_SGE - 1) / MAX_IOCTL_SGE
+	chunk = (chunk + SGE_BUFFER_SIZE - 1) / SGE_BUFFER_SIZE * SGE_BUFFER_SIZE
+
+	var count uint32
+	for off := 0; off < len(buf); off += chunk {
+		end := min(off+chunk, len(buf))
+		ioc.sgl[count] = Iovec{uint64(uintptr(unsafe.Pointer(&buf[off]))), uint64(end - off)}
+		count++
+	}
+	ioc.sge_count = count
+	return uint8(count)
+}
+
+// mfiDcmd 下发一条 DCMD, 12 字节的 instance.Dcmd.MboxB 全部作为 mbox, instance.Buf 为数据,
+// dir 为 MFI_FRAME_DIR_*, 固件返回非 MFI_STAT_OK 时返回 MfiStatus
+func (m *MegasasIoctl) mfiDcmd(ctx context.Context, instance *Instance, dir uint16) error {
 	ioc := megasas_iocpacket{host_no: instance.HostNo}
 
 	// Approximation of C union behaviour
 	dcmd := (*megasas_dcmd_frame)(unsafe.Pointer(&ioc.frame))
 
-	if len(sdev) > 0 {
-		device_id := sdev[0].Channel*MEGASAS_MAX_DEV_PER_CHANNEL + sdev[0].DeviceId
-		(*mbox_s)(unsafe.Pointer(&dcmd.mbox[0]))[0] = device_id
-	} else {
-		if instance.Dcmd.MboxB[0] > 0 {
-			(*mbox_b)(unsafe.Pointer(&dcmd.mbox[0]))[0] = instance.Dcmd.MboxB[0]
-		}
-	}
-
+	dcmd.mbox = instance.Dcmd.MboxB
 	dcmd.cmd = uint8(MFI_CMD_DCMD)
 	dcmd.cmd_status = MFI_STAT_INVALID_STATUS
 	dcmd.opcode = instance.Cmd.OpCode
 	dcmd.data_xfer_len = uint32(len(instance.Buf))
-	dcmd.sge_count = 1
-	dcmd.flags = MFI_FRAME_DIR_READ
-	dcmd.timeout = 0
+	dcmd.flags = dir
 	dcmd.pad_0 = 0
 
-	// ioc set dma
-	ioc.sge_count = 1
+	timeout, err := frameTimeout(ctx)
+	if err != nil {
+		return err
+	}
+	dcmd.timeout = timeout
+
 	ioc.sgl_off = uint32(unsafe.Offsetof(dcmd.sgl))
-	ioc.sgl[0] = Iovec{uint64(uintptr(unsafe.Pointer(&instance.Buf[0]))), uint64(len(instance.Buf))}
+	dcmd.sge_count = ioc.setSgl(instance.Buf)
 
 	iocBuf := ioc.PackedBytes()
-	// Note pointer to first item in iocBuf buffer
-	if err := Ioctl(uintptr(m.fd), MEGASAS_IOC_FIRMWARE, uintptr(unsafe.Pointer(&iocBuf[0]))); err != nil {
+	if err := m.submit(ctx, instance.HostNo, iocBuf, instance.Buf); err != nil {
 		return err
 	}
 
+	if status := iocBuf[iocFrameOffset+unsafe.Offsetof(dcmd.cmd_status)]; status != MFI_STAT_OK {
+		// 固件按 frame timeout 放弃命令时也是非 MFI_STAT_OK
+		if ctx != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return MfiStatus(status)
+	}
 	return nil
 }
 
+// frameTimeout 把 ctx 的 deadline 换算成 MFI frame 的 timeout(秒, 向上取整), 没有 deadline 时为 0(不超时),
+// ctx 已经结束时返回 ctx.Err()
+func frameTimeout(ctx context.Context) (uint16, error) {
+	if ctx == nil {
+		return 0, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	seconds := math.Ceil(time.Until(deadline).Seconds())
+	return uint16(min(max(seconds, 1), math.MaxUint16)), nil
+}
+
+// sleep 等待 d 或者 ctx 结束, 用于轮询后台操作的进度
+func sleep(ctx context.Context, d time.Duration) error {
+	if ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// submit 下发 MEGASAS_IOC_FIRMWARE. 驱动等待 ioctl 命令时没有超时, 控制器卡住时系统调用不会返回,
+// 所以 ctx 可以结束时在另一个 goroutine 里执行 ioctl, ctx 结束后直接返回 ctx.Err().
+// 被放弃的 ioctl 返回之前, iocBuf 和 bufs 会一直保持可达, 驱动仍然可以安全地写回数据
+func (m *MegasasIoctl) submit(ctx context.Context, hostNo uint16, iocBuf []byte, bufs ...[]byte) error {
+	return m.ioctl(ctx, hostNo, MEGASAS_IOC_FIRMWARE, iocBuf, bufs...)
+}
+
+// ErrHostBusy 表示 host 上有一条因为 ctx 结束而被放弃的命令还没有返回. 这期间不再向 host 下发新命令,
+// 避免在卡住的控制器上堆积命令, 也避免调用方重试一条仍在执行的写命令
+var ErrHostBusy = errors.New("a previous command has not returned yet")
+
+// ioctl 在 ctx 的控制下执行 cmd, 参数为 arg, 见 submit. ctx 结束时放弃等待, 但 host 在 ioctl 返回之前一直是忙的,
+// 新命令直接返回 ErrHostBusy, 每个 host 最多只有一个被放弃的 goroutine
+func (m *MegasasIoctl) ioctl(ctx context.Context, hostNo uint16, cmd uintptr, arg []byte, bufs ...[]byte) error {
+	if err := m.hostBusy(hostNo); err != nil {
+		return err
+	}
+	ioctl := func() error {
+		if m.sys != nil {
+			return m.sys(cmd, arg)
+		}
+		// Note pointer to first item in arg buffer
+		err := Ioctl(uintptr(m.fd), cmd, uintptr(unsafe.Pointer(&arg[0])))
+		// sgl 中的地址是 uintptr, GC 看不到, 需要显式保活
+		runtime.KeepAlive(bufs)
+		return err
+	}
+	if ctx == nil || ctx.Done() == nil {
+		return ioctl()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- ioctl() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// 命令可能恰好完成, 此时不标记为忙
+	select {
+	case err := <-done:
+		return err
+	default:
+	}
+	m.mu.Lock()
+	if m.inflight == nil {
+		m.inflight = make(map[uint16]bool)
+	}
+	m.inflight[hostNo] = true
+	m.mu.Unlock()
+	go func() {
+		<-done
+		m.mu.Lock()
+		delete(m.inflight, hostNo)
+		m.mu.Unlock()
+	}()
+	return ctx.Err()
+}
+
+// hostBusy 在 host 上有被放弃的命令还没返回时返回 ErrHostBusy
+func (m *MegasasIoctl) hostBusy(hostNo uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inflight[hostNo] {
+		return fmt.Errorf("host %d: %w", hostNo, ErrHostBusy)
+	}
+	return nil
+}
+
+// Instance 是一条命令的 host、数据缓冲区、opcode 和 mbox, 每个方法都会重新设置这些字段,
+// 同一个 Instance 不能在多个 goroutine 中同时使用, 并发时使用 Controller.
+// 超时和取消由每个方法的 ctx 控制, ctx 没有 deadline 时不超时
 type Instance struct {
 	HostNo uint16
 	Buf    []byte
@@ -148,11 +292,14 @@ type Instance struct {
 	}
 }
 
-func (m *MegasasIoctl) MegasasGetPdList(instance *Instance) ([]MR_PD_ADDRESS, error) {
+func (m *MegasasIoctl) MegasasGetPdList(ctx context.Context, instance *Instance) ([]MR_PD_ADDRESS, error) {
 	instance.Buf = make([]byte, unsafe.Sizeof(MR_PD_LIST{})*MEGASAS_MAX_PD)
 	instance.Cmd.OpCode = MR_DCMD_PD_LIST_QUERY
+	instance.Dcmd.MboxB = [12]uint8{}
 
-	m.MFI_READ(instance)
+	if err := m.MFI_READ(ctx, instance); err != nil {
+		return nil, err
+	}
 
 	respCount := binary.LittleEndian.Uint32(instance.Buf[4:])
 	if respCount == 0 {
@@ -171,11 +318,14 @@ type ScsiDevice struct {
 	DeviceId uint16 // did
 }
 
-func (m *MegasasIoctl) MegasasGetPdInfo(instance *Instance, sdev *ScsiDevice) (*MR_PD_INFO, error) {
+func (m *MegasasIoctl) MegasasGetPdInfo(ctx context.Context, instance *Instance, sdev *ScsiDevice) (*MR_PD_INFO, error) {
 	// 测试成功
 	instance.Buf = make([]byte, unsafe.Sizeof(MR_PD_INFO{}))
 	instance.Cmd.OpCode = MR_DCMD_PD_GET_INFO
-	m.MFI_READ(instance, sdev)
+	instance.Dcmd.MboxB = [12]uint8{}
+	if err := m.MFI_READ(ctx, instance, sdev); err != nil {
+		return nil, err
+	}
 
 	data := &MR_PD_INFO{}
 	if err := binary.Read(bytes.NewBuffer(instance.Buf), binary.LittleEndian, data); err != nil {
@@ -185,11 +335,12 @@ func (m *MegasasIoctl) MegasasGetPdInfo(instance *Instance, sdev *ScsiDevice) (*
 	return data, nil
 }
 
-func (m *MegasasIoctl) MegasasGetLdList(instance *Instance) (*MR_LD_LIST, error) {
+func (m *MegasasIoctl) MegasasGetLdList(ctx context.Context, instance *Instance) (*MR_LD_LIST, error) {
 	instance.Buf = make([]byte, unsafe.Sizeof(MR_LD_LIST{}))
 	instance.Cmd.OpCode = MR_DCMD_LD_GET_LIST
+	instance.Dcmd.MboxB = [12]uint8{}
 
-	if err := m.MFI_READ(instance); err != nil {
+	if err := m.MFI_READ(ctx, instance); err != nil {
 		return nil, err
 	}
 
@@ -203,19 +354,25 @@ func (m *MegasasIoctl) MegasasGetLdList(instance *Instance) (*MR_LD_LIST, error)
 }
 
 // 只能获取所有导出到OS的targetID，无关联关系，似乎没啥用
-func (m *MegasasIoctl) MegasasLdListQuery(instance *Instance, queryType uint8) error {
+func (m *MegasasIoctl) MegasasLdListQuery(ctx context.Context, instance *Instance, queryType uint8) error {
 
 	instance.Buf = make([]byte, unsafe.Sizeof(MR_LD_TARGETID_LIST{}))
 	instance.Cmd.OpCode = MR_DCMD_LD_LIST_QUERY
-	instance.Dcmd.MboxB[0] = MR_LD_QUERY_TYPE_EXPOSED_TO_HOST
-	m.MFI_READ(instance)
+	instance.Dcmd.MboxB = [12]uint8{}
+	instance.Dcmd.MboxB[0] = queryType
+	if err := m.MFI_READ(ctx, instance); err != nil {
+		return err
+	}
 
 	ldInfo := MR_LD_TARGETID_LIST{}
-	binary.Read(bytes.NewBuffer(instance.Buf[:]), binary.LittleEndian, &ldInfo)
+	if err := binary.Read(bytes.NewBuffer(instance.Buf[:]), binary.LittleEndian, &ldInfo); err != nil {
+		return err
+	}
 	fmt.Printf("export os targetID: ")
-	for i := 0; i < int(ldInfo.Count); i++ {
+	count := min(int(ldInfo.Count), len(ldInfo.TargetId))
+	for i := 0; i < count; i++ {
 		fmt.Printf("%d", ldInfo.TargetId[i])
-		if i != int(ldInfo.Count)-1 {
+		if i != count-1 {
 			fmt.Printf(",")
 		}
 	}
@@ -223,13 +380,161 @@ func (m *MegasasIoctl) MegasasLdListQuery(instance *Instance, queryType uint8) e
 	return nil
 }
 
-func (m *MegasasIoctl) MegasasGetCtrlInfo(instance *Instance) *megasas_ctrl_info {
-	instance.Buf = make([]byte, unsafe.Sizeof(megasas_ctrl_info{}))
-	instance.Cmd.OpCode = MR_DCMD_CTRL_GET_INFO
-	instance.Dcmd.MboxB[0] = 1
-	m.MFI_READ(instance)
-	data := megasas_ctrl_info{}
-	binary.Read(bytes.NewBuffer(instance.Buf), binary.LittleEndian, &data)
+// MegasasGetCtrlInfo 返回未解码的控制器信息, DCMD 失败时返回错误而不是全 0 的数据
+func (m *MegasasIoctl) MegasasGetCtrlInfo(ctx context.Context, instance *Instance) (*megasas_ctrl_info, error) {
+	return m.getCtrlInfo(ctx, instance)
+}
+
+// MegasasGetBbuStatus 读取 BBU 状态, 控制器没有 BBU 时固件返回 MfiStatus
+func (m *MegasasIoctl) MegasasGetBbuStatus(ctx context.Context, instance *Instance) (*MR_BBU_STATUS, error) {
+	instance.Buf = make([]byte, unsafe.Sizeof(MR_BBU_STATUS{}))
+	instance.Cmd.OpCode = MR_DCMD_BBU_GET_STATUS
+	instance.Dcmd.MboxB = [12]uint8{}
+	if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ); err != nil {
+		return nil, err
+	}
+
+	data := &MR_BBU_STATUS{}
+	if err := binary.Read(bytes.NewBuffer(instance.Buf), binary.LittleEndian, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// MegasasGetBbuCapacity 读取 BBU 的电量和容量, 没有 gas gauge 的 BBU 固件返回 MfiStatus
+func (m *MegasasIoctl) MegasasGetBbuCapacity(ctx context.Context, instance *Instance) (*MR_BBU_CAPACITY_INFO, error) {
+	instance.Buf = make([]byte, unsafe.Sizeof(MR_BBU_CAPACITY_INFO{}))
+	instance.Cmd.OpCode = MR_DCMD_BBU_GET_CAPACITY_INFO
+	instance.Dcmd.MboxB = [12]uint8{}
+	if err := m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_READ); err != nil {
+		return nil, err
+	}
+
+	data := &MR_BBU_CAPACITY_INFO{}
+	if err := binary.Read(bytes.NewBuffer(instance.Buf), binary.LittleEndian, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// MfiStatus 是固件返回的非 MFI_STAT_OK 完成码
+type MfiStatus uint8
+
+func (s MfiStatus) Error() string {
+	return fmt.Sprintf("mfi command failed with status %#02x", uint8(s))
+}
+
+// ScsiSenseError 是 SCSI 命令以 CHECK CONDITION 结束时返回的错误, Sense 为驱动拷贝回来的 sense data
+type ScsiSenseError struct {
+	Sense []byte
+}
+
+func (e *ScsiSenseError) Error() string {
+	key, asc, ascq := ParseSense(e.Sense)
+	return fmt.Sprintf("scsi check condition: sense key %#x, asc %#02x, ascq %#02x", key, asc, ascq)
+}
+
+// scsiPassthru 通过 MFI_CMD_LD_SCSI_IO(逻辑盘) 或 MFI_CMD_PD_SCSI_IO(物理盘) 下发一条 SCSI 命令,
+// 数据缓冲区使用 instance.Buf, dir 为 MFI_FRAME_DIR_*
+func (m *MegasasIoctl) scsiPassthru(ctx context.Context, instance *Instance, cmd uint8, targetId uint16, cdb []byte, dir uint16) error {
+	ioc := megasas_iocpacket{host_no: instance.HostNo}
+	sense := make([]byte, SCSI_SENSE_BUFFERSIZE)
+
+	// Approximation of C union behaviour
+	pthru := (*megasas_pthru_frame)(unsafe.Pointer(&ioc.frame))
+
+	pthru.cmd = cmd
+	pthru.cmd_status = MFI_STAT_INVALID_STATUS
+	pthru.target_id = uint8(targetId)
+	pthru.lun = 0
+	pthru.cdb_len = uint8(copy(pthru.cdb[:], cdb))
+	pthru.sense_len = uint8(len(sense))
+	pthru.flags = dir
+	pthru.pad_0 = 0
+
+	timeout, err := frameTimeout(ctx)
+	if err != nil {
+		return err
+	}
+	pthru.timeout = timeout
+
+	pthru.data_xfer_len = uint32(len(instance.Buf))
+	ioc.sgl_off = uint32(unsafe.Offsetof(pthru.sgl))
+	pthru.sge_count = ioc.setSgl(instance.Buf)
+
+	// 驱动从 frame[sense_off:] 读出用户态 sense buffer 的地址, 命令完成后把 sense data 拷贝回来
+	senseOff := unsafe.Offsetof(pthru.sense_buf_phys_addr_lo)
+	ioc.sense_off = uint32(senseOff)
+	ioc.sense_len = uint32(len(sense))
+	binary.LittleEndian.PutUint64(ioc.frame[senseOff:], uint64(uintptr(unsafe.Pointer(&sense[0]))))
+
+	iocBuf := ioc.PackedBytes()
+	if err := m.submit(ctx, instance.HostNo, iocBuf, instance.Buf, sense); err != nil {
+		return err
+	}
+
+	// 驱动只回写 cmd_status
+	switch status := iocBuf[iocFrameOffset+unsafe.Offsetof(pthru.cmd_status)]; status {
+	case MFI_STAT_OK:
+		return nil
+	case MFI_STAT_SCSI_DONE_WITH_ERROR:
+		return &ScsiSenseError{Sense: sense}
+	default:
+		if ctx != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return MfiStatus(status)
+	}
+}
+
+// MegasasLdInquiryVpd 通过 MFI_CMD_LD_SCSI_IO 向逻辑盘(targetId)发送 INQUIRY EVPD, 返回原始的 VPD page
+func (m *MegasasIoctl) MegasasLdInquiryVpd(ctx context.Context, instance *Instance, targetId uint8, page uint8) ([]byte, error) {
+	instance.Buf = make([]byte, 0xff)
+	cdb := []byte{SCSI_INQUIRY, 0x01, page, 0, uint8(len(instance.Buf)), 0}
+
+	if err := m.scsiPassthru(ctx, instance, MFI_CMD_LD_SCSI_IO, uint16(targetId), cdb, MFI_FRAME_DIR_READ); err != nil {
+		return nil, err
+	}
+	if instance.Buf[1] != page {
+		return nil, fmt.Errorf("vpd page %#02x: unexpected page code %#02x in response", page, instance.Buf[1])
+	}
+
+	return instance.Buf[:min(len(instance.Buf), 4+int(binary.BigEndian.Uint16(instance.Buf[2:4])))], nil
+}
+
+// LdVpd 是逻辑盘的 unit serial(0x80)、device identification(0x83) 和 block limits(0xB0)
+type LdVpd struct {
+	TargetId     uint8
+	SerialNumber string
+	WWN          string
+	Designators  []VpdDesignator
+	BlockLimits  *VpdBlockLimits // 固件不支持 0xB0 时为 nil
+}
+
+// MegasasGetLdVpd 读取逻辑盘的 VPD, WWN 与内核 /sys/block/sdX/device/wwid 中的一致
+func (m *MegasasIoctl) MegasasGetLdVpd(ctx context.Context, instance *Instance, targetId uint8) (*LdVpd, error) {
+	vpd := &LdVpd{TargetId: targetId}
+
+	page, err := m.MegasasLdInquiryVpd(ctx, instance, targetId, VPD_UNIT_SERIAL_NUMBER)
+	if err != nil {
+		return nil, err
+	}
+	if vpd.SerialNumber, err = ParseVpdPage80(page); err != nil {
+		return nil, err
+	}
+
+	if page, err = m.MegasasLdInquiryVpd(ctx, instance, targetId, VPD_DEVICE_IDENTIFICATION); err != nil {
+		return nil, err
+	}
+	if vpd.Designators, err = ParseVpdPage83(page); err != nil {
+		return nil, err
+	}
+	vpd.WWN = VpdWWN(vpd.Designators)
+
+	// block limits 是可选页
+	if page, err = m.MegasasLdInquiryVpd(ctx, instance, targetId, VPD_BLOCK_LIMITS); err == nil {
+		vpd.BlockLimits, _ = ParseVpdPageB0(page)
+	}
 
-	return &data
+	return vpd, nil
 }
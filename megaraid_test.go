@@ -2,13 +2,24 @@ package megaraid
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/dswarbrick/smart/utils"
+	"golang.org/x/sys/unix"
 )
 
 func TestScanHosts(t *testing.T) {
@@ -24,12 +35,13 @@ func TestScanHosts(t *testing.T) {
 	t.Log(hosts)
 }
 func TestMegasasGetPdList(t *testing.T) {
+	ctx := context.Background()
 	m, err := CreateMegasasIoctl()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer m.Close()
-	devices, err := m.MegasasGetPdList(&Instance{HostNo: 0})
+	devices, err := m.MegasasGetPdList(ctx, &Instance{HostNo: 0})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -59,6 +71,7 @@ func TestMegasasGetPdList(t *testing.T) {
 }
 
 func TestMegasasGetPdInfo(t *testing.T) {
+	ctx := context.Background()
 	m, err := CreateMegasasIoctl()
 	if err != nil {
 		t.Fatal(err)
@@ -72,13 +85,14 @@ func TestMegasasGetPdInfo(t *testing.T) {
 		DeviceId: 10,
 	}
 	// slotnumber不对
-	m.MegasasGetPdInfo(&instance, &sdev)
+	m.MegasasGetPdInfo(ctx, &instance, &sdev)
 	/*
 		did = 10
 		 /sys/class/scsi_host/host0/device/target0\:0\:10/0\:0\:10\:0/block/sdg
 	*/
 }
 func TestMegasasGetLdList(t *testing.T) {
+	ctx := context.Background()
 	m, err := CreateMegasasIoctl()
 	if err != nil {
 		t.Fatal(err)
@@ -87,9 +101,10 @@ func TestMegasasGetLdList(t *testing.T) {
 	instance := Instance{
 		HostNo: 0,
 	}
-	m.MegasasGetLdList(&instance)
+	m.MegasasGetLdList(ctx, &instance)
 }
 func TestMegasasLdListQuery(t *testing.T) {
+	ctx := context.Background()
 	m, err := CreateMegasasIoctl()
 	if err != nil {
 		t.Fatal(err)
@@ -98,10 +113,13 @@ func TestMegasasLdListQuery(t *testing.T) {
 	instance := Instance{
 		HostNo: 0,
 	}
-	m.MegasasLdListQuery(&instance, MR_LD_QUERY_TYPE_EXPOSED_TO_HOST)
+	if err := m.MegasasLdListQuery(ctx, &instance, MR_LD_QUERY_TYPE_EXPOSED_TO_HOST); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestMegasasGetCtrlInfo(t *testing.T) {
+	ctx := context.Background()
 	m, err := CreateMegasasIoctl()
 	if err != nil {
 		t.Fatal(err)
@@ -110,7 +128,9 @@ func TestMegasasGetCtrlInfo(t *testing.T) {
 	instance := Instance{
 		HostNo: 0,
 	}
-	m.MegasasGetCtrlInfo(&instance)
+	if _, err := m.MegasasGetCtrlInfo(ctx, &instance); err != nil {
+		t.Fatal(err)
+	}
 }
 func TestMRPDLIST(t *testing.T) {
 
@@ -459,3 +479,763 @@ func TestVPD(t *testing.T) {
 	fmt.Println(page)
 
 }
+
+func TestParseVpdPage83(t *testing.T) {
+	// 逻辑盘返回的 0x83: NAA 6 (16 字节) + T10 vendor id
+	data := []byte{
+		0x00, 0x83, 0x00, 0x30,
+		0x01, 0x03, 0x00, 0x10,
+		0x60, 0x06, 0x05, 0xb0, 0x0d, 0x0f, 0x3a, 0x20, 0x2c, 0x3d, 0x4e, 0x5f, 0x01, 0x02, 0x03, 0x04,
+		0x02, 0x01, 0x00, 0x18,
+		'A', 'V', 'A', 'G', 'O', ' ', ' ', ' ', 'M', 'R', '9', '3', '6', '1', '-', '8', 'i', ' ', ' ', ' ', ' ', ' ', ' ', ' ',
+	}
+
+	designators, err := ParseVpdPage83(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(designators) != 2 {
+		t.Fatalf("expected 2 designators, got %d", len(designators))
+	}
+	if wwn := VpdWWN(designators); wwn != "naa.600605b00d0f3a202c3d4e5f01020304" {
+		t.Fatalf("unexpected wwn %s", wwn)
+	}
+
+	for in, want := range map[string]string{
+		"5000C500A1B2C3D4":      "naa.5000c500a1b2c3d4",
+		" naa.5000C500A1B2C3D4": "naa.5000c500a1b2c3d4",
+		"0x5000c500a1b2c3d4":    "naa.5000c500a1b2c3d4",
+		"0025385B71B07E5A":      "eui.0025385b71b07e5a",
+		"t10.ATA     DISK":      "t10.ATA     DISK",
+		"NA":                    "",
+		"WWN-unknown":           "WWN-unknown",
+		"":                      "",
+	} {
+		if got := NormalizeWWN(in); got != want {
+			t.Errorf("NormalizeWWN(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseVpdPage80AndB0(t *testing.T) {
+	serial, err := ParseVpdPage80([]byte{0x00, 0x80, 0x00, 0x08, '0', '0', '2', '0', '3', 'a', 'f', ' '})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial != "00203af" {
+		t.Fatalf("unexpected serial %q", serial)
+	}
+
+	page := make([]byte, 64)
+	page[1], page[3] = VPD_BLOCK_LIMITS, 0x3c
+	binary.BigEndian.PutUint32(page[8:], 0x800)
+	binary.BigEndian.PutUint32(page[12:], 0x100)
+	binary.BigEndian.PutUint64(page[36:], 0xffff)
+	limits, err := ParseVpdPageB0(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.MaxTransferLength != 0x800 || limits.OptimalTransferLength != 0x100 || limits.MaxWriteSameLength != 0xffff {
+		t.Fatalf("unexpected block limits %+v", limits)
+	}
+}
+
+func TestControllerInfoDecode(t *testing.T) {
+	ctrl := megasas_ctrl_info{}
+	copy(ctrl.ProductName[:], "AVAGO MegaRAID SAS 9361-8i\x00\x00")
+	ctrl.DeviceInterface.Bits = 10
+	ctrl.RaidLevels.Bits = 0b10111
+	ctrl.AdapterOperations2.Bits = 1<<11 | 0b10<<25
+	ctrl.StripeSzOps.Min, ctrl.StripeSzOps.Max = 7, 11
+	ctrl.LockKeyBinding = 1
+
+	info := ctrl.Decode()
+	if info.ProductName != "AVAGO MegaRAID SAS 9361-8i" {
+		t.Fatalf("unexpected product name %q", info.ProductName)
+	}
+	if info.DeviceInterface.String() != "SAS/SATA" {
+		t.Fatalf("unexpected device interface %s", info.DeviceInterface)
+	}
+	if levels := fmt.Sprint(info.RaidLevels.Levels()); levels != "[0 1 5 6]" {
+		t.Fatalf("unexpected raid levels %s", levels)
+	}
+	if !info.AdapterOperations2.SupportJBOD || info.AdapterOperations2.ActivePassive != 2 {
+		t.Fatalf("unexpected adapter operations2 %+v", info.AdapterOperations2)
+	}
+	if info.MinStripeSize != 64*KB || info.MaxStripeSize != MB {
+		t.Fatalf("unexpected stripe size %d-%d", info.MinStripeSize, info.MaxStripeSize)
+	}
+	if !info.LockKeyBound {
+		t.Fatalf("lock key binding not decoded")
+	}
+}
+
+func TestFirmwareInventory(t *testing.T) {
+	ctrl := megasas_ctrl_info{}
+	copy(ctrl.PackageVersion[:], "24.21.0-0132")
+	ctrl.ImageComponentCount = 2
+	copy(ctrl.ImageComponent[0].Name[:], "APP ")
+	copy(ctrl.ImageComponent[0].Version[:], "4.680.00-8527")
+	copy(ctrl.ImageComponent[0].BuildDate[:], "Jun 1 2019")
+	copy(ctrl.ImageComponent[0].BuiltTime[:], "17:46:26")
+	copy(ctrl.ImageComponent[1].Name[:], "BIOS")
+	copy(ctrl.ImageComponent[1].Version[:], "6.36.00.3_4.19.08.00_0x06180203")
+	copy(ctrl.ImageComponent[1].BuildDate[:], "05/22/2019")
+
+	inv := ctrl.firmwareInventory()
+	if inv.PackageVersion != "24.21.0-0132" || len(inv.Components) != 2 || inv.RebootRequired {
+		t.Fatalf("unexpected inventory %+v", inv)
+	}
+	app := inv.Components[0]
+	if app.Name != "APP" || fmt.Sprint(app.Numbers) != "[4 680 0 8527]" {
+		t.Fatalf("unexpected component %+v", app)
+	}
+	if !app.Built.Equal(time.Date(2019, 6, 1, 17, 46, 26, 0, time.UTC)) {
+		t.Fatalf("unexpected build time %s", app.Built)
+	}
+	if inv.Components[1].Built.IsZero() {
+		t.Fatal("bios build date not parsed")
+	}
+
+	ctrl.PendingImageComponentCount = 1
+	copy(ctrl.PendingImageComponent[0].Name[:], "APP")
+	copy(ctrl.PendingImageComponent[0].Version[:], "4.740.00-8452")
+	if inv = ctrl.firmwareInventory(); !inv.RebootRequired {
+		t.Fatal("pending APP should require reboot")
+	}
+	if CompareVersion(inv.Pending[0].Version, app.Version) != 1 {
+		t.Fatal("pending version should be newer")
+	}
+}
+
+func TestVerifyFirmwareImage(t *testing.T) {
+	image := make([]byte, 256)
+	copy(image, []byte{0x55, 0xaa})
+	copy(image[0x40:], []byte{'P', 'C', 'I', 'R', 0x00, 0x10, 0x5d, 0x00})
+
+	if err := VerifyFirmwareImage(image, PciInfo{VendorId: 0x1000, DeviceId: 0x005d}); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFirmwareImage(image, PciInfo{VendorId: 0x1000, DeviceId: 0x0016}); err == nil {
+		t.Fatal("image for 1000:005d must not match 1000:0016")
+	}
+	if err := VerifyFirmwareImage(make([]byte, 256), PciInfo{VendorId: 0x1000, DeviceId: 0x005d}); err == nil {
+		t.Fatal("image without PCIR must be rejected")
+	}
+
+	ioc := megasas_iocpacket{}
+	if count := ioc.setSgl(make([]byte, FLASH_BUF_SIZE)); count != MAX_IOCTL_SGE || ioc.sgl[0].IovLen != SGE_BUFFER_SIZE {
+		t.Fatalf("unexpected sgl split: %d x %d", count, ioc.sgl[0].IovLen)
+	}
+}
+
+func TestWriteBufferCdb(t *testing.T) {
+	cdb := writeBufferCdb(WRITE_BUFFER_MODE_OFFSETS_SAVE, 0x30000, WRITE_BUFFER_CHUNK_SIZE)
+	want := []byte{0x3b, 0x07, 0x00, 0x03, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	if !bytes.Equal(cdb, want) {
+		t.Fatalf("unexpected cdb % x", cdb)
+	}
+}
+
+func TestParseSelfTestLogs(t *testing.T) {
+	scsi := make([]byte, 4+2*20)
+	scsi[0], scsi[3] = LOG_PAGE_SELF_TEST_RESULTS, 40
+	// 参数 1: 正在进行的 extended; 参数 2: 上一次 short 通过
+	copy(scsi[4:], []byte{0, 1, 3, 0x10, 2<<5 | 0xf, 1, 0x12, 0x34, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(scsi[24:], []byte{0, 2, 3, 0x10, 1 << 5, 2, 0x12, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	results, err := ParseScsiSelfTestLog(scsi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].InProgress() || results[0].Type != "extended" || !results[1].Passed() {
+		t.Fatalf("unexpected scsi results %+v", results)
+	}
+
+	ata := make([]byte, ATA_SECTOR_SIZE)
+	ata[508] = 2
+	copy(ata[2:], []byte{1, 0x00, 100, 0})                      // 第 1 条: short 通过
+	copy(ata[2+24:], []byte{2, 0x73, 200, 0, 0, 0x10, 0, 0, 0}) // 第 2 条: extended read failure
+	if results, err = ParseAtaSelfTestLog(ata); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != 7 || results[0].FailingLBA != 0x10 || results[1].Type != "short" {
+		t.Fatalf("unexpected ata results %+v", results)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	hdr := MR_CONFIG_DATA{ArrayCount: 1, LogDrvCount: 1,
+		ArraySize: uint16(binary.Size(MR_ARRAY{})), LogDrvSize: uint16(binary.Size(MR_LD_CONFIG{}))}
+	array := MR_ARRAY{NumDrives: 2, ArrayRef: 7}
+	array.Pd[0].Ref.DeviceId, array.Pd[1].Ref.DeviceId = 4, 5
+	ld := MR_LD_CONFIG{}
+	ld.Properties.Ref.TargetId = 1
+	ld.Params.SpanDepth = 1
+	ld.Span[0].ArrayRef = 7
+
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, hdr)
+	binary.Write(b, binary.LittleEndian, array)
+	binary.Write(b, binary.LittleEndian, ld)
+
+	cfg, err := ParseConfig(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref, ok := cfg.ArrayOf(5); !ok || ref != 7 {
+		t.Fatalf("pd 5 should be in array 7")
+	}
+	if _, ok := cfg.ArrayOf(6); ok {
+		t.Fatalf("pd 6 is not in any array")
+	}
+	if lds := cfg.LdsOfArray(7); len(lds) != 1 || lds[0] != 1 {
+		t.Fatalf("unexpected lds %v", lds)
+	}
+
+	// 固件的热备盘记录是 40 字节, 专用热备盘关联 array 7
+	if size := binary.Size(MR_SPARE{}); size != 40 {
+		t.Fatalf("MR_SPARE is %d bytes, want 40", size)
+	}
+	hdr.SparesCount, hdr.SparesSize = 1, 40
+	spare := make([]byte, 40)
+	binary.LittleEndian.PutUint16(spare[0:], 9)
+	spare[4], spare[7] = MR_SPARE_DEDICATED, 1
+	binary.LittleEndian.PutUint16(spare[8:], 7)
+	b.Reset()
+	binary.Write(b, binary.LittleEndian, hdr)
+	binary.Write(b, binary.LittleEndian, array)
+	binary.Write(b, binary.LittleEndian, ld)
+	b.Write(spare)
+	if cfg, err = ParseConfig(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if s := cfg.Spares[0]; s.Ref.DeviceId != 9 || s.SpareType != MR_SPARE_DEDICATED || s.ArrayCount != 1 || s.ArrayRef[0] != 7 {
+		t.Fatalf("unexpected spare %+v", s)
+	}
+
+	// 元素比 Go 结构体短时剩余字段为 0
+	hdr.SparesSize = 10
+	b.Reset()
+	binary.Write(b, binary.LittleEndian, hdr)
+	binary.Write(b, binary.LittleEndian, array)
+	binary.Write(b, binary.LittleEndian, ld)
+	b.Write(spare[:10])
+	if cfg, err = ParseConfig(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if s := cfg.Spares[0]; s.Ref.DeviceId != 9 || s.ArrayRef[0] != 7 || s.ArrayRef[1] != 0 {
+		t.Fatalf("unexpected short spare %+v", s)
+	}
+}
+
+func TestCheckErasable(t *testing.T) {
+	pd := &MR_PD_INFO{}
+	pd.Ref.DeviceId = 5
+	pd.FwState = uint16(MR_PD_STATE_UNCONFIGURED_GOOD)
+	if err := CheckErasable(pd, &Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Arrays: []MR_ARRAY{{NumDrives: 1}}}
+	cfg.Arrays[0].Pd[0].Ref.DeviceId = 5
+	if err := CheckErasable(pd, cfg); !errors.Is(err, ErrNotErasable) {
+		t.Fatalf("pd in array must not be erasable, got %v", err)
+	}
+
+	pd.FwState = uint16(MR_PD_STATE_ONLINE)
+	if err := CheckErasable(pd, &Config{}); !errors.Is(err, ErrNotErasable) {
+		t.Fatalf("online pd must not be erasable, got %v", err)
+	}
+
+	sense := make([]byte, 18)
+	sense[0], sense[2], sense[12], sense[13] = 0x70, 0x02, 0x04, 0x1b
+	sense[15], sense[16] = 0x80, 0x80
+	if percent, ok, err := SanitizeProgress(sense); err != nil || !ok || percent != 50 {
+		t.Fatalf("unexpected sanitize progress %d %t %v", percent, ok, err)
+	}
+	for _, c := range []struct {
+		name           string
+		key, asc, ascq uint8
+		failed         bool
+	}{
+		{"no sense", 0, 0, 0, false},
+		{"sanitize failed", 0x3, 0x31, 0x03, true},
+		{"hardware error", 0x4, 0x44, 0x00, true},
+		{"illegal request", 0x5, 0x20, 0x00, true},
+	} {
+		clear(sense)
+		sense[0], sense[2], sense[12], sense[13] = 0x70, c.key, c.asc, c.ascq
+		_, ok, err := SanitizeProgress(sense)
+		var senseErr *ScsiSenseError
+		if ok || c.failed != errors.As(err, &senseErr) {
+			t.Errorf("%s: in progress %t, err %v", c.name, ok, err)
+		}
+	}
+	if _, _, err := SanitizeProgress(make([]byte, SCSI_SENSE_BUFFERSIZE)); err != nil {
+		t.Errorf("empty sense must be done, got %v", err)
+	}
+
+	clearEvent := func(seq uint32, deviceId uint16, desc string) Event {
+		return Event{SeqNum: seq, Description: desc, Pd: &EventPd{DeviceId: deviceId}}
+	}
+	for _, c := range []struct {
+		name   string
+		events []Event
+		ok     bool
+	}{
+		{"completed", []Event{clearEvent(1, 5, "Clear started on PD 05(e0xfc/s3)"), clearEvent(2, 5, "Clear completed on PD 05(e0xfc/s3)")}, true},
+		{"aborted", []Event{clearEvent(1, 5, "Clear started on PD 05(e0xfc/s3)"), clearEvent(2, 5, "Clear aborted on PD 05(e0xfc/s3)")}, false},
+		{"with errors", []Event{clearEvent(2, 5, "Clear completed with errors on PD 05(e0xfc/s3)")}, false},
+		{"other pd", []Event{clearEvent(2, 6, "Clear completed on PD 06(e0xfc/s4)")}, false},
+		{"no event", nil, false},
+	} {
+		if err := ClearResult(c.events, 5); (err == nil) != c.ok {
+			t.Errorf("%s: ClearResult = %v", c.name, err)
+		}
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	cfg := &Config{Arrays: []MR_ARRAY{{NumDrives: 2, ArrayRef: 1}}, Lds: []MR_LD_CONFIG{{}}}
+	cfg.Arrays[0].Pd[0].Ref.DeviceId = 8
+	cfg.Arrays[0].Pd[1].Ref.DeviceId = 9
+	cfg.Lds[0].Properties.Ref.TargetId = 0
+	cfg.Lds[0].Params.SpanDepth = 1
+	cfg.Lds[0].Span[0].ArrayRef = 1
+
+	sed, plain := &MR_PD_INFO{Security: 0x05}, &MR_PD_INFO{}
+	sec, err := LdSecurityOf(cfg, map[uint16]*MR_PD_INFO{8: sed, 9: sed}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sec.Capable || !sec.Secured || sec.Locked || len(sec.Members) != 2 {
+		t.Fatalf("unexpected ld security %+v", sec)
+	}
+	sec, _ = LdSecurityOf(cfg, map[uint16]*MR_PD_INFO{8: sed, 9: plain}, 0)
+	if sec.Capable || sec.Secured {
+		t.Fatalf("ld with non-SED member must not be capable %+v", sec)
+	}
+	if _, err := LdSecurityOf(cfg, nil, 1); err == nil {
+		t.Fatal("missing ld must fail")
+	}
+}
+
+func TestController(t *testing.T) {
+	m := &MegasasIoctl{}
+	c := m.Controller(1)
+	if m.Controller(1) != c || m.Controller(2) == c || c.HostNo() != 1 {
+		t.Fatal("expected one handle per host")
+	}
+
+	var active, maxActive int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Do(context.Background(), func(m *MegasasIoctl, instance *Instance) error {
+				n := atomic.AddInt32(&active, 1)
+				for {
+					old := atomic.LoadInt32(&maxActive)
+					if n <= old || atomic.CompareAndSwapInt32(&maxActive, old, n) {
+						break
+					}
+				}
+				if instance.HostNo != 1 || instance.Buf != nil || instance.Dcmd.MboxB != [12]uint8{} {
+					t.Errorf("instance not fresh: %+v", instance)
+				}
+				instance.Buf = make([]byte, 8)
+				instance.Dcmd.MboxB[0] = 1
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&active, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if maxActive != 1 {
+		t.Errorf("expected commands to be serialized, %d ran at once", maxActive)
+	}
+
+	// nil ctx 不超时, 不能 panic
+	if err := c.Do(nil, func(*MegasasIoctl, *Instance) error { return nil }); err != nil {
+		t.Errorf("Do with nil ctx: %v", err)
+	}
+}
+
+func TestContextTimeout(t *testing.T) {
+	if timeout, err := frameTimeout(context.Background()); timeout != 0 || err != nil {
+		t.Errorf("no deadline: %d %v", timeout, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if timeout, err := frameTimeout(ctx); timeout != 2 || err != nil {
+		t.Errorf("1.5s deadline: %d %v", timeout, err)
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	m := &MegasasIoctl{fd: -1}
+	if _, err := m.MegasasGetBbuStatus(expired, &Instance{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded from an expired ctx, got %v", err)
+	}
+
+	// host 被占用时, 等锁也受 ctx 控制
+	c := m.Controller(0)
+	locked, release := make(chan struct{}), make(chan struct{})
+	go c.Do(context.Background(), func(*MegasasIoctl, *Instance) error {
+		close(locked)
+		<-release
+		return nil
+	})
+	<-locked
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetControllerInfo(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded while the host is busy, got %v", err)
+	}
+	close(release)
+
+	// 卡住的 ioctl 返回之前 host 一直是忙的, 新命令立即失败, 其他 host 不受影响
+	stuck, unstuck := make(chan struct{}), make(chan struct{})
+	m.sys = func(cmd uintptr, arg []byte) error {
+		// arg 以 megasas_iocpacket.host_no 开头
+		if binary.LittleEndian.Uint16(arg) == 1 {
+			close(stuck)
+			<-unstuck
+		}
+		return nil
+	}
+	short, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.Controller(1).GetBbuStatus(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded from a stuck ioctl, got %v", err)
+	}
+	<-stuck
+	if _, err := m.Controller(1).GetBbuStatus(context.Background()); !errors.Is(err, ErrHostBusy) {
+		t.Errorf("expected ErrHostBusy while the ioctl is stuck, got %v", err)
+	}
+	if _, err := m.Controller(2).GetBbuStatus(context.Background()); errors.Is(err, ErrHostBusy) {
+		t.Errorf("other hosts must not be busy: %v", err)
+	}
+	close(unstuck)
+	for deadline := time.Now().Add(5 * time.Second); m.hostBusy(1) != nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("host still busy after the ioctl returned")
+		}
+	}
+}
+
+func TestMfiReadStatus(t *testing.T) {
+	status := MFI_STAT_INVALID_DCMD
+	m := &MegasasIoctl{fd: -1, sys: func(cmd uintptr, arg []byte) error {
+		arg[iocFrameOffset+unsafe.Offsetof(megasas_dcmd_frame{}.cmd_status)] = status
+		return nil
+	}}
+	ctx := context.Background()
+	// 固件拒绝时数据是全 0, 不能当作有效的控制器信息
+	if _, err := m.MegasasGetCtrlInfo(ctx, &Instance{}); !errors.Is(err, MfiStatus(MFI_STAT_INVALID_DCMD)) {
+		t.Errorf("expected MfiStatus from a rejected DCMD, got %v", err)
+	}
+	if _, err := m.MegasasGetPdInfo(ctx, &Instance{}, &ScsiDevice{DeviceId: 8}); !errors.Is(err, MfiStatus(MFI_STAT_INVALID_DCMD)) {
+		t.Errorf("expected MfiStatus from a rejected pd info, got %v", err)
+	}
+	status = MFI_STAT_OK
+	if _, err := m.MegasasGetCtrlInfo(ctx, &Instance{}); err != nil {
+		t.Errorf("MFI_STAT_OK: %v", err)
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	pdInfo := &MR_PD_INFO{}
+	pdInfo.Ref.DeviceId, pdInfo.EnclDeviceId, pdInfo.SlotNumber = 8, 32, 1
+	pdInfo.FwState = uint16(MR_PD_STATE_REBUILD)
+	pdInfo.MediaErrCount = 3
+	pdInfo.CoercedSize = [2]uint32{2048, 0}
+	pdInfo.ProgInfo.Active[0] = MR_PD_PROGRESS_REBUILD
+	pdInfo.ProgInfo.Rbld.Mrprogress.Progress = 0x4000
+
+	cfg := &Config{Arrays: []MR_ARRAY{{ArrayRef: 5, NumDrives: 1}}, Lds: []MR_LD_CONFIG{{}}}
+	// fw_state 为 Online(0x18), 不能当作 enclosure id
+	cfg.Arrays[0].Pd[0].Ref.DeviceId, cfg.Arrays[0].Pd[0].FwState, cfg.Arrays[0].Pd[0].SlotNumber = 8, uint16(MR_PD_STATE_ONLINE), 1
+	cfg.Lds[0].Properties.Ref.TargetId = 1
+	cfg.Lds[0].Properties.DefaultCachePolicy = MR_LD_CACHE_WRITE_BACK
+	cfg.Lds[0].Params.PrimaryRaidLevel, cfg.Lds[0].Params.SpanDepth, cfg.Lds[0].Params.StripeSize = 1, 1, 7
+	cfg.Lds[0].Span[0].ArrayRef = 5
+
+	s := &Snapshot{
+		SchemaVersion: SnapshotSchemaVersion,
+		Time:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Controllers: []ControllerSnapshot{{
+			HostNo:        0,
+			Info:          &ControllerInfo{ProductName: "PERC H730P Mini"},
+			Pds:           []PdSnapshot{NewPdSnapshot(pdInfo)},
+			Lds:           []LdSnapshot{NewLdSnapshot(cfg, &LD_INFO{Ref: cfg.Lds[0].Properties.Ref, State: 2, Size: 2048}, []PdSnapshot{NewPdSnapshot(pdInfo)})},
+			BackgroundOps: NewBackgroundOps(pdInfo),
+		}},
+	}
+	ld := s.Controllers[0].Lds[0]
+	if ld.RaidLevel != "RAID1" || ld.StripeSize != 64*KB || len(ld.Spans) != 1 || ld.Spans[0].Drives[0] != (SpanDrive{8, 32, 1}) {
+		t.Fatalf("unexpected ld %+v", ld)
+	}
+	// PD 信息读取失败时不知道 enclosure
+	if l := NewLdSnapshot(cfg, &LD_INFO{Ref: cfg.Lds[0].Properties.Ref}, nil); l.Spans[0].Drives[0] != (SpanDrive{8, 0xffff, 1}) {
+		t.Fatalf("unexpected span drive without pd info %+v", l.Spans[0].Drives[0])
+	}
+	if ops := s.Controllers[0].BackgroundOps; len(ops) != 1 || ops[0].Operation != "Rebuild" || ops[0].Percent != 25 {
+		t.Fatalf("unexpected background ops %+v", ops)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := json.Marshal(got)
+	if !bytes.Equal(data, again) {
+		t.Errorf("round trip mismatch:\n%s\n%s", data, again)
+	}
+	if got.Controller(0).Pds[0].State != "Rebuild" || got.Controller(0).Pds[0].SizeBytes != 2048*SectorSz {
+		t.Errorf("unexpected pd %+v", got.Controller(0).Pds[0])
+	}
+
+	if _, err := UnmarshalSnapshot([]byte(`{"SchemaVersion": 2}`)); !errors.Is(err, ErrSnapshotSchema) {
+		t.Errorf("expected ErrSnapshotSchema, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	pd := func(wwn string, slot uint8, state string, media uint32) PdSnapshot {
+		return PdSnapshot{WWN: wwn, EnclDeviceId: 32, Slot: slot, State: state, Health: PdHealth{MediaErrors: media}}
+	}
+	old := &Snapshot{Controllers: []ControllerSnapshot{{
+		HostNo: 0,
+		Info:   &ControllerInfo{Firmware: &FirmwareInventory{PackageVersion: "25.5.8.0001"}},
+		Pds:    []PdSnapshot{pd("5000c500a1", 0, "Online", 0), pd("5000c500a2", 1, "Online", 5), pd("5000c500a3", 2, "Online", 0)},
+		Lds:    []LdSnapshot{{TargetId: 0, State: "Optimal", CurrentCachePolicy: MR_LD_CACHE_WRITE_BACK}},
+	}}}
+	new := &Snapshot{Controllers: []ControllerSnapshot{{
+		HostNo: 0,
+		Info:   &ControllerInfo{Firmware: &FirmwareInventory{PackageVersion: "25.5.9.0001"}},
+		Pds:    []PdSnapshot{pd("5000c500a1", 0, "Failed", 0), pd("5000c500a2", 1, "Online", 9), pd("5000c500a4", 2, "Rebuild", 0)},
+		Lds:    []LdSnapshot{{TargetId: 0, State: "Degraded"}},
+	}}}
+
+	var got []string
+	for _, c := range Diff(old, new) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"host 0 controller Firmware: 25.5.8.0001 -> 25.5.9.0001",
+		"host 0 pd 32:0 PdState: Online -> Failed",
+		"host 0 pd 32:1 ErrorCount MediaErrors: 5 -> 9",
+		"host 0 pd 32:2 PdInserted:  -> Rebuild",
+		"host 0 pd 32:2 PdRemoved: Online -> ",
+		"host 0 ld 0 LdState: Optimal -> Degraded",
+		"host 0 ld 0 Property CurrentCachePolicy: 1 -> 0",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected changes:\n%s", strings.Join(got, "\n"))
+	}
+
+	// 读取失败的盘和配置不算变化
+	new.Controllers[0].Pds = new.Controllers[0].Pds[:2]
+	new.Controllers[0].Errors = []string{"pd 7: timeout", "config: timeout"}
+	old.Controllers[0].Pds[2].DeviceId = 7
+	for _, c := range Diff(old, new) {
+		if c.Type == ChangePdRemoved || c.Type == ChangeProperty {
+			t.Errorf("unexpected change %s", c)
+		}
+	}
+	// 上次读取失败的盘和逻辑盘也不算插入或创建
+	old.Controllers[0].Errors = []string{"pd list: timeout", "ld list: timeout"}
+	old.Controllers[0].Pds, old.Controllers[0].Lds = nil, nil
+	new.Controllers[0].Errors = nil
+	for _, c := range Diff(old, new) {
+		if c.Type == ChangePdInserted || c.Type == ChangeLdCreated {
+			t.Errorf("unexpected change %s", c)
+		}
+	}
+	old.Controllers[0].Errors = []string{"pd 9: timeout"}
+	new.Controllers[0].Pds[1].DeviceId = 9
+	var inserted []string
+	for _, c := range Diff(old, new) {
+		if c.Type == ChangePdInserted {
+			inserted = append(inserted, c.Object)
+		}
+	}
+	if fmt.Sprint(inserted) != "[pd 32:0]" {
+		t.Errorf("only pds that were read last time can be inserted, got %v", inserted)
+	}
+
+	data, _ := json.Marshal(Change{Type: ChangePdState})
+	var c Change
+	if err := json.Unmarshal(data, &c); err != nil || c.Type != ChangePdState {
+		t.Errorf("change type round trip: %s %v", data, err)
+	}
+}
+
+func TestParseEventList(t *testing.T) {
+	if n := unsafe.Sizeof(MR_EVT_DETAIL{}); n != 256 {
+		t.Fatalf("sizeof MR_EVT_DETAIL = %d", n)
+	}
+
+	pd := MR_EVT_DETAIL{SeqNum: 100, TimeStamp: 86400, Code: 0x71, Locale: MR_EVT_LOCALE_PD, Class: MR_EVT_CLASS_WARNING, ArgType: MR_EVT_ARGS_PD}
+	binary.LittleEndian.PutUint16(pd.Args[0:], 8)
+	pd.Args[2], pd.Args[3] = 1, 3
+	copy(pd.Description[:], "Predictive failure: PD 08(e0x01/s3)")
+	boot := MR_EVT_DETAIL{SeqNum: 101, TimeStamp: 0xff00003c, Code: 0x51, Class: MR_EVT_CLASS_CRITICAL, ArgType: MR_EVT_ARGS_LD_STATE}
+	binary.LittleEndian.PutUint16(boot.Args[0:], 2)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, MR_EVT_LIST_HEADER{Count: 2})
+	binary.Write(&buf, binary.LittleEndian, pd)
+	binary.Write(&buf, binary.LittleEndian, boot)
+	buf.Write(make([]byte, 256)) // 缓冲区比返回的事件多
+
+	events, err := parseEventList(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events", len(events))
+	}
+	e := events[0]
+	if e.SeqNum != 100 || e.Class.String() != "warning" || e.Description != "Predictive failure: PD 08(e0x01/s3)" ||
+		!e.Time.Equal(time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)) || e.Object() != "pd did 8" || e.Pd.Slot != 3 {
+		t.Errorf("event = %+v", e)
+	}
+	e = events[1]
+	if !e.Time.IsZero() || e.SinceBoot != time.Minute || e.Object() != "ld 2" || e.Class.String() != "critical" {
+		t.Errorf("event = %+v", e)
+	}
+
+	if AllEvents.word() != 0x0000ffff || (EventFilter{Class: EventClass(MR_EVT_CLASS_DEBUG), Locale: MR_EVT_LOCALE_PD}).word() != 0xfe000002 {
+		t.Error("EventFilter.word")
+	}
+	binary.LittleEndian.PutUint32(buf.Bytes(), 100)
+	if _, err := parseEventList(buf.Bytes()); err == nil {
+		t.Error("count larger than buffer: want error")
+	}
+}
+
+func TestEventCursor(t *testing.T) {
+	info := &MR_EVT_LOG_INFO{NewestSeqNum: 500, OldestSeqNum: 100, ClearSeqNum: 50}
+	for _, c := range []struct {
+		name   string
+		reader EventReader
+		reason string
+		next   uint32
+	}{
+		{"in range", EventReader{Next: 300, ClearSeqNum: 50, clearKnown: true}, "", 300},
+		{"caught up", EventReader{Next: 501, ClearSeqNum: 50, clearKnown: true}, "", 501},
+		{"wrapped", EventReader{Next: 80, ClearSeqNum: 50, clearKnown: true}, "wrapped", 100},
+		{"cleared", EventReader{Next: 40, ClearSeqNum: 10, clearKnown: true}, "cleared", 100},
+		{"reset", EventReader{Next: 900, ClearSeqNum: 50, clearKnown: true}, "reset", 501},
+		// 新建的 reader 不知道 ClearSeqNum, 不报告清除
+		{"unknown clear", EventReader{Next: 300}, "", 300},
+	} {
+		r := c.reader
+		gap := r.sync(info)
+		if r.Next != c.next || r.ClearSeqNum != 50 {
+			t.Errorf("%s: next %d clear %d, want %d 50", c.name, r.Next, r.ClearSeqNum, c.next)
+		}
+		if (gap == nil) != (c.reason == "") || gap != nil && (gap.Reason != c.reason || gap.Expected != c.reader.Next || gap.Resumed != c.next) {
+			t.Errorf("%s: gap %v, want %q", c.name, gap, c.reason)
+		}
+	}
+	// 日志在 cursor 之后被清除, 从 clear 事件继续
+	r := EventReader{Next: 300, ClearSeqNum: 50, clearKnown: true}
+	if gap := r.sync(&MR_EVT_LOG_INFO{NewestSeqNum: 420, OldestSeqNum: 1, ClearSeqNum: 400}); gap == nil || gap.Reason != "cleared" || r.Next != 400 {
+		t.Errorf("cleared after cursor: gap %v, next %d", gap, r.Next)
+	}
+
+	// 事件没有处理成功时回到读取之前的位置, 再次读取时仍然报告清除
+	r2 := EventReader{}
+	r2.Seek(EventCursor{Next: 300, ClearSeqNum: 50})
+	if gap := r2.sync(&MR_EVT_LOG_INFO{NewestSeqNum: 420, OldestSeqNum: 1, ClearSeqNum: 400}); gap == nil || gap.Reason != "cleared" || r2.Cursor() != r.Cursor() {
+		t.Errorf("seek: gap %v, cursor %+v", gap, r2.Cursor())
+	}
+
+	path := t.TempDir() + "/cursor"
+	cp, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cp.Get("SV1"); ok {
+		t.Fatal("empty checkpoint has cursor")
+	}
+	if err := cp.Save("SV1", r.Cursor()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Save("SV2", EventCursor{Next: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err = OpenCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := cp.Get("SV1"); !ok || c != (EventCursor{Next: 400, ClearSeqNum: 400}) {
+		t.Errorf("SV1 = %+v", c)
+	}
+	if c, _ := cp.Get("SV2"); c.Next != 7 {
+		t.Errorf("SV2 = %+v", c)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) != 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+
+	os.WriteFile(path, []byte("{"), 0644)
+	if _, err := OpenCheckpoint(path); err == nil {
+		t.Error("corrupt checkpoint: want error")
+	}
+}
+
+func TestAenAsync(t *testing.T) {
+	// 与 linux/megaraid_sas.h 中 _IOW('M', 3, struct megasas_aen) 一致
+	if MEGASAS_IOC_GET_AEN != 0x400c4d03 {
+		t.Errorf("MEGASAS_IOC_GET_AEN = %#x", MEGASAS_IOC_GET_AEN)
+	}
+
+	// 用管道代替 ioctl 节点, 管道可读时内核同样发送 SIGIO
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	m := &MegasasIoctl{fd: p[0]}
+	async := func() bool {
+		flags, err := unix.FcntlInt(uintptr(p[0]), unix.F_GETFL, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return flags&unix.O_ASYNC != 0
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGIO)
+	defer signal.Stop(sig)
+	for i := 0; i < 2; i++ {
+		if err := m.enableAsync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unix.Write(p[1], []byte{0})
+	select {
+	case <-sig:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no SIGIO")
+	}
+
+	m.disableAsync()
+	if !async() {
+		t.Error("O_ASYNC cleared while still in use")
+	}
+	m.disableAsync()
+	if async() {
+		t.Error("O_ASYNC not cleared")
+	}
+}
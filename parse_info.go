@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"strings"
 )
 
 func SizeOfDisk(sectors uint64, unit string) uint64 {
@@ -104,3 +105,184 @@ func ParseVpdPage83Jbod(data []byte) string {
 	}
 	return "no valid WWN found"
 }
+
+// ParseSense 解析 fixed(0x70/0x71) 或 descriptor(0x72/0x73) 格式的 sense data
+func ParseSense(sense []byte) (key, asc, ascq uint8) {
+	if len(sense) < 4 {
+		return 0, 0, 0
+	}
+	switch sense[0] & 0x7f {
+	case 0x72, 0x73:
+		return sense[1] & 0x0f, sense[2], sense[3]
+	case 0x70, 0x71:
+		if len(sense) < 14 {
+			return sense[2] & 0x0f, 0, 0
+		}
+		return sense[2] & 0x0f, sense[12], sense[13]
+	}
+	return 0, 0, 0
+}
+
+// ParseVpdPage80 解析 SCSI VPD Page 0x80 (Unit Serial Number)
+func ParseVpdPage80(data []byte) (string, error) {
+	if len(data) < 4 || data[1] != VPD_UNIT_SERIAL_NUMBER {
+		return "", fmt.Errorf("invalid vpd page 0x80")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if 4+length > len(data) {
+		return "", fmt.Errorf("vpd page 0x80 truncated: need %d bytes, got %d", 4+length, len(data))
+	}
+	return trimString(data[4 : 4+length]), nil
+}
+
+// VpdDesignator 是 VPD Page 0x83 中的一条 designation descriptor
+type VpdDesignator struct {
+	CodeSet     uint8 // 1: binary 2: ascii 3: utf-8
+	Association uint8 // 0: logical unit 1: target port 2: target device
+	Type        uint8 // VPD_DESIGNATOR_*
+	Identifier  []byte
+}
+
+// String 按内核 wwid 的格式返回标识, 比如 naa.600605b00d0f3a20..., 不认识的类型返回空串
+func (d *VpdDesignator) String() string {
+	switch d.Type {
+	case VPD_DESIGNATOR_NAA:
+		return fmt.Sprintf("naa.%x", d.Identifier)
+	case VPD_DESIGNATOR_EUI64:
+		return fmt.Sprintf("eui.%x", d.Identifier)
+	case VPD_DESIGNATOR_T10_VENDOR_ID:
+		return "t10." + trimString(d.Identifier)
+	case VPD_DESIGNATOR_SCSI_NAME:
+		return trimString(d.Identifier)
+	}
+	return ""
+}
+
+// NormalizeWWN 把 storcli 等工具输出的 WWN 转成 VpdDesignator.String 的格式, 例如 5000C500A1B2C3D4 转为 naa.5000c500a1b2c3d4,
+// 这样不同来源的同一块盘得到相同的 PdKey. 已经带类型前缀的原样返回(十六进制转成小写), NA 等占位符返回空串
+func NormalizeWWN(wwn string) string {
+	wwn = strings.TrimSpace(wwn)
+	if prefix, id, ok := strings.Cut(wwn, "."); ok {
+		switch strings.ToLower(prefix) {
+		case "naa", "eui":
+			return strings.ToLower(prefix) + "." + strings.ToLower(id)
+		}
+		return wwn
+	}
+	wwn = strings.TrimPrefix(strings.TrimPrefix(wwn, "0x"), "0X")
+	switch wwn {
+	case "", "NA", "N/A", "-":
+		// 没有 WWN, PdKey 退回到序列号
+		return ""
+	}
+	if strings.Trim(wwn, "0123456789abcdefABCDEF") != "" {
+		return wwn
+	}
+	// NAA 标识的第一个十六进制数字是 NAA 类型, 8 字节的 IEEE 扩展/注册格式为 2、3、5, 16 字节的注册扩展格式为 6
+	switch wwn[0] {
+	case '2', '3', '5', '6':
+		return "naa." + strings.ToLower(wwn)
+	}
+	return "eui." + strings.ToLower(wwn)
+}
+
+// ParseVpdPage83 解析 SCSI VPD Page 0x83 (Device Identification) 的全部 designator,
+// 不同于 ParseVpdPage83Jbod, 这里保留完整的 identifier, RAID 逻辑盘常见的 16 字节 NAA 6 不会被截断
+func ParseVpdPage83(data []byte) ([]VpdDesignator, error) {
+	if len(data) < 4 || data[1] != VPD_DEVICE_IDENTIFICATION {
+		return nil, fmt.Errorf("invalid vpd page 0x83")
+	}
+	end := 4 + int(binary.BigEndian.Uint16(data[2:4]))
+	if end > len(data) {
+		end = len(data)
+	}
+
+	var designators []VpdDesignator
+	for offset := 4; offset+4 <= end; {
+		length := int(data[offset+3])
+		if offset+4+length > end {
+			return designators, fmt.Errorf("vpd page 0x83: designator at offset %d truncated", offset)
+		}
+		designators = append(designators, VpdDesignator{
+			CodeSet:     data[offset] & 0x0f,
+			Association: (data[offset+1] >> 4) & 0x3,
+			Type:        data[offset+1] & 0x0f,
+			Identifier:  data[offset+4 : offset+4+length],
+		})
+		offset += 4 + length
+	}
+	return designators, nil
+}
+
+// VpdWWN 从逻辑单元关联的 designator 中挑选 WWN: NAA 优先(越长越好), 其次 EUI-64、SCSI name string、T10 vendor id
+func VpdWWN(designators []VpdDesignator) string {
+	priority := map[uint8]int{
+		VPD_DESIGNATOR_NAA:           4,
+		VPD_DESIGNATOR_EUI64:         3,
+		VPD_DESIGNATOR_SCSI_NAME:     2,
+		VPD_DESIGNATOR_T10_VENDOR_ID: 1,
+	}
+
+	var best *VpdDesignator
+	for i := range designators {
+		d := &designators[i]
+		if d.Association != 0 || priority[d.Type] == 0 {
+			continue
+		}
+		if best == nil || priority[d.Type] > priority[best.Type] ||
+			(d.Type == best.Type && len(d.Identifier) > len(best.Identifier)) {
+			best = d
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.String()
+}
+
+// VpdBlockLimits 是 SCSI VPD Page 0xB0 (Block Limits), 长度单位都是逻辑块
+type VpdBlockLimits struct {
+	MaxCompareAndWriteLength       uint8
+	OptimalTransferGranularity     uint16
+	MaxTransferLength              uint32
+	OptimalTransferLength          uint32
+	MaxPrefetchLength              uint32
+	MaxUnmapLbaCount               uint32
+	MaxUnmapBlockDescriptorCount   uint32
+	OptimalUnmapGranularity        uint32
+	UnmapGranularityAlignmentValid bool
+	UnmapGranularityAlignment      uint32
+	MaxWriteSameLength             uint64
+}
+
+// ParseVpdPageB0 解析 SCSI VPD Page 0xB0, 老设备只返回前 12/16 字节, 缺失的字段保持 0
+func ParseVpdPageB0(data []byte) (*VpdBlockLimits, error) {
+	if len(data) < 4 || data[1] != VPD_BLOCK_LIMITS {
+		return nil, fmt.Errorf("invalid vpd page 0xb0")
+	}
+	data = data[:min(len(data), 4+int(binary.BigEndian.Uint16(data[2:4])))]
+	if len(data) < 12 {
+		return nil, fmt.Errorf("vpd page 0xb0 truncated: got %d bytes", len(data))
+	}
+
+	limits := &VpdBlockLimits{
+		MaxCompareAndWriteLength:   data[5],
+		OptimalTransferGranularity: binary.BigEndian.Uint16(data[6:8]),
+		MaxTransferLength:          binary.BigEndian.Uint32(data[8:12]),
+	}
+	if len(data) >= 16 {
+		limits.OptimalTransferLength = binary.BigEndian.Uint32(data[12:16])
+	}
+	if len(data) >= 36 {
+		limits.MaxPrefetchLength = binary.BigEndian.Uint32(data[16:20])
+		limits.MaxUnmapLbaCount = binary.BigEndian.Uint32(data[20:24])
+		limits.MaxUnmapBlockDescriptorCount = binary.BigEndian.Uint32(data[24:28])
+		limits.OptimalUnmapGranularity = binary.BigEndian.Uint32(data[28:32])
+		limits.UnmapGranularityAlignmentValid = data[32]&0x80 != 0
+		limits.UnmapGranularityAlignment = binary.BigEndian.Uint32(data[32:36]) & 0x7fffffff
+	}
+	if len(data) >= 44 {
+		limits.MaxWriteSameLength = binary.BigEndian.Uint64(data[36:44])
+	}
+	return limits, nil
+}
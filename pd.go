@@ -0,0 +1,44 @@
+package megaraid
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+// pdRefDcmd 下发 mbox 为 PD ref(deviceId, seqNum) 的无数据 DCMD
+func (m *MegasasIoctl) pdRefDcmd(ctx context.Context, instance *Instance, opcode uint32, pdInfo *MR_PD_INFO) error {
+	instance.Buf = nil
+	instance.Cmd.OpCode = opcode
+	instance.Dcmd.MboxB = [12]uint8{}
+	binary.LittleEndian.PutUint16(instance.Dcmd.MboxB[0:], pdInfo.Ref.DeviceId)
+	binary.LittleEndian.PutUint16(instance.Dcmd.MboxB[2:], pdInfo.Ref.SeqNum)
+	return m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_NONE)
+}
+
+// MegasasLocatePd 点亮或熄灭物理盘的定位灯
+func (m *MegasasIoctl) MegasasLocatePd(ctx context.Context, instance *Instance, deviceId uint16, on bool) error {
+	pdInfo, err := m.MegasasGetPdInfo(ctx, instance, &ScsiDevice{DeviceId: deviceId})
+	if err != nil {
+		return err
+	}
+	opcode := uint32(MR_DCMD_PD_LOCATE_STOP)
+	if on {
+		opcode = MR_DCMD_PD_LOCATE_START
+	}
+	return m.pdRefDcmd(ctx, instance, opcode, pdInfo)
+}
+
+// MegasasSetPdState 修改物理盘状态, state 为 MR_PD_STATE_*, 例如把 UBad 置为 UGood
+func (m *MegasasIoctl) MegasasSetPdState(ctx context.Context, instance *Instance, deviceId uint16, state uint8) error {
+	pdInfo, err := m.MegasasGetPdInfo(ctx, instance, &ScsiDevice{DeviceId: deviceId})
+	if err != nil {
+		return err
+	}
+	instance.Buf = nil
+	instance.Cmd.OpCode = MR_DCMD_PD_SET_STATE
+	instance.Dcmd.MboxB = [12]uint8{}
+	binary.LittleEndian.PutUint16(instance.Dcmd.MboxB[0:], pdInfo.Ref.DeviceId)
+	binary.LittleEndian.PutUint16(instance.Dcmd.MboxB[2:], pdInfo.Ref.SeqNum)
+	binary.LittleEndian.PutUint16(instance.Dcmd.MboxB[4:], uint16(state))
+	return m.mfiDcmd(ctx, instance, MFI_FRAME_DIR_NONE)
+}
@@ -0,0 +1,93 @@
+package redfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+// Handler 以只读的 Redfish REST 接口提供 Resources, 每次请求都重新采集, 挂载在 Root 下
+type Handler struct {
+	mu sync.Mutex
+	b  collector.Backend
+}
+
+func NewHandler(b collector.Backend) *Handler {
+	return &Handler{b: b}
+}
+
+func (h *Handler) gather(ctx context.Context) ([]*collector.Host, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hostNos, err := h.b.ScanHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 与 storcli 的 /cX 一致, 控制器编号为排序后的下标
+	sort.Slice(hostNos, func(i, j int) bool { return hostNos[i] < hostNos[j] })
+
+	var hosts []*collector.Host
+	for _, hostNo := range hostNos {
+		host, err := h.b.Gather(ctx, hostNo)
+		if err != nil {
+			return nil, fmt.Errorf("host %d: %w", hostNo, err)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, http.StatusMethodNotAllowed, "Base.1.0.OperationNotAllowed", "the resource is read-only")
+		return
+	}
+
+	hosts, err := h.gather(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Base.1.0.InternalError", err.Error())
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	res, ok := Resources(hosts)[path]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "Base.1.0.ResourceMissingAtURI", fmt.Sprintf("%s not found", r.URL.Path))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, res)
+}
+
+// writeJSON 写 JSON 响应, HEAD 请求只有和 GET 相同的头部, 没有 body
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data = append(data, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("OData-Version", "4.0")
+	w.WriteHeader(code)
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// writeError 返回 Redfish 的错误响应
+func writeError(w http.ResponseWriter, r *http.Request, code int, id, message string) {
+	writeJSON(w, r, code, Resource{"error": Resource{
+		"code":    id,
+		"message": message,
+	}})
+}
@@ -0,0 +1,376 @@
+// Package redfish 把控制器、逻辑盘、物理盘和 enclosure 映射成 DMTF Redfish 的 Storage、StorageController、
+// Volume、Drive 和 Chassis 资源, 形状与 BMC 提供的 Redfish 一致, 方便和带外的数据对比.
+// Storage 挂在唯一的 ComputerSystem Systems/1 下, 客户端从 ServiceRoot 开始遍历
+package redfish
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+const (
+	Root        = "/redfish/v1"
+	SystemsRoot = Root + "/Systems"
+	// SystemRoot 是本机的 ComputerSystem, 只有一个
+	SystemRoot  = SystemsRoot + "/1"
+	StorageRoot = SystemRoot + "/Storage"
+	ChassisRoot = Root + "/Chassis"
+)
+
+// Resource 是一个 Redfish 资源的 JSON 对象
+type Resource = map[string]any
+
+// Redfish 的 Status.Health
+const (
+	OK       = "OK"
+	Warning  = "Warning"
+	Critical = "Critical"
+)
+
+func link(id string) Resource {
+	return Resource{"@odata.id": id}
+}
+
+func links(ids []string) []Resource {
+	l := []Resource{}
+	for _, id := range ids {
+		l = append(l, link(id))
+	}
+	return l
+}
+
+func collection(id, odataType, name string, members []string) Resource {
+	return Resource{
+		"@odata.id":           id,
+		"@odata.type":         odataType,
+		"Name":                name,
+		"Members":             links(members),
+		"Members@odata.count": len(members),
+	}
+}
+
+// worse 返回两个 Health 中更差的一个
+func worse(a, b string) string {
+	rank := map[string]int{OK: 0, Warning: 1, Critical: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// StorageId 是控制器的 Storage 资源 Id, c 为控制器编号
+func StorageId(c int) string {
+	return fmt.Sprintf("c%d", c)
+}
+
+// DriveId 是物理盘在 Storage 下的 Id, 与 storcli 的 /eY/sZ 对应
+func DriveId(info *megaraid.MR_PD_INFO) string {
+	return fmt.Sprintf("e%d.s%d", info.EnclDeviceId, info.SlotNumber)
+}
+
+// EnclosureId 是 enclosure 的 Chassis 资源 Id
+func EnclosureId(c int, eid uint16) string {
+	return fmt.Sprintf("Enclosure.c%d.e%d", c, eid)
+}
+
+// Resources 生成所有资源, key 为 @odata.id, 控制器编号 c 为 hosts 中的下标
+func Resources(hosts []*collector.Host) map[string]Resource {
+	res := map[string]Resource{}
+	var storages, chassis []string
+
+	for c, h := range hosts {
+		sid := StorageRoot + "/" + StorageId(c)
+		storages = append(storages, sid)
+
+		health := OK
+		drives := map[uint16]string{}
+		var driveIds []string
+		for _, pd := range h.Pds {
+			id := sid + "/Drives/" + DriveId(pd.Info)
+			drives[pd.Info.Ref.DeviceId] = id
+			driveIds = append(driveIds, id)
+		}
+
+		var volumeIds []string
+		volumesOfDrive := map[string][]string{}
+		for i := range h.Lds {
+			ld := &h.Lds[i]
+			id := fmt.Sprintf("%s/Volumes/%d", sid, ld.Ref.TargetId)
+			volumeIds = append(volumeIds, id)
+
+			var members []string
+			for _, deviceId := range ldMembers(h.Config, ld.Ref.TargetId) {
+				if d, ok := drives[deviceId]; ok {
+					members = append(members, d)
+					volumesOfDrive[d] = append(volumesOfDrive[d], id)
+				}
+			}
+			v := Volume(h, ld, members)
+			v["@odata.id"] = id
+			res[id] = v
+			health = worse(health, v["Status"].(Resource)["Health"].(string))
+		}
+
+		var enclIds []string
+		for _, e := range h.Enclosures {
+			id := ChassisRoot + "/" + EnclosureId(c, e.DeviceId)
+			enclIds = append(enclIds, id)
+			chassis = append(chassis, id)
+			res[id] = Enclosure(h, e, id, sid)
+		}
+
+		for _, pd := range h.Pds {
+			id := drives[pd.Info.Ref.DeviceId]
+			d := Drive(pd, volumesOfDrive[id])
+			d["@odata.id"] = id
+			if pd.Info.EnclDeviceId != 0xffff {
+				d["Links"].(Resource)["Chassis"] = link(ChassisRoot + "/" + EnclosureId(c, pd.Info.EnclDeviceId))
+			}
+			res[id] = d
+			health = worse(health, d["Status"].(Resource)["Health"].(string))
+		}
+
+		ctrlId := sid + "/Controllers/0"
+		ctrl := StorageController(h)
+		ctrl["@odata.id"] = ctrlId
+		res[ctrlId] = ctrl
+		res[sid+"/Controllers"] = collection(sid+"/Controllers", "#StorageControllerCollection.StorageControllerCollection", "Storage Controller Collection", []string{ctrlId})
+		res[sid+"/Volumes"] = collection(sid+"/Volumes", "#VolumeCollection.VolumeCollection", "Volume Collection", volumeIds)
+
+		res[sid] = Resource{
+			"@odata.id":   sid,
+			"@odata.type": "#Storage.v1_15_0.Storage",
+			"Id":          StorageId(c),
+			"Name":        h.Ctrl.ProductName,
+			"Status":      Resource{"State": "Enabled", "Health": ctrl["Status"].(Resource)["Health"], "HealthRollup": worse(health, ctrl["Status"].(Resource)["Health"].(string))},
+			"Controllers": link(sid + "/Controllers"),
+			"Drives":      links(driveIds),
+			"Volumes":     link(sid + "/Volumes"),
+			"Links":       Resource{"Enclosures": links(enclIds)},
+		}
+	}
+
+	res[StorageRoot] = collection(StorageRoot, "#StorageCollection.StorageCollection", "Storage Collection", storages)
+	res[ChassisRoot] = collection(ChassisRoot, "#ChassisCollection.ChassisCollection", "Chassis Collection", chassis)
+	res[SystemsRoot] = collection(SystemsRoot, "#ComputerSystemCollection.ComputerSystemCollection", "Computer System Collection", []string{SystemRoot})
+	res[SystemRoot] = Resource{
+		"@odata.id":   SystemRoot,
+		"@odata.type": "#ComputerSystem.v1_10_0.ComputerSystem",
+		"Id":          "1",
+		"Name":        "Computer System",
+		"Storage":     link(StorageRoot),
+	}
+	// 客户端从 ServiceRoot 开始按链接遍历资源
+	res[Root] = Resource{
+		"@odata.id":      Root,
+		"@odata.type":    "#ServiceRoot.v1_5_0.ServiceRoot",
+		"Id":             "RootService",
+		"Name":           "Root Service",
+		"RedfishVersion": "1.8.0",
+		"Systems":        link(SystemsRoot),
+		"Chassis":        link(ChassisRoot),
+	}
+	return res
+}
+
+// ldMembers 返回逻辑盘成员盘的 deviceId, 没有 RAID 配置时为空
+func ldMembers(cfg *megaraid.Config, targetId uint8) []uint16 {
+	if cfg == nil {
+		return nil
+	}
+	var ids []uint16
+	for i := range cfg.Lds {
+		ld := &cfg.Lds[i]
+		if ld.Properties.Ref.TargetId != targetId {
+			continue
+		}
+		for s := 0; s < int(ld.Params.SpanDepth) && s < len(ld.Span); s++ {
+			for a := range cfg.Arrays {
+				array := &cfg.Arrays[a]
+				if array.ArrayRef != ld.Span[s].ArrayRef {
+					continue
+				}
+				for p := 0; p < int(array.NumDrives) && p < len(array.Pd); p++ {
+					ids = append(ids, array.Pd[p].Ref.DeviceId)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// StorageController 对应 StorageController 资源
+func StorageController(h *collector.Host) Resource {
+	ctrl := h.Ctrl
+	health := OK
+	if ctrl.MemUncorrectableErrorCount > 0 {
+		health = Critical
+	} else if h.Bbu != nil && !h.Bbu.Healthy() {
+		health = Warning
+	}
+
+	var fw string
+	if ctrl.Firmware != nil {
+		fw = ctrl.Firmware.PackageVersion
+	}
+	protocols := []string{}
+	if ctrl.DeviceInterface.SAS3G {
+		protocols = append(protocols, "SAS")
+	}
+	if ctrl.DeviceInterface.SATA1_5G || ctrl.DeviceInterface.SATA3G {
+		protocols = append(protocols, "SATA")
+	}
+	raid := []string{}
+	for _, level := range ctrl.RaidLevels.Levels() {
+		raid = append(raid, "RAID"+level)
+	}
+
+	return Resource{
+		"@odata.type":              "#StorageController.v1_7_0.StorageController",
+		"Id":                       "0",
+		"Name":                     ctrl.ProductName,
+		"Model":                    ctrl.ProductName,
+		"SerialNumber":             ctrl.SerialNumber,
+		"FirmwareVersion":          fw,
+		"SupportedRAIDTypes":       raid,
+		"SupportedDeviceProtocols": protocols,
+		"Status":                   Resource{"State": "Enabled", "Health": health},
+	}
+}
+
+// Volume 对应 Volume 资源, drives 为成员盘的 @odata.id
+func Volume(h *collector.Host, ld *megaraid.LD_INFO, drives []string) Resource {
+	// 3 为 Optimal, 0 为 Offline, 其余都是降级
+	health := Warning
+	switch ld.State {
+	case 0:
+		health = Critical
+	case 3:
+		health = OK
+	}
+
+	v := Resource{
+		"@odata.type":   "#Volume.v1_9_0.Volume",
+		"Id":            fmt.Sprint(ld.Ref.TargetId),
+		"Name":          fmt.Sprintf("Virtual Disk %d", ld.Ref.TargetId),
+		"CapacityBytes": ld.Size * megaraid.SectorSz,
+		"Status":        Resource{"State": "Enabled", "Health": health},
+		"Links":         Resource{"Drives": links(drives)},
+	}
+	if h.Config != nil {
+		for i := range h.Config.Lds {
+			cfg := &h.Config.Lds[i]
+			if cfg.Properties.Ref.TargetId != ld.Ref.TargetId {
+				continue
+			}
+			// RAID1E 的 PrimaryRaidLevel 是 0x11 这类值, 不在 Redfish 枚举里的不输出
+			if level := cfg.GetRaidLevel(); raidTypes[level] {
+				v["RAIDType"] = level
+			}
+			if name := cfg.GetName(); name != "" {
+				v["Name"] = name
+			}
+		}
+	}
+	return v
+}
+
+// Drive 对应 Drive 资源, volumes 为所属逻辑盘的 @odata.id
+func Drive(pd collector.Pd, volumes []string) Resource {
+	info := pd.Info
+	state, health := "Enabled", OK
+	switch uint8(info.FwState) {
+	case megaraid.MR_PD_STATE_FAILED, megaraid.MR_PD_STATE_OFFLINE, megaraid.MR_PD_STATE_UNCONFIGURED_BAD:
+		state, health = "UnavailableOffline", Critical
+	case megaraid.MR_PD_STATE_HOT_SPARE:
+		state = "StandbySpare"
+	case megaraid.MR_PD_STATE_REBUILD, megaraid.MR_PD_STATE_COPYBACK:
+		state = "Updating"
+	}
+	if health == OK && info.PredFailCount > 0 {
+		health = Warning
+	}
+
+	media := info.GetMediaType()
+	if media == "Unknown" {
+		media = ""
+	}
+	encryption := "None"
+	if info.GetSecurity().FdeCapable {
+		encryption = "SelfEncryptingDrive"
+	}
+
+	d := Resource{
+		"@odata.type":        "#Drive.v1_17_0.Drive",
+		"Id":                 DriveId(info),
+		"Name":               fmt.Sprintf("Drive %d:%d", info.EnclDeviceId, info.SlotNumber),
+		"Manufacturer":       pd.Vendor,
+		"Model":              pd.Model,
+		"SerialNumber":       pd.Serial,
+		"Revision":           pd.Firmware,
+		"CapacityBytes":      megaraid.ArrayZip(info.RawSize[:], 32) * megaraid.SectorSz,
+		"NegotiatedSpeedGbs": info.GetLinkSpeed(),
+		"FailurePredicted":   info.PredFailCount > 0,
+		"EncryptionAbility":  encryption,
+		"PhysicalLocation": Resource{"PartLocation": Resource{
+			"LocationOrdinalValue": info.SlotNumber,
+			"LocationType":         "Slot",
+		}},
+		"Status": Resource{"State": state, "Health": health},
+		"Links":  Resource{"Volumes": links(volumes)},
+	}
+	if media != "" {
+		d["MediaType"] = media
+	}
+	if protocol := info.GetInterface(); protocol != "Unknown" {
+		d["Protocol"] = protocol
+	}
+	if id := identifier(pd.WWN); id != nil {
+		d["Identifiers"] = []Resource{id}
+	}
+	return d
+}
+
+// raidTypes 是 Redfish 的 RAIDType 枚举中 MegaRAID 会用到的值
+var raidTypes = map[string]bool{
+	"RAID0": true, "RAID1": true, "RAID5": true, "RAID6": true, "RAID1E": true,
+	"RAID00": true, "RAID10": true, "RAID50": true, "RAID60": true,
+}
+
+// identifier 把 naa./eui. 格式的 WWN 转成 Redfish 的 Identifier, DurableName 为不带前缀的十六进制.
+// T10 vendor id 和 SCSI name string 没有对应的 DurableNameFormat, 返回 nil
+func identifier(wwn string) Resource {
+	prefix, id, _ := strings.Cut(megaraid.NormalizeWWN(wwn), ".")
+	var format string
+	switch prefix {
+	case "naa":
+		format = "NAA"
+	case "eui":
+		format = "EUI"
+	default:
+		return nil
+	}
+	return Resource{"DurableNameFormat": format, "DurableName": strings.ToUpper(id)}
+}
+
+// Enclosure 对应 ChassisType 为 Enclosure 的 Chassis 资源
+func Enclosure(h *collector.Host, e megaraid.MR_PD_ADDRESS, id, storage string) Resource {
+	var drives []string
+	for _, pd := range h.Pds {
+		if pd.Info.EnclDeviceId == e.DeviceId {
+			drives = append(drives, storage+"/Drives/"+DriveId(pd.Info))
+		}
+	}
+	return Resource{
+		"@odata.id":   id,
+		"@odata.type": "#Chassis.v1_14_0.Chassis",
+		"Id":          id[len(ChassisRoot)+1:],
+		"Name":        fmt.Sprintf("Enclosure %d", e.DeviceId),
+		"ChassisType": "Enclosure",
+		"Status":      Resource{"State": "Enabled", "Health": OK},
+		"Links":       Resource{"Drives": links(drives), "Storage": links([]string{storage})},
+	}
+}
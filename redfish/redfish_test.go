@@ -0,0 +1,152 @@
+package redfish
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+type fakeBackend struct{ hosts map[uint16]*collector.Host }
+
+func (b fakeBackend) ScanHosts(ctx context.Context) ([]uint16, error) {
+	var hostNos []uint16
+	for hostNo := range b.hosts {
+		hostNos = append(hostNos, hostNo)
+	}
+	return hostNos, nil
+}
+
+func (b fakeBackend) Gather(ctx context.Context, hostNo uint16) (*collector.Host, error) {
+	return b.hosts[hostNo], nil
+}
+func (b fakeBackend) Close() {}
+
+func testHost() *collector.Host {
+	pd := &megaraid.MR_PD_INFO{}
+	pd.Ref.DeviceId = 8
+	pd.EnclDeviceId, pd.SlotNumber = 32, 1
+	pd.FwState = uint16(megaraid.MR_PD_STATE_ONLINE)
+	pd.PredFailCount = 1
+	pd.LinkSpeed = 3
+	pd.InterfaceType = 2
+
+	cfg := &megaraid.Config{
+		Arrays: []megaraid.MR_ARRAY{{ArrayRef: 0, NumDrives: 1}},
+		Lds:    []megaraid.MR_LD_CONFIG{{}},
+	}
+	cfg.Arrays[0].Pd[0].Ref.DeviceId = 8
+	cfg.Lds[0].Params.PrimaryRaidLevel = 1
+	cfg.Lds[0].Params.SpanDepth = 1
+
+	return &collector.Host{
+		Ctrl:       &megaraid.ControllerInfo{ProductName: "PERC H730P Mini", SerialNumber: "52T00R1", RaidLevels: megaraid.RaidLevels{Raid0: true, Raid1: true}},
+		Lds:        []megaraid.LD_INFO{{State: 3, Size: 2048}},
+		Pds:        []collector.Pd{{Info: pd, Serial: "S1", WWN: "5000C500A1B2C3D4", Vendor: "SEAGATE", Model: "ST1200"}},
+		Enclosures: []megaraid.MR_PD_ADDRESS{{DeviceId: 32}},
+		Config:     cfg,
+	}
+}
+
+func TestResources(t *testing.T) {
+	res := Resources([]*collector.Host{testHost()})
+
+	drive := res[StorageRoot+"/c0/Drives/e32.s1"]
+	if drive == nil {
+		t.Fatalf("drive missing, have %v", res)
+	}
+	if drive["SerialNumber"] != "S1" || drive["Protocol"] != "SAS" ||
+		drive["NegotiatedSpeedGbs"] != 6.0 || drive["Status"].(Resource)["Health"] != Warning {
+		t.Errorf("unexpected drive %v", drive)
+	}
+	if id := drive["Identifiers"].([]Resource)[0]; id["DurableNameFormat"] != "NAA" || id["DurableName"] != "5000C500A1B2C3D4" {
+		t.Errorf("unexpected identifiers %v", drive["Identifiers"])
+	}
+	if identifier("eui.0025385b71b07e5a")["DurableNameFormat"] != "EUI" || identifier("t10.ATA DISK") != nil {
+		t.Error("unexpected identifier format")
+	}
+	if drive["Links"].(Resource)["Chassis"].(Resource)["@odata.id"] != ChassisRoot+"/Enclosure.c0.e32" {
+		t.Errorf("unexpected drive links %v", drive["Links"])
+	}
+
+	volume := res[StorageRoot+"/c0/Volumes/0"]
+	if volume["RAIDType"] != "RAID1" || volume["CapacityBytes"] != uint64(2048*512) ||
+		len(volume["Links"].(Resource)["Drives"].([]Resource)) != 1 {
+		t.Errorf("unexpected volume %v", volume)
+	}
+
+	ctrl := res[StorageRoot+"/c0/Controllers/0"]
+	if raid := ctrl["SupportedRAIDTypes"].([]string); len(raid) != 2 || raid[0] != "RAID0" || raid[1] != "RAID1" {
+		t.Errorf("unexpected SupportedRAIDTypes %v", ctrl["SupportedRAIDTypes"])
+	}
+
+	storage := res[StorageRoot+"/c0"]
+	if storage["Status"].(Resource)["HealthRollup"] != Warning {
+		t.Errorf("unexpected storage status %v", storage["Status"])
+	}
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(fakeBackend{map[uint16]*collector.Host{0: testHost()}}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + StorageRoot + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var storages Resource
+	if err := json.NewDecoder(resp.Body).Decode(&storages); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || storages["Members@odata.count"] != 1.0 {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, storages)
+	}
+
+	// 从 ServiceRoot 按链接找到 Storage
+	id := Root
+	for _, key := range []string{"Systems", "Members", "Storage"} {
+		resp, err := http.Get(srv.URL + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res Resource
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %d %v", id, resp.StatusCode, err)
+		}
+		next := res[key]
+		if members, ok := next.([]any); ok && len(members) == 1 {
+			next = members[0]
+		}
+		id = next.(map[string]any)["@odata.id"].(string)
+	}
+	if id != StorageRoot {
+		t.Errorf("ServiceRoot leads to %s, want %s", id, StorageRoot)
+	}
+
+	resp, err = http.Head(srv.URL + StorageRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.ContentLength <= 0 {
+		t.Errorf("HEAD: %d, Content-Length %d, body %q", resp.StatusCode, resp.ContentLength, body)
+	}
+
+	resp, err = http.Get(srv.URL + StorageRoot + "/c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,104 @@
+package megaraid
+
+import (
+	"context"
+	"fmt"
+)
+
+// 这里只读取和解码 SED 状态. 控制器密钥管理(创建、修改、校验 lock key, secure 逻辑盘, 解锁 foreign 盘)
+// 没有实现: 这些 DCMD 的 opcode 和 mbox/数据布局在 Linux 驱动和公开的 MFI 头文件里都没有定义, 无法核对,
+// 猜错的写命令可能让盘永久无法访问. 需要时请使用 storcli /cX set security 等命令
+
+// PdSecurity 是 MR_PD_INFO.Security 中的 SED(FDE) 状态
+type PdSecurity struct {
+	FdeCapable bool // 是自加密盘
+	FdeEnabled bool // 加密已开启
+	Secured    bool // 已经用控制器的密钥保护
+	Locked     bool // 被锁定, 需要密钥才能访问
+	Foreign    bool // 用其他控制器的密钥保护
+	NeedsEKM   bool // 需要外部密钥管理(EKM)
+}
+
+// GetSecurity 解码 MR_PD_INFO.Security
+func (info *MR_PD_INFO) GetSecurity() PdSecurity {
+	return PdSecurity{
+		FdeCapable: flag(info.Security, 0),
+		FdeEnabled: flag(info.Security, 1),
+		Secured:    flag(info.Security, 2),
+		Locked:     flag(info.Security, 3),
+		Foreign:    flag(info.Security, 4),
+		NeedsEKM:   flag(info.Security, 5),
+	}
+}
+
+// LdSecurity 是逻辑盘的加密状态, 由成员盘的状态汇总得到
+type LdSecurity struct {
+	TargetId uint8
+	Capable  bool // 所有成员盘都是 SED, 可以 secure
+	Secured  bool // 所有成员盘都已 secured
+	Locked   bool // 有成员盘被锁定
+	Members  []uint16
+}
+
+// LdSecurityOf 根据 RAID 配置和成员盘信息汇总逻辑盘的加密状态, pds 以 deviceId 为 key
+func LdSecurityOf(cfg *Config, pds map[uint16]*MR_PD_INFO, targetId uint8) (*LdSecurity, error) {
+	sec := &LdSecurity{TargetId: targetId, Capable: true, Secured: true}
+
+	for i := range cfg.Lds {
+		ld := &cfg.Lds[i]
+		if ld.Properties.Ref.TargetId != targetId {
+			continue
+		}
+		for s := 0; s < int(ld.Params.SpanDepth) && s < len(ld.Span); s++ {
+			for a := range cfg.Arrays {
+				array := &cfg.Arrays[a]
+				if array.ArrayRef != ld.Span[s].ArrayRef {
+					continue
+				}
+				for p := 0; p < int(array.NumDrives) && p < len(array.Pd); p++ {
+					sec.Members = append(sec.Members, array.Pd[p].Ref.DeviceId)
+				}
+			}
+		}
+	}
+	if len(sec.Members) == 0 {
+		return nil, fmt.Errorf("ld %d not found in config", targetId)
+	}
+
+	for _, id := range sec.Members {
+		pd, ok := pds[id]
+		if !ok {
+			// 缺盘(0xffff)或者没拿到信息的盘按不安全处理
+			sec.Capable, sec.Secured = false, false
+			continue
+		}
+		s := pd.GetSecurity()
+		sec.Capable = sec.Capable && s.FdeCapable
+		sec.Secured = sec.Secured && s.Secured
+		sec.Locked = sec.Locked || s.Locked
+	}
+	return sec, nil
+}
+
+// MegasasGetLdSecurity 读取逻辑盘成员盘的信息并汇总加密状态
+func (m *MegasasIoctl) MegasasGetLdSecurity(ctx context.Context, instance *Instance, targetId uint8) (*LdSecurity, error) {
+	cfg, err := m.MegasasGetConfig(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	pds := make(map[uint16]*MR_PD_INFO)
+	for i := range cfg.Arrays {
+		array := &cfg.Arrays[i]
+		for p := 0; p < int(array.NumDrives) && p < len(array.Pd); p++ {
+			id := array.Pd[p].Ref.DeviceId
+			if id == 0xffff {
+				continue
+			}
+			if pd, err := m.MegasasGetPdInfo(ctx, instance, &ScsiDevice{DeviceId: id}); err == nil {
+				pds[id] = pd
+			}
+		}
+	}
+	return LdSecurityOf(cfg, pds, targetId)
+}
@@ -0,0 +1,388 @@
+package megaraid
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// SelfTest 是后台自检的类型, 数值与 SEND DIAGNOSTIC 的 self-test code 及 ATA SMART 子命令相同
+type SelfTest uint8
+
+const (
+	SelfTestShort    SelfTest = 1
+	SelfTestExtended SelfTest = 2
+
+	scsiSelfTestAbort = 4 // SEND DIAGNOSTIC: abort background self-test
+)
+
+func (t SelfTest) String() string {
+	switch t {
+	case SelfTestShort:
+		return "short"
+	case SelfTestExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("self-test(%d)", uint8(t))
+}
+
+// SelfTestResult 是自检日志中的一条记录
+type SelfTestResult struct {
+	Number       int // 1 为最近一次
+	Type         string
+	Status       uint8 // SCSI: log page 0x10 的 self-test results; SATA: self-test execution status 高 4 位
+	Description  string
+	PowerOnHours uint32
+	FailingLBA   uint64 // 没有出错的 LBA 时为 0xffffffffffffffff
+}
+
+func (r SelfTestResult) InProgress() bool {
+	return r.Status == 0xf
+}
+
+func (r SelfTestResult) Passed() bool {
+	return r.Status == 0
+}
+
+// SelfTestStatus 是一块盘的自检状态
+type SelfTestStatus struct {
+	DeviceId         uint16
+	Sata             bool
+	InProgress       bool
+	PercentRemaining int
+	Results          []SelfTestResult
+	Err              error // SelfTestScheduler 里单块盘失败时记录在这里
+}
+
+var scsiSelfTestResults = map[uint8]string{
+	0x0: "Completed without error",
+	0x1: "Aborted by SEND DIAGNOSTIC",
+	0x2: "Aborted by other method",
+	0x3: "Unknown error",
+	0x4: "Failed in unknown segment",
+	0x5: "Failed in first segment",
+	0x6: "Failed in second segment",
+	0x7: "Failed in another segment",
+	0xf: "In progress",
+}
+
+var ataSelfTestResults = map[uint8]string{
+	0x0: "Completed without error",
+	0x1: "Aborted by host",
+	0x2: "Interrupted by host reset",
+	0x3: "Fatal error",
+	0x4: "Unknown failure",
+	0x5: "Electrical failure",
+	0x6: "Servo failure",
+	0x7: "Read failure",
+	0x8: "Handling damage",
+	0xf: "In progress",
+}
+
+func selfTestTypeName(code uint8) string {
+	switch code {
+	case 1, 5:
+		return "short"
+	case 2, 6:
+		return "extended"
+	case 3, 4:
+		return "conveyance"
+	}
+	return fmt.Sprintf("vendor(%d)", code)
+}
+
+// ParseScsiSelfTestLog 解析 LOG SENSE page 0x10 (Self-Test Results), 最近的记录在前
+func ParseScsiSelfTestLog(data []byte) ([]SelfTestResult, error) {
+	if len(data) < 4 || data[0]&0x3f != LOG_PAGE_SELF_TEST_RESULTS {
+		return nil, fmt.Errorf("invalid self-test results log page")
+	}
+	end := min(len(data), 4+int(binary.BigEndian.Uint16(data[2:4])))
+
+	var results []SelfTestResult
+	for off := 4; off+4 <= end; off += 4 + int(data[off+3]) {
+		param := data[off:min(end, off+4+int(data[off+3]))]
+		if len(param) < 20 {
+			break
+		}
+		// 没有执行过的记录全是 0
+		if binary.BigEndian.Uint64(param[4:12])|binary.BigEndian.Uint64(param[12:20]) == 0 {
+			continue
+		}
+		status := param[4] & 0x0f
+		results = append(results, SelfTestResult{
+			Number:       int(binary.BigEndian.Uint16(param[0:2])),
+			Type:         selfTestTypeName(param[4] >> 5),
+			Status:       status,
+			Description:  scsiSelfTestResults[status],
+			PowerOnHours: uint32(binary.BigEndian.Uint16(param[6:8])),
+			FailingLBA:   binary.BigEndian.Uint64(param[8:16]),
+		})
+	}
+	return results, nil
+}
+
+// ParseAtaSelfTestLog 解析 SMART self-test log (log address 0x06), 最近的记录在前
+func ParseAtaSelfTestLog(data []byte) ([]SelfTestResult, error) {
+	const entries, entrySize = 21, 24
+	if len(data) < ATA_SECTOR_SIZE {
+		return nil, fmt.Errorf("smart self-test log too short: %d bytes", len(data))
+	}
+
+	// byte 508 是最近一条记录的序号(1-21), 0 表示没有记录
+	index := int(data[508])
+	if index == 0 || index > entries {
+		return nil, nil
+	}
+
+	var results []SelfTestResult
+	for n := 0; n < entries; n++ {
+		i := (index - 1 - n + entries) % entries
+		entry := data[2+i*entrySize : 2+(i+1)*entrySize]
+		if entry[0] == 0 && entry[1] == 0 && entry[2] == 0 && entry[3] == 0 {
+			continue
+		}
+		status := entry[1] >> 4
+		lba := uint64(binary.LittleEndian.Uint32(entry[5:9]))
+		if status == 0 {
+			lba = 0xffffffffffffffff
+		}
+		results = append(results, SelfTestResult{
+			Number:       n + 1,
+			Type:         selfTestTypeName(entry[0] & 0x7f),
+			Status:       status,
+			Description:  ataSelfTestResults[status],
+			PowerOnHours: uint32(binary.LittleEndian.Uint16(entry[2:4])),
+			FailingLBA:   lba,
+		})
+	}
+	return results, nil
+}
+
+// ataSmartCdb 构造 ATA PASS-THROUGH(16) 的 SMART 命令, dataIn 时读一个扇区(PIO data-in)
+func ataSmartCdb(feature, lbaLow uint8, dataIn bool) []byte {
+	cdb := make([]byte, 16)
+	cdb[0] = SCSI_ATA_PASSTHRU_16
+	if dataIn {
+		cdb[1] = 4 << 1 // protocol: PIO data-in
+		cdb[2] = 0x0e   // t_dir=1, byt_blok=1, t_length=sector count
+		cdb[6] = 1
+	} else {
+		cdb[1] = 3 << 1 // protocol: non-data
+	}
+	cdb[4] = feature
+	cdb[8] = lbaLow
+	cdb[10] = 0x4f
+	cdb[12] = 0xc2
+	cdb[14] = ATA_SMART
+	return cdb
+}
+
+// isSataPd 按 SAT 的约定, inquiry vendor 为 ATA 的是 SATA 盘
+func (m *MegasasIoctl) isSataPd(ctx context.Context, instance *Instance, deviceId uint16) (bool, error) {
+	pdInfo, err := m.MegasasGetPdInfo(ctx, instance, &ScsiDevice{DeviceId: deviceId})
+	if err != nil {
+		return false, err
+	}
+	inq, err := pdInfo.GetInquiryData()
+	if err != nil {
+		return false, err
+	}
+	return inq.VendorIdentification == "ATA", nil
+}
+
+// StartSelfTest 在物理盘上启动后台自检: SAS 盘用 SEND DIAGNOSTIC, SATA 盘用 SMART EXECUTE OFF-LINE IMMEDIATE
+func (m *MegasasIoctl) StartSelfTest(ctx context.Context, instance *Instance, deviceId uint16, test SelfTest) error {
+	return m.selfTestCommand(ctx, instance, deviceId, uint8(test), uint8(test))
+}
+
+// AbortSelfTest 中止物理盘上正在运行的后台自检
+func (m *MegasasIoctl) AbortSelfTest(ctx context.Context, instance *Instance, deviceId uint16) error {
+	return m.selfTestCommand(ctx, instance, deviceId, scsiSelfTestAbort, ATA_SMART_ABORT_SELF_TEST)
+}
+
+func (m *MegasasIoctl) selfTestCommand(ctx context.Context, instance *Instance, deviceId uint16, scsiCode, ataSubcommand uint8) error {
+	sata, err := m.isSataPd(ctx, instance, deviceId)
+	if err != nil {
+		return err
+	}
+
+	instance.Buf = nil
+	if sata {
+		return m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, ataSmartCdb(ATA_SMART_EXECUTE_OFFLINE, ataSubcommand, false), MFI_FRAME_DIR_NONE)
+	}
+	return m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, []byte{SCSI_SEND_DIAGNOSTIC, scsiCode << 5, 0, 0, 0, 0}, MFI_FRAME_DIR_NONE)
+}
+
+// GetSelfTestStatus 读取物理盘的自检进度和自检日志
+func (m *MegasasIoctl) GetSelfTestStatus(ctx context.Context, instance *Instance, deviceId uint16) (*SelfTestStatus, error) {
+	sata, err := m.isSataPd(ctx, instance, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	status := &SelfTestStatus{DeviceId: deviceId, Sata: sata}
+
+	if sata {
+		instance.Buf = make([]byte, ATA_SECTOR_SIZE)
+		if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, ataSmartCdb(ATA_SMART_READ_DATA, 0, true), MFI_FRAME_DIR_READ); err != nil {
+			return nil, err
+		}
+		exec := instance.Buf[ATA_SMART_SELF_TEST_EXEC_OFF]
+		status.InProgress = exec>>4 == 0xf
+		if status.InProgress {
+			status.PercentRemaining = int(exec&0x0f) * 10
+		}
+
+		instance.Buf = make([]byte, ATA_SECTOR_SIZE)
+		if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, ataSmartCdb(ATA_SMART_READ_LOG, ATA_SMART_LOG_SELF_TEST, true), MFI_FRAME_DIR_READ); err != nil {
+			return nil, err
+		}
+		if status.Results, err = ParseAtaSelfTestLog(instance.Buf); err != nil {
+			return nil, err
+		}
+		return status, nil
+	}
+
+	instance.Buf = make([]byte, 4+20*20)
+	cdb := []byte{SCSI_LOG_SENSE, 0, 0x40 | LOG_PAGE_SELF_TEST_RESULTS, 0, 0, 0, 0, uint8(len(instance.Buf) >> 8), uint8(len(instance.Buf)), 0}
+	if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, cdb, MFI_FRAME_DIR_READ); err != nil {
+		return nil, err
+	}
+	if status.Results, err = ParseScsiSelfTestLog(instance.Buf); err != nil {
+		return nil, err
+	}
+	status.InProgress = len(status.Results) > 0 && status.Results[0].InProgress()
+
+	if status.InProgress {
+		// REQUEST SENSE 的 sense-key specific 字段带有进度(fixed 格式 byte 15-17)
+		instance.Buf = make([]byte, SCSI_SENSE_BUFFERSIZE)
+		cdb := []byte{SCSI_REQUEST_SENSE, 0, 0, 0, uint8(len(instance.Buf)), 0}
+		if err := m.scsiPassthru(ctx, instance, MFI_CMD_PD_SCSI_IO, deviceId, cdb, MFI_FRAME_DIR_READ); err == nil &&
+			instance.Buf[0]&0x7f == 0x70 && instance.Buf[15]&0x80 != 0 {
+			done := int(binary.BigEndian.Uint16(instance.Buf[16:18])) * 100 / 65536
+			status.PercentRemaining = 100 - done
+		}
+	}
+	return status, nil
+}
+
+// StartSelfTest 见 MegasasIoctl.StartSelfTest
+func (c *Controller) StartSelfTest(ctx context.Context, deviceId uint16, test SelfTest) error {
+	return c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		return m.StartSelfTest(ctx, instance, deviceId, test)
+	})
+}
+
+// AbortSelfTest 见 MegasasIoctl.AbortSelfTest
+func (c *Controller) AbortSelfTest(ctx context.Context, deviceId uint16) error {
+	return c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		return m.AbortSelfTest(ctx, instance, deviceId)
+	})
+}
+
+// GetSelfTestStatus 见 MegasasIoctl.GetSelfTestStatus
+func (c *Controller) GetSelfTestStatus(ctx context.Context, deviceId uint16) (status *SelfTestStatus, err error) {
+	err = c.Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		status, err = m.GetSelfTestStatus(ctx, instance, deviceId)
+		return err
+	})
+	return status, err
+}
+
+// SelfTestScheduler 按 array 限流地对一批物理盘做自检: 同一个 array 里同时只有 PerArray 块盘在自检,
+// 不在任何 array 里的盘(UGood、JBOD、热备)各自独立. 命令通过 Controller 下发, 轮询的间隔中不占用 host
+type SelfTestScheduler struct {
+	Controller   *Controller
+	Test         SelfTest
+	PerArray     int           // 默认 1
+	PollInterval time.Duration // 默认 1 分钟
+}
+
+// Run 阻塞直到所有盘的自检结束或 ctx 结束, 返回顺序与 deviceIds 相同, 单块盘的失败记录在 SelfTestStatus.Err.
+// ctx 结束时已经启动的自检不会被中止
+func (s *SelfTestScheduler) Run(ctx context.Context, deviceIds []uint16) ([]*SelfTestStatus, error) {
+	perArray, interval := s.PerArray, s.PollInterval
+	if perArray <= 0 {
+		perArray = 1
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	cfg, err := s.Controller.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type job struct {
+		index    int
+		deviceId uint16
+		before   SelfTestResult // 启动前最近的一条记录, 用来判断新的自检是否已经出结果
+		polls    int
+	}
+
+	// 不在 array 里的盘用 deviceId 作为单独的组
+	queues := make(map[int][]*job)
+	var groups []int
+	for i, id := range deviceIds {
+		group := 1<<16 + int(id)
+		if ref, ok := cfg.ArrayOf(id); ok {
+			group = int(ref)
+		}
+		if _, ok := queues[group]; !ok {
+			groups = append(groups, group)
+		}
+		queues[group] = append(queues[group], &job{index: i, deviceId: id})
+	}
+
+	results := make([]*SelfTestStatus, len(deviceIds))
+	running := make(map[int][]*job)
+	for {
+		for _, group := range groups {
+			for len(running[group]) < perArray && len(queues[group]) > 0 {
+				j := queues[group][0]
+				queues[group] = queues[group][1:]
+
+				if st, err := s.Controller.GetSelfTestStatus(ctx, j.deviceId); err == nil && len(st.Results) > 0 {
+					j.before = st.Results[0]
+				}
+				if err := s.Controller.StartSelfTest(ctx, j.deviceId, s.Test); err != nil {
+					results[j.index] = &SelfTestStatus{DeviceId: j.deviceId, Err: err}
+					continue
+				}
+				running[group] = append(running[group], j)
+			}
+		}
+
+		pending := 0
+		for _, group := range groups {
+			pending += len(running[group]) + len(queues[group])
+		}
+		if pending == 0 {
+			return results, nil
+		}
+
+		if err := sleep(ctx, interval); err != nil {
+			return results, err
+		}
+		for _, group := range groups {
+			var still []*job
+			for _, j := range running[group] {
+				j.polls++
+				st, err := s.Controller.GetSelfTestStatus(ctx, j.deviceId)
+				if err != nil {
+					results[j.index] = &SelfTestStatus{DeviceId: j.deviceId, Err: err}
+					continue
+				}
+				// 刚启动时日志里可能还没有新记录, 至少等到日志变化或者轮询 3 次
+				finished := !st.InProgress && ((len(st.Results) > 0 && st.Results[0] != j.before) || j.polls >= 3)
+				if !finished {
+					still = append(still, j)
+					continue
+				}
+				results[j.index] = st
+			}
+			running[group] = still
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package megaraid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// SnapshotSchemaVersion 是 Snapshot 的 JSON 结构版本, 删除字段或改变字段含义时加 1, 只增加字段时不变
+const SnapshotSchemaVersion = 1
+
+// Snapshot 是某一时刻所有控制器的完整状态. 返回后不会再被修改, 可以在多个 goroutine 中共享,
+// JSON 序列化后可以用 UnmarshalSnapshot 还原
+type Snapshot struct {
+	SchemaVersion int
+	Time          time.Time
+	Controllers   []ControllerSnapshot // 按 HostNo 排序, 下标与 storcli 的 /cX 一致
+}
+
+// ControllerSnapshot 是一个控制器的状态. 控制器信息读取失败时只有 HostNo 和 Errors,
+// 单个对象读取失败时跳过该对象并记录到 Errors
+type ControllerSnapshot struct {
+	HostNo        uint16
+	Info          *ControllerInfo
+	Enclosures    []EnclosureSnapshot
+	Pds           []PdSnapshot
+	Lds           []LdSnapshot
+	HotSpares     []HotSpareSnapshot
+	BackgroundOps []BackgroundOp
+	Bbu           *BbuSnapshot // 没有 BBU 时为 nil
+	Errors        []string
+
+	Raw *ControllerRaw `json:"-"` // 从 JSON 还原的快照中为 nil
+}
+
+// ControllerRaw 是读取快照时固件返回的原始结构, 给需要完整字段的 collector、storcli 输出和 Redfish 使用
+type ControllerRaw struct {
+	Enclosures []MR_PD_ADDRESS
+	Pds        []*MR_PD_INFO // 与 ControllerSnapshot.Pds 按下标对应
+	Lds        []LD_INFO
+	Config     *Config // 读取失败时为 nil
+	Bbu        *MR_BBU_STATUS
+}
+
+type EnclosureSnapshot struct {
+	DeviceId uint16
+	SasAddr  string
+	Slots    int // 在位的物理盘数
+}
+
+// PdSnapshot 是物理盘的身份、状态和健康计数
+type PdSnapshot struct {
+	DeviceId     uint16
+	EnclDeviceId uint16 // 0xffff 表示不在 enclosure 里
+	Slot         uint8
+	State        string // 同 MR_PD_INFO.GetFwState
+	InVD         bool
+	Foreign      bool
+	MediaType    string
+	Interface    string
+	LinkSpeed    float64 // Gb/s
+	SizeBytes    uint64  // coerced size
+
+	Vendor      string
+	Model       string
+	Serial      string
+	Firmware    string
+	WWN         string
+	Designators []VpdDesignator // VPD 0x83
+	Security    PdSecurity
+
+	Health PdHealth
+}
+
+// PdHealth 是 MR_PD_INFO 中的错误计数和温度
+type PdHealth struct {
+	MediaErrors             uint32
+	OtherErrors             uint32
+	PredictiveFailures      uint32
+	LastPredFailEventSeqNum uint32
+	Temperature             uint8 // ℃
+}
+
+// LdSnapshot 是逻辑盘的状态、属性和成员
+type LdSnapshot struct {
+	TargetId  uint8
+	Name      string
+	State     string // 同 LD_INFO.GetState
+	RaidLevel string
+	SizeBytes uint64
+
+	StripeSize         uint32 // Bytes
+	DefaultCachePolicy uint8  // MR_LD_CACHE_*
+	CurrentCachePolicy uint8  // MR_LD_CACHE_*, 与 DefaultCachePolicy 不同说明固件降级了策略, 比如 BBU 故障时 WB 变为 WT
+	DiskCachePolicy    uint8
+	AccessPolicy       uint8 // MR_LD_ACCESS_*
+	Consistent         bool
+
+	Spans []SpanSnapshot
+	Vpd   *LdVpd // 读取失败时为 nil
+}
+
+// SpanSnapshot 是逻辑盘在一个 array 上的范围和 array 的成员盘
+type SpanSnapshot struct {
+	ArrayRef   uint16
+	StartBlock uint64
+	NumBlocks  uint64
+	Drives     []SpanDrive
+}
+
+type SpanDrive struct {
+	DeviceId     uint16 // 0xffff 表示缺盘
+	EnclDeviceId uint16 // 从 PD 列表中查找, 找不到时为 0xffff
+	Slot         uint8
+}
+
+type HotSpareSnapshot struct {
+	DeviceId     uint16
+	Dedicated    bool
+	Revertible   bool
+	EnclAffinity bool
+	Arrays       []uint16 // dedicated 时服务的 array
+}
+
+// BackgroundOp 是物理盘上正在进行的 rebuild、patrol read 或 clear
+type BackgroundOp struct {
+	DeviceId    uint16
+	Operation   string // Rebuild, Patrol, Clear
+	Percent     int
+	ElapsedSecs uint16
+}
+
+type BbuSnapshot struct {
+	Type        uint8 // MR_BBU_TYPE_*
+	Voltage     uint16
+	Current     int16
+	Temperature uint16
+	FwStatus    uint32 // MR_BBU_STATE_*
+	Healthy     bool
+
+	// 以下来自 MR_DCMD_BBU_GET_CAPACITY_INFO, 没有 gas gauge 时为 0
+	RelativeStateOfCharge uint16 // %
+	RemainingCapacity     uint16 // mAh
+	FullChargeCapacity    uint16 // mAh
+	CycleCount            uint16
+}
+
+// Snapshot 依次读取所有控制器, 见 SnapshotController.
+// ctx 结束时返回 ctx.Err(), 其他错误记录在对应控制器的 Errors 中
+func (m *MegasasIoctl) Snapshot(ctx context.Context) (*Snapshot, error) {
+	hostNos, err := m.ScanHosts()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(hostNos)
+
+	s := &Snapshot{SchemaVersion: SnapshotSchemaVersion, Time: time.Now().UTC()}
+	for _, hostNo := range hostNos {
+		c, err := m.SnapshotController(ctx, hostNo)
+		if err != nil {
+			return nil, err
+		}
+		s.Controllers = append(s.Controllers, *c)
+	}
+	return s, nil
+}
+
+// SnapshotController 在 host 的 Controller 锁内读取一个控制器, 是读取控制器状态的唯一入口, collector 也通过它采集.
+// 只在 ctx 结束时返回错误, 单个对象读取失败时跳过并记录在 Errors 中, 控制器信息读取失败时 Info 为 nil
+func (m *MegasasIoctl) SnapshotController(ctx context.Context, hostNo uint16) (*ControllerSnapshot, error) {
+	c := &ControllerSnapshot{HostNo: hostNo, Raw: &ControllerRaw{}}
+	err := m.Controller(hostNo).Do(ctx, func(m *MegasasIoctl, instance *Instance) error {
+		return m.snapshotController(ctx, instance, c)
+	})
+	if errors.Is(err, ErrHostBusy) {
+		c.Errors = append(c.Errors, err.Error())
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// snapshotController 只在 ctx 结束时返回错误
+func (m *MegasasIoctl) snapshotController(ctx context.Context, instance *Instance, c *ControllerSnapshot) error {
+	failed := func(what string, err error) bool {
+		if err == nil {
+			return false
+		}
+		c.Errors = append(c.Errors, fmt.Sprintf("%s: %v", what, err))
+		return true
+	}
+	ctxErr := func() error {
+		if ctx != nil {
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	info, err := m.MegasasGetControllerInfo(ctx, instance)
+	if failed("controller info", err) {
+		return ctxErr()
+	}
+	c.Info = info
+
+	cfg, err := m.MegasasGetConfig(ctx, instance)
+	failed("config", err)
+	c.Raw.Config = cfg
+
+	devices, err := m.MegasasGetPdList(ctx, instance)
+	failed("pd list", err)
+	for _, v := range devices {
+		if v.IsEnclosure() {
+			c.Enclosures = append(c.Enclosures, EnclosureSnapshot{DeviceId: v.DeviceId, SasAddr: v.GetSasAddrs()})
+			c.Raw.Enclosures = append(c.Raw.Enclosures, v)
+			continue
+		}
+		if !v.IsScsiDev() {
+			continue
+		}
+		pdInfo, err := m.MegasasGetPdInfo(ctx, instance, &ScsiDevice{Channel: v.EnclosureId, DeviceId: v.DeviceId})
+		if failed(fmt.Sprintf("pd %d", v.DeviceId), err) {
+			continue
+		}
+		c.Pds = append(c.Pds, NewPdSnapshot(pdInfo))
+		c.Raw.Pds = append(c.Raw.Pds, pdInfo)
+		c.BackgroundOps = append(c.BackgroundOps, NewBackgroundOps(pdInfo)...)
+	}
+	for i := range c.Enclosures {
+		for _, pd := range c.Pds {
+			if pd.EnclDeviceId == c.Enclosures[i].DeviceId {
+				c.Enclosures[i].Slots++
+			}
+		}
+	}
+
+	ldList, err := m.MegasasGetLdList(ctx, instance)
+	if !failed("ld list", err) {
+		c.Raw.Lds = ldList.LdList[:min(int(ldList.LdCount), len(ldList.LdList))]
+		for _, ld := range c.Raw.Lds {
+			l := NewLdSnapshot(cfg, &ld, c.Pds)
+			if vpd, err := m.MegasasGetLdVpd(ctx, instance, ld.Ref.TargetId); !failed(fmt.Sprintf("ld %d vpd", ld.Ref.TargetId), err) {
+				l.Vpd = vpd
+			}
+			c.Lds = append(c.Lds, l)
+		}
+	}
+
+	c.HotSpares = NewHotSpareSnapshots(cfg)
+
+	if info.HwPresent.BBU {
+		bbu, err := m.MegasasGetBbuStatus(ctx, instance)
+		if !failed("bbu", err) {
+			c.Bbu = NewBbuSnapshot(bbu)
+			c.Raw.Bbu = bbu
+			// CacheVault(超级电容)没有 gas gauge, 读取失败不算错误
+			if capacity, err := m.MegasasGetBbuCapacity(ctx, instance); err == nil {
+				c.Bbu.RelativeStateOfCharge = capacity.RelativeStateOfCharge
+				c.Bbu.RemainingCapacity = capacity.RemainingCapacity
+				c.Bbu.FullChargeCapacity = capacity.FullChargeCapacity
+				c.Bbu.CycleCount = capacity.CycleCount
+			}
+		}
+	}
+	return ctxErr()
+}
+
+// NewPdSnapshot 转换 MR_PD_INFO, 序列号、WWN 等从 inquiry 和 VPD 中解析
+func NewPdSnapshot(info *MR_PD_INFO) PdSnapshot {
+	pd := PdSnapshot{
+		DeviceId:     info.Ref.DeviceId,
+		EnclDeviceId: info.EnclDeviceId,
+		Slot:         info.SlotNumber,
+		State:        info.GetFwState(),
+		InVD:         info.InVD(),
+		Foreign:      BitField(info.State.PdType, 4, 1) == 1,
+		MediaType:    info.GetMediaType(),
+		Interface:    info.GetInterface(),
+		LinkSpeed:    info.GetLinkSpeed(),
+		SizeBytes:    ArrayZip(info.CoercedSize[:], 32) * SectorSz,
+		Security:     info.GetSecurity(),
+		Health: PdHealth{
+			MediaErrors:             info.MediaErrCount,
+			OtherErrors:             info.OtherErrCount,
+			PredictiveFailures:      info.PredFailCount,
+			LastPredFailEventSeqNum: info.LastPredFailEventSeqNum,
+			Temperature:             info.Temperature,
+		},
+	}
+	if inq, err := info.GetInquiryData(); err == nil {
+		pd.Vendor, pd.Model, pd.Serial, pd.Firmware = inq.VendorIdentification, inq.ProductIdentification, inq.SerialNumber, inq.FirmwareRevision
+	}
+	pd.Designators, _ = ParseVpdPage83(info.VpdPage83[:])
+	pd.WWN = VpdWWN(pd.Designators)
+	return pd
+}
+
+// NewBackgroundOps 返回物理盘上正在进行的后台任务
+func NewBackgroundOps(info *MR_PD_INFO) []BackgroundOp {
+	var ops []BackgroundOp
+	for _, op := range []struct {
+		bit      uint8
+		name     string
+		progress MR_PROGRESS
+	}{
+		{MR_PD_PROGRESS_REBUILD, "Rebuild", info.ProgInfo.Rbld},
+		{MR_PD_PROGRESS_PATROL, "Patrol", info.ProgInfo.Patrol},
+		{MR_PD_PROGRESS_CLEAR, "Clear", info.ProgInfo.Clear},
+	} {
+		if info.ProgInfo.Active[0]&op.bit != 0 {
+			ops = append(ops, BackgroundOp{
+				DeviceId:    info.Ref.DeviceId,
+				Operation:   op.name,
+				Percent:     op.progress.Percent(),
+				ElapsedSecs: op.progress.Mrprogress.ElapsedSecs,
+			})
+		}
+	}
+	return ops
+}
+
+// NewLdSnapshot 合并 LD 列表和 RAID 配置, cfg 为 nil 时只有列表中的状态和大小.
+// array 记录中没有 enclosure 的 device id, 成员盘的 enclosure 按 DeviceId 从 pds 中查找
+func NewLdSnapshot(cfg *Config, ld *LD_INFO, pds []PdSnapshot) LdSnapshot {
+	l := LdSnapshot{
+		TargetId:  ld.Ref.TargetId,
+		State:     ld.GetState(),
+		SizeBytes: ld.Size * SectorSz,
+	}
+	if cfg == nil {
+		return l
+	}
+	for i := range cfg.Lds {
+		ldCfg := &cfg.Lds[i]
+		if ldCfg.Properties.Ref.TargetId != ld.Ref.TargetId {
+			continue
+		}
+		l.Name = ldCfg.GetName()
+		l.RaidLevel = ldCfg.GetRaidLevel()
+		l.StripeSize = SectorSz << ldCfg.Params.StripeSize
+		l.DefaultCachePolicy = ldCfg.Properties.DefaultCachePolicy
+		l.CurrentCachePolicy = ldCfg.Properties.CurrentCachePolicy
+		l.DiskCachePolicy = ldCfg.Properties.DiskCachePolicy
+		l.AccessPolicy = ldCfg.Properties.AccessPolicy
+		l.Consistent = ldCfg.Params.IsConsistent != 0
+
+		for s := 0; s < int(ldCfg.Params.SpanDepth) && s < len(ldCfg.Span); s++ {
+			span := SpanSnapshot{ArrayRef: ldCfg.Span[s].ArrayRef, StartBlock: ldCfg.Span[s].StartBlock, NumBlocks: ldCfg.Span[s].NumBlocks}
+			for a := range cfg.Arrays {
+				array := &cfg.Arrays[a]
+				if array.ArrayRef != span.ArrayRef {
+					continue
+				}
+				for p := 0; p < int(array.NumDrives) && p < len(array.Pd); p++ {
+					drive := SpanDrive{DeviceId: array.Pd[p].Ref.DeviceId, EnclDeviceId: 0xffff, Slot: array.Pd[p].SlotNumber}
+					for _, pd := range pds {
+						if pd.DeviceId == drive.DeviceId {
+							drive.EnclDeviceId, drive.Slot = pd.EnclDeviceId, pd.Slot
+							break
+						}
+					}
+					span.Drives = append(span.Drives, drive)
+				}
+			}
+			l.Spans = append(l.Spans, span)
+		}
+	}
+	return l
+}
+
+// NewHotSpareSnapshots 返回 RAID 配置中的热备盘, cfg 为 nil 时返回 nil
+func NewHotSpareSnapshots(cfg *Config) []HotSpareSnapshot {
+	if cfg == nil {
+		return nil
+	}
+	var spares []HotSpareSnapshot
+	for _, spare := range cfg.Spares {
+		spares = append(spares, HotSpareSnapshot{
+			DeviceId:     spare.Ref.DeviceId,
+			Dedicated:    spare.SpareType&MR_SPARE_DEDICATED != 0,
+			Revertible:   spare.SpareType&MR_SPARE_REVERTIBLE != 0,
+			EnclAffinity: spare.SpareType&MR_SPARE_ENCL_AFFINITY != 0,
+			Arrays:       slices.Clone(spare.ArrayRef[:min(int(spare.ArrayCount), len(spare.ArrayRef))]),
+		})
+	}
+	return spares
+}
+
+// NewBbuSnapshot 转换 BBU 状态, 容量信息需要另外读取
+func NewBbuSnapshot(bbu *MR_BBU_STATUS) *BbuSnapshot {
+	return &BbuSnapshot{
+		Type:        bbu.BatteryType,
+		Voltage:     bbu.Voltage,
+		Current:     bbu.Current,
+		Temperature: bbu.Temperature,
+		FwStatus:    bbu.FwStatus,
+		Healthy:     bbu.Healthy(),
+	}
+}
+
+// ErrSnapshotSchema 表示 JSON 来自更新的、不兼容的 schema 版本
+var ErrSnapshotSchema = errors.New("unsupported snapshot schema version")
+
+// UnmarshalSnapshot 解析 JSON 格式的 Snapshot, SchemaVersion 比 SnapshotSchemaVersion 新时返回 ErrSnapshotSchema
+func UnmarshalSnapshot(data []byte) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.SchemaVersion < 1 || s.SchemaVersion > SnapshotSchemaVersion {
+		return nil, fmt.Errorf("%w %d", ErrSnapshotSchema, s.SchemaVersion)
+	}
+	return s, nil
+}
+
+// Controller 按 HostNo 查找控制器快照
+func (s *Snapshot) Controller(hostNo uint16) *ControllerSnapshot {
+	for i := range s.Controllers {
+		if s.Controllers[i].HostNo == hostNo {
+			return &s.Controllers[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package storcli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+// Commands 是查找厂商命令行工具的顺序, 找不到时再查这些常见的安装路径
+var Commands = []string{
+	"storcli64", "storcli", "perccli64", "perccli",
+	"/opt/MegaRAID/storcli/storcli64", "/opt/MegaRAID/perccli/perccli64",
+}
+
+// Backend 运行 storcli/perccli 并把 J 输出转换成 ioctl 路径返回的类型, 用于打不开 ioctl 设备的主机(比如受限的容器)。
+// HostNo 为 storcli 的控制器编号 /cX; BBU 状态和 RAID 配置不做转换
+type Backend struct {
+	// Run 执行一条 storcli 命令并返回输出, ctx 结束时结束命令, 测试时可以替换成读取 fixture
+	Run func(ctx context.Context, args ...string) ([]byte, error)
+}
+
+// NewBackend 使用 cmd 作为 storcli/perccli, cmd 为空时按 Commands 查找
+func NewBackend(cmd string) (*Backend, error) {
+	if cmd == "" {
+		for _, c := range Commands {
+			if p, err := exec.LookPath(c); err == nil {
+				cmd = p
+				break
+			}
+		}
+		if cmd == "" {
+			return nil, fmt.Errorf("storcli/perccli not found")
+		}
+	}
+	return &Backend{Run: func(ctx context.Context, args ...string) ([]byte, error) {
+		// storcli 出错时返回码非 0, 但 J 输出里仍有 Command Status, 由 query 处理
+		out, err := exec.CommandContext(ctx, cmd, args...).Output()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if len(out) > 0 {
+			return out, nil
+		}
+		return nil, err
+	}}, nil
+}
+
+// OpenBackend 优先使用 ioctl, ioctl 设备打不开时退回到 storcli/perccli
+func OpenBackend(cmd string) (collector.Backend, error) {
+	m, err := megaraid.CreateMegasasIoctl()
+	if err == nil {
+		return collector.IoctlBackend{MegasasIoctl: m}, nil
+	}
+	b, err2 := NewBackend(cmd)
+	if err2 != nil {
+		return nil, fmt.Errorf("ioctl: %v; %w", err, err2)
+	}
+	return b, nil
+}
+
+func (b *Backend) Close() {}
+
+// query 执行命令, 返回第一个控制器的 Response Data
+func (b *Backend) query(ctx context.Context, args ...string) (json.RawMessage, error) {
+	out, err := b.Run(ctx, append(args, "J")...)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Controllers []struct {
+			CommandStatus struct {
+				Status      string
+				Description string
+			} `json:"Command Status"`
+			ResponseData json.RawMessage `json:"Response Data"`
+		}
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.Join(args, " "), err)
+	}
+	if len(resp.Controllers) == 0 {
+		return nil, fmt.Errorf("%s: no controller in output", strings.Join(args, " "))
+	}
+	c := resp.Controllers[0]
+	if c.CommandStatus.Status != "Success" {
+		return nil, fmt.Errorf("%s: %s", strings.Join(args, " "), c.CommandStatus.Description)
+	}
+	return c.ResponseData, nil
+}
+
+// ScanHosts 返回 0..控制器数-1
+func (b *Backend) ScanHosts(ctx context.Context) ([]uint16, error) {
+	data, err := b.query(ctx, "show")
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Count int `json:"Number of Controllers"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	hosts := make([]uint16, resp.Count)
+	for i := range hosts {
+		hosts[i] = uint16(i)
+	}
+	return hosts, nil
+}
+
+func (b *Backend) Gather(ctx context.Context, hostNo uint16) (*collector.Host, error) {
+	data, err := b.query(ctx, fmt.Sprintf("/c%d", hostNo), "show", "all")
+	if err != nil {
+		return nil, err
+	}
+	h, err := ParseShowAll(data)
+	if err != nil {
+		return nil, err
+	}
+	h.Ctrl.HostNo = hostNo
+
+	if len(h.Pds) == 0 {
+		return h, nil
+	}
+	data, err = b.query(ctx, fmt.Sprintf("/c%d/eall/sall", hostNo), "show", "all")
+	if err != nil {
+		return nil, err
+	}
+	if err := ParseDrivesShowAll(data, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+type showAll struct {
+	Basics struct {
+		Model  string `json:"Model"`
+		Serial string `json:"Serial Number"`
+	} `json:"Basics"`
+	Version struct {
+		Package string `json:"Firmware Package Build"`
+		Driver  string `json:"Driver Version"`
+	} `json:"Version"`
+	Status struct {
+		MemCorrectable   uint16 `json:"Memory Correctable Errors"`
+		MemUncorrectable uint16 `json:"Memory Uncorrectable Errors"`
+	} `json:"Status"`
+	HwCfg struct {
+		BBU      string `json:"BBU"`
+		RocTemp  any    `json:"ROC temperature(Degree Celsius)"`
+		CtrlTemp any    `json:"Ctrl temperature(Degree Celsius)"`
+	} `json:"HwCfg"`
+	VdList   []map[string]any `json:"VD LIST"`
+	PdList   []map[string]any `json:"PD LIST"`
+	EnclList []map[string]any `json:"Enclosure LIST"`
+}
+
+// ParseShowAll 把 storcli /cX show all J 的 Response Data 转成 collector.Host, 物理盘只有 PD LIST 中的字段
+func ParseShowAll(data []byte) (*collector.Host, error) {
+	var resp showAll
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	ctrl := &megaraid.ControllerInfo{
+		ProductName:                resp.Basics.Model,
+		SerialNumber:               resp.Basics.Serial,
+		MemCorrectableErrorCount:   resp.Status.MemCorrectable,
+		MemUncorrectableErrorCount: resp.Status.MemUncorrectable,
+		TemperatureROC:             uint8(number(resp.HwCfg.RocTemp)),
+		TemperatureCtrl:            uint8(number(resp.HwCfg.CtrlTemp)),
+		Firmware:                   &megaraid.FirmwareInventory{PackageVersion: resp.Version.Package, DriverVersion: resp.Version.Driver},
+	}
+	ctrl.HwPresent.BBU = resp.HwCfg.BBU == "Present"
+	h := &collector.Host{Ctrl: ctrl}
+
+	for _, row := range resp.VdList {
+		var dg, vd int
+		if _, err := fmt.Sscanf(str(row["DG/VD"]), "%d/%d", &dg, &vd); err != nil {
+			return nil, fmt.Errorf("invalid DG/VD %q", row["DG/VD"])
+		}
+		ld := megaraid.LD_INFO{State: ldStateCode(str(row["State"])), Size: sectors(str(row["Size"]))}
+		ld.Ref.TargetId = uint8(vd)
+		switch ld.State {
+		case 0:
+			ctrl.LdOfflineCount++
+		case 1, 2:
+			ctrl.LdDegradedCount++
+		}
+		h.Lds = append(h.Lds, ld)
+	}
+	ctrl.LdPresentCount = uint16(len(h.Lds))
+
+	for _, row := range resp.PdList {
+		info := &megaraid.MR_PD_INFO{}
+		var eid, slot int
+		if _, err := fmt.Sscanf(str(row["EID:Slt"]), "%d:%d", &eid, &slot); err != nil {
+			// 不在 enclosure 里的盘只有 " :slot"
+			if _, err := fmt.Sscanf(strings.TrimSpace(str(row["EID:Slt"])), ":%d", &slot); err != nil {
+				return nil, fmt.Errorf("invalid EID:Slt %q", row["EID:Slt"])
+			}
+			eid = 0xffff
+		}
+		info.EnclDeviceId, info.SlotNumber = uint16(eid), uint8(slot)
+		info.Ref.DeviceId = uint16(number(row["DID"]))
+		info.FwState = uint16(pdStateCode(str(row["State"])))
+		info.MediaType = mediaTypeCode(str(row["Med"]))
+		info.InterfaceType = interfaceCode(str(row["Intf"]))
+		if str(row["SED"]) == "Y" {
+			info.Security |= 1
+		}
+		info.RawSize[0], info.RawSize[1] = split64(sectors(str(row["Size"])))
+		h.Pds = append(h.Pds, collector.Pd{Info: info, Model: strings.TrimSpace(str(row["Model"]))})
+	}
+
+	for _, row := range resp.EnclList {
+		eid := uint16(number(row["EID"]))
+		h.Enclosures = append(h.Enclosures, megaraid.MR_PD_ADDRESS{DeviceId: eid, EnclosureId: eid, ScsiDevType: 0x0d})
+	}
+	return h, nil
+}
+
+// ParseDrivesShowAll 用 storcli /cX/eall/sall show all J 的详细信息补全 h.Pds
+func ParseDrivesShowAll(data []byte, h *collector.Host) error {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+
+	for i := range h.Pds {
+		pd := &h.Pds[i]
+		info := pd.Info
+		path := fmt.Sprintf("/c%d/e%d/s%d", h.Ctrl.HostNo, info.EnclDeviceId, info.SlotNumber)
+		if info.EnclDeviceId == 0xffff {
+			path = fmt.Sprintf("/c%d/s%d", h.Ctrl.HostNo, info.SlotNumber)
+		}
+		raw, ok := resp["Drive "+path+" - Detailed Information"]
+		if !ok {
+			continue
+		}
+		var detail struct {
+			State map[string]any
+			Attrs map[string]any
+		}
+		var sections map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &sections); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for key, v := range map[string]*map[string]any{"State": &detail.State, "Device attributes": &detail.Attrs} {
+			if b, ok := sections["Drive "+path+" "+key]; ok {
+				if err := json.Unmarshal(b, v); err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+			}
+		}
+		state, attrs := detail.State, detail.Attrs
+
+		info.MediaErrCount = uint32(number(state["Media Error Count"]))
+		info.OtherErrCount = uint32(number(state["Other Error Count"]))
+		info.PredFailCount = uint32(number(state["Predictive Failure Count"]))
+		var temp int
+		if _, err := fmt.Sscanf(strings.TrimSpace(str(state["Drive Temperature"])), "%dC", &temp); err == nil {
+			info.Temperature = uint8(temp)
+		}
+		info.LinkSpeed = linkSpeedCode(str(attrs["Link Speed"]))
+		if n := sectors(str(attrs["Raw size"])); n > 0 {
+			info.RawSize[0], info.RawSize[1] = split64(n)
+		}
+		if n := sectors(str(attrs["Coerced size"])); n > 0 {
+			info.CoercedSize[0], info.CoercedSize[1] = split64(n)
+		}
+
+		pd.Serial = strings.TrimSpace(str(attrs["SN"]))
+		// 与 ioctl 的 GetWWN 一致, 否则同一块盘在两种后端下的 PdKey 不同
+		pd.WWN = megaraid.NormalizeWWN(str(attrs["WWN"]))
+		pd.Vendor = strings.TrimSpace(str(attrs["Manufacturer Id"]))
+		pd.Firmware = strings.TrimSpace(str(attrs["Firmware Revision"]))
+		if m := strings.TrimSpace(str(attrs["Model Number"])); m != "" {
+			pd.Model = m
+		}
+	}
+	return nil
+}
+
+func str(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// number 处理 storcli 里有时是数字有时是字符串的字段
+func number(v any) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f
+	}
+	return 0
+}
+
+// sectors 解析 "278.875 GB" 或 "279.396 GB [0x22ecb25c Sectors]", 返回 512 字节扇区数
+func sectors(s string) uint64 {
+	if i := strings.Index(s, "[0x"); i >= 0 {
+		var n uint64
+		if _, err := fmt.Sscanf(s[i:], "[0x%x Sectors]", &n); err == nil {
+			return n
+		}
+	}
+	var v float64
+	var unit string
+	if _, err := fmt.Sscanf(s, "%f %s", &v, &unit); err != nil {
+		return 0
+	}
+	scale := map[string]float64{"KB": megaraid.KB, "MB": megaraid.MB, "GB": megaraid.GB, "TB": megaraid.TB}[strings.ToUpper(unit)]
+	return uint64(v * scale / megaraid.SectorSz)
+}
+
+func split64(v uint64) (uint32, uint32) {
+	return uint32(v), uint32(v >> 32)
+}
+
+func ldStateCode(s string) uint8 {
+	for code := uint8(0); code <= 3; code++ {
+		if LdState(code) == s {
+			return code
+		}
+	}
+	return 0xff
+}
+
+func pdStateCode(s string) uint8 {
+	switch s {
+	case "UGood":
+		return megaraid.MR_PD_STATE_UNCONFIGURED_GOOD
+	case "UBad":
+		return megaraid.MR_PD_STATE_UNCONFIGURED_BAD
+	case "GHS", "DHS":
+		return megaraid.MR_PD_STATE_HOT_SPARE
+	case "Offln":
+		return megaraid.MR_PD_STATE_OFFLINE
+	case "Failed":
+		return megaraid.MR_PD_STATE_FAILED
+	case "Rbld":
+		return megaraid.MR_PD_STATE_REBUILD
+	case "Onln":
+		return megaraid.MR_PD_STATE_ONLINE
+	case "Cpybck":
+		return megaraid.MR_PD_STATE_COPYBACK
+	case "JBOD":
+		return megaraid.MR_PD_STATE_SYSTEM
+	}
+	return 0xff
+}
+
+func mediaTypeCode(s string) uint8 {
+	switch s {
+	case "HDD":
+		return 0
+	case "SSD":
+		return 1
+	}
+	return 0xff
+}
+
+func interfaceCode(s string) uint8 {
+	for code := uint8(1); code <= 5; code++ {
+		info := megaraid.MR_PD_INFO{InterfaceType: code}
+		if info.GetInterface() == s {
+			return code
+		}
+	}
+	return 0
+}
+
+func linkSpeedCode(s string) uint8 {
+	var v float64
+	if _, err := fmt.Sscanf(s, "%fGb/s", &v); err != nil {
+		return 0
+	}
+	for code := uint8(1); code <= 5; code++ {
+		info := megaraid.MR_PD_INFO{LinkSpeed: code}
+		if info.GetLinkSpeed() == v {
+			return code
+		}
+	}
+	return 0
+}
@@ -0,0 +1,339 @@
+// Package storcli 按 storcli 的 JSON 格式(storcli /cX show all J)输出控制器、逻辑盘、物理盘和 enclosure 的信息,
+// 现有解析 storcli 输出的脚本可以直接使用。控制器编号 /cX 为 hosts 中的下标
+package storcli
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+const CliVersion = "megaraid-go"
+
+// Object 是 JSON 中的一个对象, storcli 的 key 带空格和斜杠, 所以不用结构体
+type Object = map[string]any
+
+// Controller 是 Controllers 数组的一个元素
+type Controller struct {
+	CommandStatus CommandStatus `json:"Command Status" yaml:"Command Status"`
+	ResponseData  Object        `json:"Response Data,omitempty" yaml:"Response Data,omitempty"`
+}
+
+type CommandStatus struct {
+	CliVersion      string `json:"CLI Version" yaml:"CLI Version"`
+	OperatingSystem string `json:"Operating system" yaml:"Operating system"`
+	Controller      int    `json:"Controller" yaml:"Controller"`
+	Status          string `json:"Status" yaml:"Status"`
+	Description     string `json:"Description" yaml:"Description"`
+}
+
+// Output 是 storcli JSON 输出的最外层
+type Output struct {
+	Controllers []Controller `json:"Controllers" yaml:"Controllers"`
+}
+
+// Render 对每个控制器调用 data 生成 Response Data, data 返回错误时该控制器的 Status 为 Failure,
+// 同时返回的 Response Data 仍然输出(例如每块盘的执行结果)
+func Render(hosts []*collector.Host, data func(c int, h *collector.Host) (Object, error)) *Output {
+	out := &Output{Controllers: []Controller{}}
+	for c, h := range hosts {
+		ctrl := Controller{CommandStatus: CommandStatus{
+			CliVersion:      CliVersion,
+			OperatingSystem: runtime.GOOS,
+			Controller:      c,
+			Status:          "Success",
+			Description:     "None",
+		}}
+		resp, err := data(c, h)
+		if err != nil {
+			ctrl.CommandStatus.Status, ctrl.CommandStatus.Description = "Failure", err.Error()
+		}
+		ctrl.ResponseData = resp
+		out.Controllers = append(out.Controllers, ctrl)
+	}
+	return out
+}
+
+func (o *Output) Marshal() ([]byte, error) {
+	return json.MarshalIndent(o, "", "\t")
+}
+
+// ShowAll 对应 storcli /cX show all
+func ShowAll(c int, h *collector.Host) (Object, error) {
+	ctrl := h.Ctrl
+	resp := Object{
+		"Basics": Object{
+			"Controller":                   c,
+			"Model":                        ctrl.ProductName,
+			"Serial Number":                ctrl.SerialNumber,
+			"Current Controller Date/Time": ctrl.CurrentFwTime.Format("01/02/2006, 15:04:05"),
+			"Current System Date/time":     time.Now().Format("01/02/2006, 15:04:05"),
+		},
+		"Status": Object{
+			"Controller Status":           "Optimal",
+			"Memory Correctable Errors":   ctrl.MemCorrectableErrorCount,
+			"Memory Uncorrectable Errors": ctrl.MemUncorrectableErrorCount,
+		},
+		"HwCfg": Object{
+			"BBU":                              onOff(ctrl.HwPresent.BBU, "Present", "Absent"),
+			"ROC temperature(Degree Celsius)":  ctrl.TemperatureROC,
+			"Ctrl temperature(Degree Celsius)": ctrl.TemperatureCtrl,
+		},
+		"Virtual Drives":  len(h.Lds),
+		"VD LIST":         VdList(h),
+		"Physical Drives": len(h.Pds),
+		"PD LIST":         PdList(h),
+		"Enclosures":      len(h.Enclosures),
+		"Enclosure LIST":  EnclosureList(h),
+	}
+	if ctrl.Firmware != nil {
+		resp["Version"] = Object{
+			"Firmware Package Build": ctrl.Firmware.PackageVersion,
+			"Driver Version":         ctrl.Firmware.DriverVersion,
+		}
+	}
+	if ctrl.LdDegradedCount > 0 || ctrl.LdOfflineCount > 0 {
+		resp["Status"].(Object)["Controller Status"] = "Needs Attention"
+	}
+	return resp, nil
+}
+
+// DrivesShowAll 对应 storcli /cX/eall/sall show all, 每块盘输出 "Drive /cX/eY/sZ" 和 "Drive /cX/eY/sZ - Detailed Information"
+func DrivesShowAll(c int, h *collector.Host) (Object, error) {
+	resp := Object{}
+	for _, pd := range h.Pds {
+		path := DrivePath(c, pd.Info)
+		resp["Drive "+path] = []Object{pdRow(h, pd)}
+		resp["Drive "+path+" - Detailed Information"] = DriveDetail(path, pd)
+	}
+	return resp, nil
+}
+
+// DrivePath 返回 storcli 的物理盘路径 /cX/eY/sZ
+func DrivePath(c int, info *megaraid.MR_PD_INFO) string {
+	return fmt.Sprintf("/c%d/e%d/s%d", c, info.EnclDeviceId, info.SlotNumber)
+}
+
+// VdList 是 "VD LIST", 没有 RAID 配置时只有 LD list 里的状态和大小
+func VdList(h *collector.Host) []Object {
+	list := []Object{}
+	for i := range h.Lds {
+		ld := &h.Lds[i]
+		row := Object{
+			"DG/VD":   fmt.Sprintf("-/%d", ld.Ref.TargetId),
+			"TYPE":    "-",
+			"State":   LdState(ld.State),
+			"Access":  "-",
+			"Consist": "-",
+			"Cache":   "-",
+			"Cac":     "-",
+			"sCC":     "-",
+			"Size":    ld.GetSize(),
+			"Name":    "",
+		}
+		if cfg := ldConfig(h, ld.Ref.TargetId); cfg != nil {
+			row["DG/VD"] = fmt.Sprintf("%d/%d", cfg.Span[0].ArrayRef, ld.Ref.TargetId)
+			row["TYPE"] = cfg.GetRaidLevel()
+			row["Access"] = ldAccess(cfg.Properties.AccessPolicy)
+			row["Consist"] = onOff(cfg.Params.IsConsistent != 0, "Yes", "No")
+			row["Cache"] = ldCache(cfg.Properties.CurrentCachePolicy)
+			row["Name"] = cfg.GetName()
+		}
+		list = append(list, row)
+	}
+	return list
+}
+
+// PdList 是 "PD LIST"
+func PdList(h *collector.Host) []Object {
+	list := []Object{}
+	for _, pd := range h.Pds {
+		list = append(list, pdRow(h, pd))
+	}
+	return list
+}
+
+// EnclosureList 是 "Enclosure LIST", 只有 PD list 中能拿到的字段
+func EnclosureList(h *collector.Host) []Object {
+	list := []Object{}
+	for _, e := range h.Enclosures {
+		var pds int
+		for _, pd := range h.Pds {
+			if pd.Info.EnclDeviceId == e.DeviceId {
+				pds++
+			}
+		}
+		list = append(list, Object{
+			"EID":   e.DeviceId,
+			"State": "OK",
+			"PD":    pds,
+		})
+	}
+	return list
+}
+
+func pdRow(h *collector.Host, pd collector.Pd) Object {
+	info := pd.Info
+	dg := "-"
+	if h.Config != nil {
+		if ref, ok := h.Config.ArrayOf(info.Ref.DeviceId); ok {
+			dg = strconv.Itoa(int(ref))
+		}
+	}
+	sectorSize := int(info.UserDataBlockSize)
+	if sectorSize == 0 {
+		sectorSize = megaraid.SectorSz
+	}
+	return Object{
+		"EID:Slt": fmt.Sprintf("%d:%d", info.EnclDeviceId, info.SlotNumber),
+		"DID":     info.Ref.DeviceId,
+		"State":   PdState(h, info),
+		"DG":      dg,
+		"Size":    info.GetSize(),
+		"Intf":    info.GetInterface(),
+		"Med":     info.GetMediaType(),
+		"SED":     onOff(info.GetSecurity().FdeCapable, "Y", "N"),
+		"PI":      onOff(megaraid.BitField(info.Properties.Bits, 4, 1) == 1, "Y", "N"),
+		"SeSz":    fmt.Sprintf("%dB", sectorSize),
+		"Model":   pd.Model,
+		"Sp":      pdSpin(info.PowerState),
+		"Type":    "-",
+	}
+}
+
+// DriveDetail 是 "Drive /cX/eY/sZ - Detailed Information"
+func DriveDetail(path string, pd collector.Pd) Object {
+	info := pd.Info
+	return Object{
+		"Drive " + path + " State": Object{
+			"Media Error Count":                info.MediaErrCount,
+			"Other Error Count":                info.OtherErrCount,
+			"Drive Temperature":                fmt.Sprintf("%3dC (%.2f F)", info.Temperature, float64(info.Temperature)*9/5+32),
+			"Predictive Failure Count":         info.PredFailCount,
+			"S.M.A.R.T alert flagged by drive": onOff(info.PredFailCount > 0, "Yes", "No"),
+		},
+		"Drive " + path + " Device attributes": Object{
+			"SN":                pd.Serial,
+			"Manufacturer Id":   pd.Vendor,
+			"Model Number":      pd.Model,
+			"Firmware Revision": pd.Firmware,
+			"WWN":               pd.WWN,
+			"Raw size":          info.GetSize(),
+			"Coerced size":      megaraid.SizeString(megaraid.ArrayZip(info.CoercedSize[:], 32)),
+			"Link Speed":        fmt.Sprintf("%.1fGb/s", info.GetLinkSpeed()),
+		},
+	}
+}
+
+func ldConfig(h *collector.Host, targetId uint8) *megaraid.MR_LD_CONFIG {
+	if h.Config == nil {
+		return nil
+	}
+	for i := range h.Config.Lds {
+		if h.Config.Lds[i].Properties.Ref.TargetId == targetId {
+			return &h.Config.Lds[i]
+		}
+	}
+	return nil
+}
+
+// LdState 返回 storcli 的逻辑盘状态缩写
+func LdState(state uint8) string {
+	switch state {
+	case 0:
+		return "OfLn"
+	case 1:
+		return "Pdgd"
+	case 2:
+		return "Dgrd"
+	case 3:
+		return "Optl"
+	}
+	return "Unknown"
+}
+
+// PdState 返回 storcli 的物理盘状态缩写, 热备盘按 RAID 配置区分 GHS/DHS
+func PdState(h *collector.Host, info *megaraid.MR_PD_INFO) string {
+	switch uint8(info.FwState) {
+	case megaraid.MR_PD_STATE_UNCONFIGURED_GOOD:
+		return "UGood"
+	case megaraid.MR_PD_STATE_UNCONFIGURED_BAD:
+		return "UBad"
+	case megaraid.MR_PD_STATE_HOT_SPARE:
+		if h.Config != nil {
+			for i := range h.Config.Spares {
+				if h.Config.Spares[i].Ref.DeviceId == info.Ref.DeviceId && h.Config.Spares[i].SpareType&megaraid.MR_SPARE_DEDICATED != 0 {
+					return "DHS"
+				}
+			}
+		}
+		return "GHS"
+	case megaraid.MR_PD_STATE_OFFLINE:
+		return "Offln"
+	case megaraid.MR_PD_STATE_FAILED:
+		return "Failed"
+	case megaraid.MR_PD_STATE_REBUILD:
+		return "Rbld"
+	case megaraid.MR_PD_STATE_ONLINE:
+		return "Onln"
+	case megaraid.MR_PD_STATE_COPYBACK:
+		return "Cpybck"
+	case megaraid.MR_PD_STATE_SYSTEM:
+		return "JBOD"
+	}
+	return "Unknown"
+}
+
+func ldAccess(policy uint8) string {
+	switch policy {
+	case megaraid.MR_LD_ACCESS_RW:
+		return "RW"
+	case megaraid.MR_LD_ACCESS_READ_ONLY:
+		return "RO"
+	case megaraid.MR_LD_ACCESS_BLOCKED:
+		return "Blocked"
+	}
+	return "-"
+}
+
+// ldCache 按 storcli 的缩写输出缓存策略, 例如 RWBD、NRWTD、RAWBC
+func ldCache(policy uint8) string {
+	s := "NR"
+	if policy&megaraid.MR_LD_CACHE_READ_AHEAD != 0 {
+		s = "R"
+	}
+	switch {
+	case policy&megaraid.MR_LD_CACHE_WRITE_BACK == 0:
+		s += "WT"
+	case policy&megaraid.MR_LD_CACHE_WRITE_CACHE_BAD_BBU != 0:
+		s += "AWB"
+	default:
+		s += "WB"
+	}
+	if policy&megaraid.MR_LD_CACHE_ALLOW_READ_CACHE != 0 {
+		return s + "C"
+	}
+	return s + "D"
+}
+
+func pdSpin(powerState uint8) string {
+	switch powerState {
+	case 0:
+		return "U"
+	case 1:
+		return "D"
+	}
+	return "T"
+}
+
+func onOff(b bool, yes, no string) string {
+	if b {
+		return yes
+	}
+	return no
+}
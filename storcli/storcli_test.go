@@ -0,0 +1,82 @@
+package storcli
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+func testHost() *collector.Host {
+	pd := &megaraid.MR_PD_INFO{EnclDeviceId: 252, SlotNumber: 1, InterfaceType: 2, Temperature: 30}
+	pd.Ref.DeviceId = 8
+	pd.FwState = uint16(megaraid.MR_PD_STATE_ONLINE)
+
+	cfg := &megaraid.Config{Arrays: []megaraid.MR_ARRAY{{NumDrives: 1, ArrayRef: 0}}, Lds: []megaraid.MR_LD_CONFIG{{}}}
+	cfg.Arrays[0].Pd[0].Ref.DeviceId = 8
+	cfg.Lds[0].Params.PrimaryRaidLevel = 1
+	cfg.Lds[0].Params.SpanDepth = 1
+	cfg.Lds[0].Params.IsConsistent = 1
+	cfg.Lds[0].Properties.CurrentCachePolicy = megaraid.MR_LD_CACHE_READ_AHEAD | megaraid.MR_LD_CACHE_WRITE_BACK
+
+	return &collector.Host{
+		Ctrl:       &megaraid.ControllerInfo{ProductName: "PERC H730P Mini"},
+		Lds:        []megaraid.LD_INFO{{State: 3}},
+		Pds:        []collector.Pd{{Info: pd, Serial: "S1", Model: "ST1200MM0099"}},
+		Enclosures: []megaraid.MR_PD_ADDRESS{{DeviceId: 252}},
+		Config:     cfg,
+	}
+}
+
+// 按 storcli 的 schema 解析, 和现有脚本的用法一致
+func TestShowAll(t *testing.T) {
+	b, err := Render([]*collector.Host{testHost()}, ShowAll).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct {
+		Controllers []struct {
+			CommandStatus struct {
+				Controller int
+				Status     string
+			} `json:"Command Status"`
+			ResponseData struct {
+				VdList []map[string]any `json:"VD LIST"`
+				PdList []map[string]any `json:"PD LIST"`
+				Encl   []map[string]any `json:"Enclosure LIST"`
+			} `json:"Response Data"`
+		}
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	c := out.Controllers[0]
+	if c.CommandStatus.Status != "Success" || c.CommandStatus.Controller != 0 {
+		t.Fatalf("unexpected command status %+v", c.CommandStatus)
+	}
+	vd := c.ResponseData.VdList[0]
+	if vd["DG/VD"] != "0/0" || vd["TYPE"] != "RAID1" || vd["State"] != "Optl" || vd["Cache"] != "RWBD" || vd["Consist"] != "Yes" {
+		t.Fatalf("unexpected vd %v", vd)
+	}
+	pd := c.ResponseData.PdList[0]
+	if pd["EID:Slt"] != "252:1" || pd["DID"] != 8.0 || pd["State"] != "Onln" || pd["DG"] != "0" || pd["Intf"] != "SAS" || pd["Model"] != "ST1200MM0099" {
+		t.Fatalf("unexpected pd %v", pd)
+	}
+	if c.ResponseData.Encl[0]["PD"] != 1.0 {
+		t.Fatalf("unexpected enclosure %v", c.ResponseData.Encl)
+	}
+}
+
+func TestDrivesShowAll(t *testing.T) {
+	resp, _ := DrivesShowAll(0, testHost())
+	if _, ok := resp["Drive /c0/e252/s1"]; !ok {
+		t.Fatalf("missing drive key in %v", resp)
+	}
+	detail := resp["Drive /c0/e252/s1 - Detailed Information"].(Object)
+	state := detail["Drive /c0/e252/s1 State"].(Object)
+	if state["Drive Temperature"] != " 30C (86.00 F)" {
+		t.Fatalf("unexpected temperature %q", state["Drive Temperature"])
+	}
+}
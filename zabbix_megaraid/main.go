@@ -0,0 +1,89 @@
+// zabbix_megaraid 输出 Zabbix 低级发现(LLD)的 JSON 和单个监控项的值, 用于 UserParameter:
+//
+//	zabbix_megaraid discovery pds
+//	zabbix_megaraid item pd 0 252 3 media_errors
+//
+// 出错时输出 ZBX_NOTSUPPORTED 和原因, 监控项变为不支持而不是得到错误的值
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ishmaelwanglin/megaraid/collector"
+	"github.com/ishmaelwanglin/megaraid/storcli"
+)
+
+func main() {
+	storcliCmd := flag.String("storcli", "", "storcli/perccli to use when the ioctl device cannot be opened, searched in PATH if empty")
+	// zabbix agent 默认的 Timeout 是 3 秒, UserParameter 超时后结果会被丢弃
+	timeout := flag.Duration("timeout", 3*time.Second, "give up when the controller does not answer within this duration")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-storcli path] discovery <controllers|lds|pds|enclosures>\n       %s [-storcli path] item <ctrl|ld|pd> <host> ... <key>\n", os.Args[0], os.Args[0])
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	v, err := run(ctx, *storcliCmd, args)
+	if err != nil {
+		// UserParameter 的输出以 ZBX_NOTSUPPORTED 开头时监控项变为不支持, \0 后面是原因
+		fmt.Printf("ZBX_NOTSUPPORTED\x00%v\n", err)
+		return
+	}
+	fmt.Println(v)
+}
+
+func run(ctx context.Context, storcliCmd string, args []string) (string, error) {
+	b, err := storcli.OpenBackend(storcliCmd)
+	if err != nil {
+		return "", err
+	}
+	defer b.Close()
+
+	switch args[0] {
+	case "discovery":
+		hostNos, err := b.ScanHosts(ctx)
+		if err != nil {
+			return "", err
+		}
+		var hosts []*collector.Host
+		for _, hostNo := range hostNos {
+			h, err := b.Gather(ctx, hostNo)
+			if err != nil {
+				return "", fmt.Errorf("host %d: %w", hostNo, err)
+			}
+			// 缺少对象的发现结果会让 Zabbix 把对应的监控项当作丢失的资源删除
+			if len(h.Errors) > 0 {
+				return "", fmt.Errorf("host %d: %s", hostNo, strings.Join(h.Errors, "; "))
+			}
+			hosts = append(hosts, h)
+		}
+		data, err := Discovery(hosts, args[1])
+		if err != nil {
+			return "", err
+		}
+		out, err := json.Marshal(data)
+		return string(out), err
+	case "item":
+		// 只读取监控项所在的控制器
+		hostNo, err := ItemHost(args[1:])
+		if err != nil {
+			return "", err
+		}
+		h, err := b.Gather(ctx, hostNo)
+		if err != nil {
+			return "", fmt.Errorf("host %d: %w", hostNo, err)
+		}
+		return Item(h, args[1:])
+	}
+	return "", fmt.Errorf("unknown mode %q", args[0])
+}
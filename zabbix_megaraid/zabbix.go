@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+// Discovery 返回 Zabbix LLD 的数据, 每个元素是一组 {#MACRO}
+func Discovery(hosts []*collector.Host, kind string) ([]map[string]string, error) {
+	data := []map[string]string{}
+	for _, h := range hosts {
+		host := strconv.Itoa(int(h.Ctrl.HostNo))
+		switch kind {
+		case "controllers":
+			data = append(data, map[string]string{
+				"{#HOST}":    host,
+				"{#PRODUCT}": h.Ctrl.ProductName,
+				"{#SERIAL}":  h.Ctrl.SerialNumber,
+			})
+		case "lds":
+			for i := range h.Lds {
+				data = append(data, map[string]string{
+					"{#HOST}":     host,
+					"{#TARGETID}": strconv.Itoa(int(h.Lds[i].Ref.TargetId)),
+					"{#SIZE}":     h.Lds[i].GetSize(),
+				})
+			}
+		case "pds":
+			for _, pd := range h.Pds {
+				data = append(data, map[string]string{
+					"{#HOST}":   host,
+					"{#EID}":    strconv.Itoa(int(pd.Info.EnclDeviceId)),
+					"{#SLOT}":   strconv.Itoa(int(pd.Info.SlotNumber)),
+					"{#DID}":    strconv.Itoa(int(pd.Info.Ref.DeviceId)),
+					"{#SERIAL}": pd.Serial,
+					"{#WWN}":    pd.WWN,
+					"{#MEDIA}":  pd.Info.GetMediaType(),
+				})
+			}
+		case "enclosures":
+			for _, e := range h.Enclosures {
+				var slots int
+				for _, pd := range h.Pds {
+					if pd.Info.EnclDeviceId == e.DeviceId {
+						slots++
+					}
+				}
+				data = append(data, map[string]string{
+					"{#HOST}":    host,
+					"{#EID}":     strconv.Itoa(int(e.DeviceId)),
+					"{#SASADDR}": e.GetSasAddrs(),
+					"{#PDS}":     strconv.Itoa(slots),
+				})
+			}
+		default:
+			return nil, fmt.Errorf("unknown discovery %q, want controllers, lds, pds or enclosures", kind)
+		}
+	}
+	return data, nil
+}
+
+// ItemHost 返回监控项所在控制器的 host 号, args 同 Item
+func ItemHost(args []string) (uint16, error) {
+	if len(args) < 3 {
+		return 0, fmt.Errorf("usage: ctrl <host> <key> | ld <host> <targetId> <key> | pd <host> <eid> <slot> <key>")
+	}
+	hostNo, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid host %q", args[1])
+	}
+	return uint16(hostNo), nil
+}
+
+// Item 返回 h 上一个监控项的值, args 为 ctrl <host> <key>, ld <host> <targetId> <key> 或 pd <host> <eid> <slot> <key>
+func Item(h *collector.Host, args []string) (string, error) {
+	hostNo, err := ItemHost(args)
+	if err != nil {
+		return "", err
+	}
+	if h.Ctrl.HostNo != hostNo {
+		return "", fmt.Errorf("host %d not found", hostNo)
+	}
+
+	switch {
+	case args[0] == "ctrl" && len(args) == 3:
+		return ctrlItem(h, args[2])
+	case args[0] == "ld" && len(args) == 4:
+		id, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "", err
+		}
+		for i := range h.Lds {
+			if int(h.Lds[i].Ref.TargetId) == id {
+				return ldItem(h, i, args[3])
+			}
+		}
+		return "", notFound(h, fmt.Sprintf("ld %d", id))
+	case args[0] == "pd" && len(args) == 5:
+		eid, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "", err
+		}
+		slot, err := strconv.Atoi(args[3])
+		if err != nil {
+			return "", err
+		}
+		for _, pd := range h.Pds {
+			if int(pd.Info.EnclDeviceId) == eid && int(pd.Info.SlotNumber) == slot {
+				return pdItem(pd, args[4])
+			}
+		}
+		return "", notFound(h, fmt.Sprintf("pd %d:%d", eid, slot))
+	}
+	return "", fmt.Errorf("invalid item %v", args)
+}
+
+// notFound 返回对象不存在的错误, 读取时跳过了对象的话附上原因
+func notFound(h *collector.Host, object string) error {
+	if len(h.Errors) > 0 {
+		return fmt.Errorf("%s not found on host %d, skipped: %s", object, h.Ctrl.HostNo, strings.Join(h.Errors, "; "))
+	}
+	return fmt.Errorf("%s not found on host %d", object, h.Ctrl.HostNo)
+}
+
+func ctrlItem(h *collector.Host, key string) (string, error) {
+	c := h.Ctrl
+	switch key {
+	case "product":
+		return c.ProductName, nil
+	case "serial":
+		return c.SerialNumber, nil
+	case "temperature_roc":
+		return fmt.Sprint(c.TemperatureROC), nil
+	case "temperature_ctrl":
+		return fmt.Sprint(c.TemperatureCtrl), nil
+	case "mem_correctable":
+		return fmt.Sprint(c.MemCorrectableErrorCount), nil
+	case "mem_uncorrectable":
+		return fmt.Sprint(c.MemUncorrectableErrorCount), nil
+	case "ld_present":
+		return fmt.Sprint(c.LdPresentCount), nil
+	case "ld_degraded":
+		return fmt.Sprint(c.LdDegradedCount), nil
+	case "ld_offline":
+		return fmt.Sprint(c.LdOfflineCount), nil
+	case "bbu_healthy":
+		if h.Bbu != nil && h.Bbu.Healthy() {
+			return "1", nil
+		}
+		return "0", nil
+	}
+	return "", fmt.Errorf("unknown controller key %q", key)
+}
+
+func ldItem(h *collector.Host, i int, key string) (string, error) {
+	switch key {
+	case "state":
+		return h.Lds[i].GetState(), nil
+	case "size":
+		return fmt.Sprint(h.Lds[i].Size), nil
+	}
+	return "", fmt.Errorf("unknown ld key %q", key)
+}
+
+func pdItem(pd collector.Pd, key string) (string, error) {
+	info := pd.Info
+	switch key {
+	case "state":
+		return info.GetFwState(), nil
+	case "serial":
+		return pd.Serial, nil
+	case "wwn":
+		return pd.WWN, nil
+	case "media_errors":
+		return fmt.Sprint(info.MediaErrCount), nil
+	case "other_errors":
+		return fmt.Sprint(info.OtherErrCount), nil
+	case "predictive_failures":
+		return fmt.Sprint(info.PredFailCount), nil
+	case "temperature":
+		return fmt.Sprint(info.Temperature), nil
+	case "link_speed":
+		return fmt.Sprint(info.GetLinkSpeed()), nil
+	}
+	return "", fmt.Errorf("unknown pd key %q", key)
+}
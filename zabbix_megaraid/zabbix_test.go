@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ishmaelwanglin/megaraid"
+	"github.com/ishmaelwanglin/megaraid/collector"
+)
+
+func TestDiscoveryAndItem(t *testing.T) {
+	pd := &megaraid.MR_PD_INFO{Temperature: 38, EnclDeviceId: 252, SlotNumber: 3}
+	pd.FwState = uint16(megaraid.MR_PD_STATE_ONLINE)
+	hosts := []*collector.Host{{
+		Ctrl:       &megaraid.ControllerInfo{HostNo: 1},
+		Lds:        []megaraid.LD_INFO{{State: 3}},
+		Pds:        []collector.Pd{{Info: pd, Serial: "S1"}},
+		Enclosures: []megaraid.MR_PD_ADDRESS{{DeviceId: 252, EnclosureId: 252, ScsiDevType: 0x0d}},
+	}}
+
+	data, err := Discovery(hosts, "pds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0]["{#HOST}"] != "1" || data[0]["{#EID}"] != "252" || data[0]["{#SLOT}"] != "3" || data[0]["{#SERIAL}"] != "S1" {
+		t.Fatalf("unexpected pd discovery %v", data)
+	}
+	if data, _ = Discovery(hosts, "enclosures"); len(data) != 1 || data[0]["{#PDS}"] != "1" {
+		t.Fatalf("unexpected enclosure discovery %v", data)
+	}
+	if _, err := Discovery(hosts, "disks"); err == nil {
+		t.Fatal("unknown discovery must fail")
+	}
+
+	for args, want := range map[[5]string]string{
+		{"pd", "1", "252", "3", "temperature"}: "38",
+		{"pd", "1", "252", "3", "state"}:       "Online",
+		{"ld", "1", "0", "state"}:              "Optimal",
+		{"ctrl", "1", "bbu_healthy"}:           "0",
+	} {
+		n := 5
+		for n > 0 && args[n-1] == "" {
+			n--
+		}
+		v, err := Item(hosts[0], args[:n])
+		if err != nil || v != want {
+			t.Fatalf("%v: got %q %v, want %q", args, v, err, want)
+		}
+	}
+	if _, err := Item(hosts[0], []string{"pd", "1", "252", "4", "state"}); err == nil {
+		t.Fatal("missing pd must fail")
+	}
+	if _, err := Item(hosts[0], []string{"ctrl", "2", "product"}); err == nil {
+		t.Fatal("item on another host must fail")
+	}
+	if hostNo, err := ItemHost([]string{"pd", "1", "252", "3", "state"}); err != nil || hostNo != 1 {
+		t.Fatalf("ItemHost = %d %v", hostNo, err)
+	}
+	// 读取失败跳过的 PD 报告原因
+	hosts[0].Errors = []string{"pd 9: timeout"}
+	if _, err := Item(hosts[0], []string{"pd", "1", "252", "4", "state"}); err == nil || !strings.Contains(err.Error(), "pd 9: timeout") {
+		t.Fatalf("missing pd on a partial snapshot: %v", err)
+	}
+}